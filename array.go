@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"encoding/binary"
+	"errors"
 	"reflect"
 )
 
@@ -11,32 +12,69 @@ type Array struct {
 	value reflect.Value
 }
 
-func NewArray(x interface{}) *Array {
+// NewArray returns the Java array of the elements of x, a slice or an
+// array. Elements of type int, uint and uintptr are long, as in
+// Encoder.WriteObject.
+func NewArray(x interface{}) (*Array, error) {
 	value := reflect.ValueOf(x)
 	if !value.IsValid() {
-		panic("NewArray: value must be valid")
+		return nil, errors.New("NewArray: value must be valid")
 	}
 	if kind := value.Kind(); kind != reflect.Array && kind != reflect.Slice {
-		panic("NewArray: value must be an array or a slice")
+		return nil, &UnsupportedTypeError{
+			Type: value.Type(),
+			Msg:  "NewArray: value must be an array or a slice",
+		}
+	}
+	if elem := unpackPointerType(value.Type().Elem()); elem.Kind() != reflect.Interface {
+		if _, err := fieldDescriptor(elem); err != nil {
+			return nil, err
+		}
 	}
 	return &Array{
 		value: value,
+	}, nil
+}
+
+// MustNewArray is like NewArray but panics if x cannot be serialized as
+// an array.
+func MustNewArray(x interface{}) *Array {
+	array, err := NewArray(x)
+	if err != nil {
+		panic(err)
 	}
+	return array
 }
 
+// ClassName returns the name of the array class, as returned by
+// Class.getName, e.g. "[Ljava.lang.String;". The element class of a slice
+// of interfaces is taken from its first element.
 func (array *Array) ClassName() string {
-	return fieldDescriptor(array.value.Type())
+	name, err := arrayClassName(array)
+	if err != nil {
+		return ""
+	}
+	return name
 }
 
+// SerialVersionUID returns the default serialVersionUID of the array class,
+// which depends on its name and on whether its component class is public.
 func (array *Array) SerialVersionUID() int64 {
 	var buf bytes.Buffer
-	w, err := NewEncoder(&buf)
-	if err != nil {
-		return 0
+	w := NewDataWriter(&buf)
+	_ = w.WriteUTF(array.ClassName())
+	// Arrays are final and abstract, and take the access of their
+	// innermost component class.
+	mods := int32(modifierFinal | modifierAbstract)
+	typ := arrayElemType(array)
+	for typ.Kind() == reflect.Slice || typ.Kind() == reflect.Array {
+		typ = unpackPointerType(typ.Elem())
+	}
+	if m, ok := reflect.New(typ).Interface().(ClassModifiers); !ok || m.ClassModifiers()&modifierPublic != 0 {
+		mods |= modifierPublic
 	}
-	_ = w.writeUTF(array.ClassName())
-	_ = w.writeBinary(int32(1 | 16 | 1024)) // Modifier.PUBLIC | Modifier.FINAL | Modifier.ABSTRACT
-	hashBytes := sha1.Sum(buf.Bytes()[4:])
+	_ = w.WriteInt(mods)
+	hashBytes := sha1.Sum(buf.Bytes())
 	return int64(binary.LittleEndian.Uint64(hashBytes[:8]))
 }
 
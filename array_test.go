@@ -7,9 +7,34 @@ import (
 )
 
 func TestArray_ClassName(t *testing.T) {
-	assert.Equal(t, "[[I", NewArray([][]int32{}).ClassName())
+	assert.Equal(t, "[[I", MustNewArray([][]int32{}).ClassName())
 }
 
+type packagePrivateClass struct{}
+
+func (packagePrivateClass) ClassName() string { return "com.example.Hidden" }
+
+func (packagePrivateClass) ClassModifiers() int32 { return 0 }
+
 func TestArray_SerialVersionUID(t *testing.T) {
-	assert.Equal(t, int64(1727100010502261052), NewArray([][]int32{}).SerialVersionUID())
+	assert.Equal(t, int64(1727100010502261052), MustNewArray([][]int32{}).SerialVersionUID())
+	stringSUID := uint64(0xadd256e7e91d7b47)
+	assert.Equal(t, int64(stringSUID), MustNewArray([]*String{}).SerialVersionUID())
+	assert.Equal(t, "[Lcom.example.Hidden;", MustNewArray([]*packagePrivateClass{}).ClassName())
+	assert.Equal(t, int64(6679132931871235544), MustNewArray([]*packagePrivateClass{}).SerialVersionUID())
+}
+
+func TestNewArray(t *testing.T) {
+	_, err := NewArray(nil)
+	assert.Error(t, err)
+	_, err = NewArray(int32(1))
+	assert.Error(t, err)
+	_, err = NewArray([]map[string]int32{})
+	assert.Error(t, err)
+	_, err = NewArray([]noClassName{})
+	assert.Error(t, err)
+	array, err := NewArray([]*String{{Value: "foo"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "[Ljava.lang.String;", array.ClassName())
+	assert.Panics(t, func() { MustNewArray(int32(1)) })
 }
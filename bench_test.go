@@ -0,0 +1,328 @@
+package javaio
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type benchRecord struct {
+	ID     int32 `javaio:"id"`
+	Count  int64
+	Score  float64
+	Active bool
+	Name   *String
+	Parent *benchRecord
+}
+
+func (benchRecord) ClassName() string {
+	return "BenchRecord"
+}
+
+func (benchRecord) SerialVersionUID() int64 {
+	return 1
+}
+
+// ClassModifiers reports BenchRecord as package-private, as it is declared
+// in GenerateFixtures.java; this changes the SUID of BenchRecord[].
+func (benchRecord) ClassModifiers() int32 {
+	return 0
+}
+
+type benchWide struct {
+	B1, B2, B3, B4 byte
+	S1, S2, S3, S4 int16
+	I1, I2, I3, I4 int32
+	J1, J2, J3, J4 int64
+	F1, F2, F3, F4 float32
+	D1, D2, D3, D4 float64
+	Z1, Z2, Z3, Z4 bool
+}
+
+func (benchWide) ClassName() string {
+	return "BenchWide"
+}
+
+func (benchWide) SerialVersionUID() int64 {
+	return 1
+}
+
+// benchList returns a List of n nodes.
+func benchList(n int) *List {
+	var list *List
+	for i := n - 1; i >= 0; i-- {
+		list = &List{Value: int32(i), Next: list}
+	}
+	return list
+}
+
+// benchGraph returns n records, each referring to the one before it. The
+// names are drawn from a small set, so most of them are back-references.
+func benchGraph(n int) []*benchRecord {
+	names := make([]*String, 16)
+	for i := range names {
+		names[i] = &String{Value: "record-" + strconv.Itoa(i)}
+	}
+	records := make([]*benchRecord, n)
+	for i := range records {
+		records[i] = &benchRecord{
+			ID:     int32(i),
+			Count:  int64(i) * 1000,
+			Score:  float64(i) / 3,
+			Active: i%2 == 0,
+			Name:   names[i%len(names)],
+		}
+		if i > 0 {
+			records[i].Parent = records[i-1]
+		}
+	}
+	return records
+}
+
+func benchWideObjects(n int) []*benchWide {
+	objects := make([]*benchWide, n)
+	for i := range objects {
+		objects[i] = &benchWide{
+			B1: byte(i), I1: int32(i), J1: int64(i), F1: float32(i), D1: float64(i), Z1: true,
+			S4: int16(i), I4: -int32(i), J4: -int64(i), D4: -float64(i),
+		}
+	}
+	return objects
+}
+
+func benchLinkedList(n int) *LinkedList {
+	list := &LinkedList{Values: make([]interface{}, n)}
+	for i := range list.Values {
+		list.Values[i] = &String{Value: strconv.Itoa(i)}
+	}
+	return list
+}
+
+var benchCases = []struct {
+	name     string
+	object   func() interface{}
+	register func(dec *Decoder) // nil if the Decoder cannot read the object
+}{
+	{
+		name:   "Flat",
+		object: func() interface{} { return &List{Value: 17} },
+		register: func(dec *Decoder) {
+			dec.RegisterType("List", reflect.TypeOf(List{}))
+		},
+	},
+	{
+		name:   "LinkedList1000",
+		object: func() interface{} { return benchList(1000) },
+		register: func(dec *Decoder) {
+			dec.RegisterType("List", reflect.TypeOf(List{}))
+		},
+	},
+	{
+		name:   "Wide1000",
+		object: func() interface{} { return benchWideObjects(1000) },
+		register: func(dec *Decoder) {
+			dec.RegisterType("BenchWide", reflect.TypeOf(benchWide{}))
+		},
+	},
+	{
+		name: "ByteArray64K",
+		object: func() interface{} {
+			return make([]byte, 64<<10)
+		},
+		register: func(dec *Decoder) {},
+	},
+	{
+		name: "IntArray16K",
+		object: func() interface{} {
+			return make([]int32, 16<<10)
+		},
+		register: func(dec *Decoder) {},
+	},
+	{
+		name:   "StringGraph5000",
+		object: func() interface{} { return benchGraph(5000) },
+		register: func(dec *Decoder) {
+			dec.RegisterType("BenchRecord", reflect.TypeOf(benchRecord{}))
+		},
+	},
+	{
+		name:   "CustomWriteObject1000",
+		object: func() interface{} { return benchLinkedList(1000) },
+		register: func(dec *Decoder) {
+			dec.RegisterType("java.util.LinkedList", reflect.TypeOf(LinkedList{}))
+		},
+	},
+}
+
+func encodeBench(tb testing.TB, object interface{}) []byte {
+	var buf bytes.Buffer
+	enc, err := NewEncoder(&buf)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := enc.WriteObject(object); err != nil {
+		tb.Fatal(err)
+	}
+	if err := enc.Flush(); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decodeBench(tb testing.TB, p []byte, register func(dec *Decoder)) interface{} {
+	dec, err := NewDecoder(bytes.NewReader(p))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	register(dec)
+	object, err := dec.ReadObject()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return object
+}
+
+func BenchmarkEncoder(b *testing.B) {
+	for _, bc := range benchCases {
+		b.Run(bc.name, func(b *testing.B) {
+			object := bc.object()
+			b.SetBytes(int64(len(encodeBench(b, object))))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				encodeBench(b, object)
+			}
+		})
+	}
+}
+
+func BenchmarkDecoder(b *testing.B) {
+	for _, bc := range benchCases {
+		if bc.register == nil {
+			continue
+		}
+		b.Run(bc.name, func(b *testing.B) {
+			p := encodeBench(b, bc.object())
+			b.SetBytes(int64(len(p)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				decodeBench(b, p, bc.register)
+			}
+		})
+	}
+}
+
+// The fixtures in testdata/bench are written by ObjectOutputStream; see
+// testdata/bench/GenerateFixtures.java and "make bench-fixtures".
+var benchFixtures = []struct {
+	file   string
+	object func() interface{}
+	name   string // of the matching benchCase
+}{
+	{"list_1000.ser", func() interface{} { return benchList(1000) }, "LinkedList1000"},
+	{"records_5000.ser", func() interface{} { return benchGraph(5000) }, "StringGraph5000"},
+	{"linked_list_1000.ser", func() interface{} { return benchLinkedList(1000) }, "CustomWriteObject1000"},
+}
+
+func readBenchFixture(tb testing.TB, file string) []byte {
+	p, err := ioutil.ReadFile(filepath.Join("testdata", "bench", file))
+	if os.IsNotExist(err) {
+		tb.Skipf("%s not generated; run make bench-fixtures", file)
+	}
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return p
+}
+
+func benchCaseRegister(name string) func(dec *Decoder) {
+	for _, bc := range benchCases {
+		if bc.name == name {
+			return bc.register
+		}
+	}
+	return nil
+}
+
+func BenchmarkDecoder_JavaFixtures(b *testing.B) {
+	for _, fixture := range benchFixtures {
+		b.Run(fixture.name, func(b *testing.B) {
+			p := readBenchFixture(b, fixture.file)
+			register := benchCaseRegister(fixture.name)
+			b.SetBytes(int64(len(p)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				decodeBench(b, p, register)
+			}
+		})
+	}
+}
+
+// TestEncoder_JavaFixtures checks that the benchmarks measure the same
+// streams that ObjectOutputStream writes.
+func TestEncoder_JavaFixtures(t *testing.T) {
+	for _, fixture := range benchFixtures {
+		t.Run(fixture.name, func(t *testing.T) {
+			p := readBenchFixture(t, fixture.file)
+			if !bytes.Equal(p, encodeBench(t, fixture.object())) {
+				t.Errorf("encoded stream differs from %s", fixture.file)
+			}
+		})
+	}
+}
+
+// TestBenchFixtureClasses checks that the fields of the Go types match
+// the classes declared in GenerateFixtures.java, even where the fixtures
+// have not been generated.
+func TestBenchFixtureClasses(t *testing.T) {
+	p, err := ioutil.ReadFile(filepath.Join("testdata", "bench", "GenerateFixtures.java"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	javaTypeCodes := map[string]byte{"int": 'I', "long": 'J', "double": 'D', "boolean": 'Z'}
+	for _, c := range []struct {
+		class string
+		typ   reflect.Type
+	}{
+		{"List", reflect.TypeOf(List{})},
+		{"BenchRecord", reflect.TypeOf(benchRecord{})},
+	} {
+		body := regexp.MustCompile(`(?s)class ` + c.class + ` implements Serializable \{(.*?)\n\}`).FindSubmatch(p)
+		if body == nil {
+			t.Fatalf("class %s not found", c.class)
+		}
+		want := map[string]byte{}
+		for _, m := range regexp.MustCompile(`(?m)^\s+(\w+) (\w+);$`).FindAllSubmatch(body[1], -1) {
+			code, ok := javaTypeCodes[string(m[1])]
+			if !ok {
+				code = 'L'
+			}
+			want[string(m[2])] = code
+		}
+		got := map[string]byte{}
+		for _, f := range cachedStructInfo(c.typ).fields {
+			got[f.name] = f.typeCode
+		}
+		assert.Equal(t, want, got, c.class)
+	}
+}
+
+func TestBenchCases(t *testing.T) {
+	for _, bc := range benchCases {
+		if bc.register == nil {
+			continue
+		}
+		t.Run(bc.name, func(t *testing.T) {
+			decodeBench(t, encodeBench(t, bc.object()), bc.register)
+		})
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	javaio "github.com/lujjjh/go-javaio"
+	"github.com/lujjjh/go-javaio/internal/stream"
+)
+
+// dumper prints stream contents as an indented tree. Every line that
+// starts a content is prefixed with the offset of its first byte.
+type dumper struct {
+	w      io.Writer
+	indent int
+	err    error
+}
+
+func (d *dumper) printf(offset int64, format string, args ...interface{}) {
+	if d.err != nil {
+		return
+	}
+	prefix := strings.Repeat(" ", 10)
+	if offset >= 0 {
+		prefix = fmt.Sprintf("%08x: ", offset)
+	}
+	_, d.err = fmt.Fprintf(d.w, "%s%s%s\n", prefix, strings.Repeat("  ", d.indent), fmt.Sprintf(format, args...))
+}
+
+func (d *dumper) nest(f func()) {
+	d.indent++
+	f()
+	d.indent--
+}
+
+func dump(w io.Writer, contents []stream.Content) error {
+	d := &dumper{w: w}
+	for _, c := range contents {
+		d.content("", c)
+	}
+	return d.err
+}
+
+// content prints c, prefixing its first line with label.
+func (d *dumper) content(label string, c stream.Content) {
+	switch c := c.(type) {
+	case *stream.Null:
+		d.printf(c.Pos, "%sTC_NULL", label)
+	case *stream.Reference:
+		d.printf(c.Pos, "%sTC_REFERENCE %#x -> %s", label, c.Handle, summary(c.Target))
+	case *stream.String:
+		d.printf(c.Pos, "%s%s %#x %q", label, stringTypeCode(c), c.Handle, c.Value)
+	case *stream.ClassDesc:
+		d.classDesc(label, c)
+	case *stream.Object:
+		d.object(label, c)
+	case *stream.Array:
+		d.array(label, c)
+	case *stream.Enum:
+		d.printf(c.Pos, "%sTC_ENUM %#x %s", label, c.Handle, className(c.Class))
+		d.nest(func() {
+			d.content("classDesc: ", c.Class)
+			if c.Constant != nil {
+				d.content("constant: ", c.Constant)
+			}
+		})
+	case *stream.Class:
+		d.printf(c.Pos, "%sTC_CLASS %#x %s", label, c.Handle, className(c.Class))
+		d.nest(func() {
+			d.content("classDesc: ", c.Class)
+		})
+	case *stream.BlockData:
+		d.blockData(label, c)
+	case *stream.Reset:
+		d.printf(c.Pos, "%sTC_RESET", label)
+	case *stream.Exception:
+		d.printf(c.Pos, "%sTC_EXCEPTION", label)
+		d.nest(func() {
+			if c.Throwable != nil {
+				d.content("throwable: ", c.Throwable)
+			}
+		})
+	case *stream.EndBlockData:
+		d.printf(c.Pos, "%sTC_ENDBLOCKDATA", label)
+	case nil:
+		d.printf(-1, "%s<missing>", label)
+	}
+}
+
+func (d *dumper) classDesc(label string, desc *stream.ClassDesc) {
+	if desc.Proxy {
+		d.printf(desc.Pos, "%sTC_PROXYCLASSDESC %#x", label, desc.Handle)
+	} else {
+		d.printf(desc.Pos, "%sTC_CLASSDESC %#x %s", label, desc.Handle, desc.Name)
+	}
+	d.nest(func() {
+		if desc.Proxy {
+			d.printf(-1, "interfaces: %s", strings.Join(desc.Interfaces, ", "))
+		} else {
+			d.printf(-1, "serialVersionUID: %#016x (%d)", uint64(desc.SerialVersionUID), desc.SerialVersionUID)
+			d.printf(-1, "flags: %#02x %s", desc.Flags, flagNames(desc.Flags))
+			d.printf(-1, "fields: %d", len(desc.Fields))
+			d.nest(func() {
+				for _, field := range desc.Fields {
+					if field.ClassName == nil {
+						d.printf(field.Pos, "%c %s", field.TypeCode, field.Name)
+						continue
+					}
+					d.content(fmt.Sprintf("%c %s: ", field.TypeCode, field.Name), field.ClassName)
+				}
+			})
+		}
+		d.annotations(desc.Annotations)
+		if desc.Super != nil {
+			d.content("superClassDesc: ", desc.Super)
+		}
+	})
+}
+
+func (d *dumper) annotations(contents []stream.Content) {
+	if len(contents) == 0 {
+		return
+	}
+	d.printf(-1, "annotations: %d", len(contents))
+	d.nest(func() {
+		for _, c := range contents {
+			d.content("", c)
+		}
+	})
+}
+
+func (d *dumper) object(label string, obj *stream.Object) {
+	d.printf(obj.Pos, "%sTC_OBJECT %#x %s", label, obj.Handle, className(obj.Class))
+	d.nest(func() {
+		d.content("classDesc: ", obj.Class)
+		if len(obj.ClassData) == 0 {
+			return
+		}
+		d.printf(-1, "classdata:")
+		d.nest(func() {
+			for _, data := range obj.ClassData {
+				d.printf(-1, "%s:", data.Class.Name)
+				d.nest(func() {
+					for _, value := range data.Values {
+						d.value(value.Name+": ", value)
+					}
+					d.annotations(data.Annotations)
+				})
+			}
+		})
+	})
+}
+
+func (d *dumper) array(label string, array *stream.Array) {
+	length := len(array.Values)
+	if array.Bytes != nil {
+		length = len(array.Bytes)
+	}
+	d.printf(array.Pos, "%sTC_ARRAY %#x %s (%d elements)", label, array.Handle, className(array.Class), length)
+	d.nest(func() {
+		d.content("classDesc: ", array.Class)
+		if array.Bytes != nil {
+			d.hexDump(array.BytesPos, array.Bytes)
+			return
+		}
+		for i, value := range array.Values {
+			d.value(fmt.Sprintf("[%d]: ", i), value)
+		}
+	})
+}
+
+func (d *dumper) value(label string, value *stream.Value) {
+	if value.Object != nil {
+		d.content(label, value.Object)
+		return
+	}
+	if value.TypeCode == 'C' {
+		d.printf(value.Pos, "%s(char) %q", label, rune(value.Primitive.(uint16)))
+		return
+	}
+	d.printf(value.Pos, "%s(%s) %v", label, primitiveName(value.TypeCode), value.Primitive)
+}
+
+func (d *dumper) blockData(label string, block *stream.BlockData) {
+	tc := "TC_BLOCKDATA"
+	if len(block.Data) > 0xff {
+		tc = "TC_BLOCKDATALONG"
+	}
+	d.printf(block.Pos, "%s%s %d bytes", label, tc, len(block.Data))
+	d.nest(func() {
+		header := int64(2)
+		if len(block.Data) > 0xff {
+			header = 5
+		}
+		d.hexDump(block.Pos+header, block.Data)
+	})
+}
+
+func (d *dumper) hexDump(offset int64, p []byte) {
+	for i := 0; i < len(p); i += 16 {
+		line := p[i:]
+		if len(line) > 16 {
+			line = line[:16]
+		}
+		var hex, text strings.Builder
+		for j, b := range line {
+			if j == 8 {
+				hex.WriteByte(' ')
+			}
+			fmt.Fprintf(&hex, "%02x ", b)
+			if b >= 0x20 && b < 0x7f {
+				text.WriteByte(b)
+			} else {
+				text.WriteByte('.')
+			}
+		}
+		d.printf(offset+int64(i), "%-49s |%s|", hex.String(), text.String())
+	}
+}
+
+func stringTypeCode(s *stream.String) string {
+	if s.Long {
+		return "TC_LONGSTRING"
+	}
+	return "TC_STRING"
+}
+
+func className(c stream.Content) string {
+	if desc := stream.Resolve(c); desc != nil {
+		if desc.Proxy {
+			return "<proxy>"
+		}
+		return desc.Name
+	}
+	return "<null>"
+}
+
+// summary describes the target of a back-reference on a single line.
+func summary(c stream.Content) string {
+	switch c := c.(type) {
+	case *stream.String:
+		return fmt.Sprintf("%s %q", stringTypeCode(c), c.Value)
+	case *stream.ClassDesc:
+		if c.Proxy {
+			return "TC_PROXYCLASSDESC"
+		}
+		return "TC_CLASSDESC " + c.Name
+	case *stream.Object:
+		return "TC_OBJECT " + className(c.Class)
+	case *stream.Array:
+		return "TC_ARRAY " + className(c.Class)
+	case *stream.Enum:
+		return "TC_ENUM " + className(c.Class)
+	case *stream.Class:
+		return "TC_CLASS " + className(c.Class)
+	}
+	return fmt.Sprintf("%T", c)
+}
+
+func flagNames(flags byte) string {
+	var names []string
+	for _, flag := range []struct {
+		value byte
+		name  string
+	}{
+		{javaio.ScWriteMethod, "SC_WRITE_METHOD"},
+		{javaio.ScSerializable, "SC_SERIALIZABLE"},
+		{javaio.ScExternalizable, "SC_EXTERNALIZABLE"},
+		{javaio.ScBlockData, "SC_BLOCK_DATA"},
+		{javaio.ScEnum, "SC_ENUM"},
+	} {
+		if flags&flag.value != 0 {
+			names = append(names, flag.name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+func primitiveName(tc byte) string {
+	switch tc {
+	case 'B':
+		return "byte"
+	case 'C':
+		return "char"
+	case 'D':
+		return "double"
+	case 'F':
+		return "float"
+	case 'I':
+		return "int"
+	case 'J':
+		return "long"
+	case 'S':
+		return "short"
+	case 'Z':
+		return "boolean"
+	}
+	return string(tc)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"testing"
+
+	"github.com/lujjjh/go-javaio/internal/stream"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeInput(t *testing.T) {
+	assert := assert.New(t)
+	raw := []byte{0xac, 0xed, 0x00, 0x05, 0x70}
+	for _, test := range []struct {
+		input  string
+		format string
+	}{
+		{string(raw), "auto"},
+		{string(raw), "raw"},
+		{"aced000570", "auto"},
+		{"0xAC ED:00 05\n70\n", "hex"},
+		{base64.StdEncoding.EncodeToString(raw), "auto"},
+		{base64.RawURLEncoding.EncodeToString(raw), "base64"},
+	} {
+		p, err := decodeInput([]byte(test.input), test.format)
+		if assert.NoError(err, test.input) {
+			assert.Equal(raw, p, test.input)
+		}
+	}
+
+	_, err := decodeInput([]byte("hello"), "auto")
+	assert.Error(err)
+	_, err = decodeInput(raw, "xml")
+	assert.Error(err)
+}
+
+func TestDump(t *testing.T) {
+	assert := assert.New(t)
+	p, err := ioutil.ReadFile("../../testdata/list.ser")
+	if !assert.NoError(err) {
+		return
+	}
+	contents, err := stream.Parse(bytes.NewReader(p))
+	if !assert.NoError(err) {
+		return
+	}
+	var b bytes.Buffer
+	assert.NoError(dump(&b, contents))
+	assert.Equal(`00000004: TC_OBJECT 0x7e0002 List
+00000005:   classDesc: TC_CLASSDESC 0x7e0000 List
+              serialVersionUID: 0x0000000000000001 (1)
+              flags: 0x02 SC_SERIALIZABLE
+              fields: 2
+00000017:       I value
+00000026:       L next: TC_STRING 0x7e0001 "LList;"
+00000030:     superClassDesc: TC_NULL
+            classdata:
+              List:
+00000031:       value: (int) 17
+00000035:       next: TC_OBJECT 0x7e0003 List
+00000036:         classDesc: TC_REFERENCE 0x7e0000 -> TC_CLASSDESC List
+                  classdata:
+                    List:
+0000003b:             value: (int) 19
+0000003f:             next: TC_NULL
+00000040: TC_REFERENCE 0x7e0003 -> TC_OBJECT List
+`, b.String())
+}
+
+func TestDump_BlockData(t *testing.T) {
+	assert := assert.New(t)
+	p, _ := hex.DecodeString("aced00057703010203")
+	contents, err := stream.Parse(bytes.NewReader(p))
+	if !assert.NoError(err) {
+		return
+	}
+	var b bytes.Buffer
+	assert.NoError(dump(&b, contents))
+	assert.Equal("00000004: TC_BLOCKDATA 3 bytes\n00000006:   01 02 03                                          |...|\n", b.String())
+}
@@ -0,0 +1,122 @@
+// Command javaio-dump prints the contents of a Java serialization stream as
+// an annotated tree, without requiring Go types for the classes in it.
+//
+// Usage:
+//
+//	javaio-dump [-format auto|raw|hex|base64] [file]
+//
+// The stream is read from file, or from standard input if no file is given.
+// With the default format, auto, raw streams are recognized by their
+// 0xaced magic and text input is decoded as hex or base64.
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/lujjjh/go-javaio/internal/stream"
+)
+
+func main() {
+	format := flag.String("format", "auto", "input format: auto, raw, hex or base64")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: javaio-dump [-format auto|raw|hex|base64] [file]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var (
+		p   []byte
+		err error
+	)
+	if flag.NArg() == 1 {
+		p, err = ioutil.ReadFile(flag.Arg(0))
+	} else {
+		p, err = ioutil.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		fatal(err)
+	}
+	if p, err = decodeInput(p, *format); err != nil {
+		fatal(err)
+	}
+
+	contents, parseErr := stream.Parse(bytes.NewReader(p))
+	if err := dump(os.Stdout, contents); err != nil {
+		fatal(err)
+	}
+	if parseErr != nil {
+		fatal(parseErr)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "javaio-dump: %v\n", err)
+	os.Exit(1)
+}
+
+var streamMagic = []byte{0xac, 0xed}
+
+func decodeInput(p []byte, format string) ([]byte, error) {
+	switch format {
+	case "raw":
+		return p, nil
+	case "hex":
+		return decodeHex(p)
+	case "base64":
+		return decodeBase64(p)
+	case "auto":
+		if bytes.HasPrefix(p, streamMagic) {
+			return p, nil
+		}
+		if b, err := decodeHex(p); err == nil && bytes.HasPrefix(b, streamMagic) {
+			return b, nil
+		}
+		if b, err := decodeBase64(p); err == nil && bytes.HasPrefix(b, streamMagic) {
+			return b, nil
+		}
+		return nil, errors.New("input is not a serialization stream in raw, hex or base64 format")
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// decodeHex decodes hex digits, ignoring whitespace, colons and an
+// optional 0x prefix.
+func decodeHex(p []byte) ([]byte, error) {
+	s := strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n', ':':
+			return -1
+		}
+		return r
+	}, string(p))
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")
+	return hex.DecodeString(s)
+}
+
+func decodeBase64(p []byte) ([]byte, error) {
+	s := strings.Join(strings.Fields(string(p)), "")
+	for _, encoding := range []*base64.Encoding{
+		base64.StdEncoding,
+		base64.URLEncoding,
+		base64.RawStdEncoding,
+		base64.RawURLEncoding,
+	} {
+		if b, err := encoding.DecodeString(s); err == nil {
+			return b, nil
+		}
+	}
+	return nil, errors.New("invalid base64 input")
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"sort"
+	"strings"
+	"unicode"
+
+	javaio "github.com/lujjjh/go-javaio"
+)
+
+// reservedNames are the methods of generated types, which fields must not
+// shadow.
+var reservedNames = map[string]bool{
+	"ClassName":        true,
+	"SerialVersionUID": true,
+	"WriteObject":      true,
+	"ReadObject":       true,
+}
+
+type generator struct {
+	buf       bytes.Buffer
+	m         *model
+	typeNames map[string]string // class name -> Go type name
+}
+
+// generate returns the formatted Go source for the classes in m.
+func generate(pkg string, m *model) ([]byte, error) {
+	g := &generator{m: m, typeNames: make(map[string]string)}
+	classes := g.classes()
+	g.nameTypes(classes)
+
+	var body bytes.Buffer
+	g.buf, body = body, g.buf
+	for _, c := range classes {
+		g.class(c)
+	}
+	g.registerAll(classes)
+	g.buf, body = body, g.buf
+
+	stubs := false
+	for _, c := range classes {
+		stubs = stubs || hasStubs(c)
+	}
+	if stubs {
+		// The stubs are meant to be filled in, so the file is not marked
+		// as generated.
+		g.printf("// Code generated by javaio-gen. Replace the WriteObject and ReadObject\n")
+		g.printf("// stubs before use.\n\n")
+	} else {
+		g.printf("// Code generated by javaio-gen. DO NOT EDIT.\n\n")
+	}
+	g.printf("package %s\n\n", pkg)
+	g.printf("import (\n")
+	if stubs {
+		g.printf("\"errors\"\n")
+	}
+	g.printf("\"reflect\"\n\njavaio %q\n)\n", "github.com/lujjjh/go-javaio")
+	g.buf.Write(body.Bytes())
+
+	src, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("generate: invalid source: %v", err)
+	}
+	return src, nil
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+// classes returns the classes to generate types for, sorted by name. Enums
+// are left out since the Decoder does not read them.
+func (g *generator) classes() []*class {
+	var classes []*class
+	for _, c := range g.m.classes {
+		if c.isEnum() || c.name == "java.lang.Enum" || c.name == "java.lang.String" {
+			continue
+		}
+		classes = append(classes, c)
+	}
+	sort.Slice(classes, func(i, j int) bool {
+		return classes[i].name < classes[j].name
+	})
+	return classes
+}
+
+func (g *generator) nameTypes(classes []*class) {
+	used := map[string]bool{"RegisterAll": true}
+	for _, c := range classes {
+		simple := c.name[strings.LastIndex(c.name, ".")+1:]
+		var name string
+		for _, part := range strings.Split(simple, "$") {
+			name += exportedName(part)
+		}
+		if used[name] {
+			if i := strings.LastIndex(c.name, "."); i >= 0 {
+				pkg := c.name[:i]
+				name = exportedName(pkg[strings.LastIndex(pkg, ".")+1:]) + name
+			}
+		}
+		name = uniqueName(name, used)
+		used[name] = true
+		g.typeNames[c.name] = name
+	}
+}
+
+func (g *generator) class(c *class) {
+	name := g.typeNames[c.name]
+	used := make(map[string]bool)
+	for n := range reservedNames {
+		used[n] = true
+	}
+
+	g.printf("\n// %s is the Go type for %s.\n", name, c.name)
+	if c.flags&javaio.ScExternalizable != 0 {
+		g.printf("//\n// %s is Externalizable, which javaio does not support.\n", c.name)
+	}
+	g.printf("type %s struct {\n", name)
+	superName, hasSuper := g.typeNames[c.super]
+	if hasSuper {
+		used[superName] = true
+		g.printf("%s\n\n", superName)
+	}
+	for _, f := range c.fields {
+		fieldName := uniqueName(exportedName(f.name), used)
+		used[fieldName] = true
+		g.printf("%s %s `javaio:%q`\n", fieldName, g.goType(f.descriptor), f.name)
+	}
+	g.printf("}\n\n")
+
+	g.printf("func (%s) ClassName() string {\nreturn %q\n}\n\n", name, c.name)
+	g.printf("func (%s) SerialVersionUID() int64 {\nreturn %d\n}\n", name, c.serialVersionUID)
+	if c.flags&javaio.ScWriteMethod != 0 {
+		g.printf("\n// WriteObject mirrors the writeObject method of %s.\n", c.name)
+		g.printf("func (x *%s) WriteObject(enc *javaio.Encoder) error {\n", name)
+		g.printf("return errors.New(%q)\n}\n", name+".WriteObject: not implemented")
+	}
+	if c.readMethod {
+		g.printf("\n// ReadObject mirrors the readObject method of %s.\n", c.name)
+		g.printf("func (x *%s) ReadObject(dec *javaio.Decoder) error {\n", name)
+		g.printf("return errors.New(%q)\n}\n", name+".ReadObject: not implemented")
+	}
+}
+
+func hasStubs(c *class) bool {
+	return c.flags&javaio.ScWriteMethod != 0 || c.readMethod
+}
+
+// goType returns the Go type the Decoder produces for values of a field
+// with the given descriptor.
+func (g *generator) goType(descriptor string) string {
+	switch descriptor[0] {
+	case 'B':
+		return "byte"
+	case 'C':
+		return "uint16"
+	case 'D':
+		return "float64"
+	case 'F':
+		return "float32"
+	case 'I':
+		return "int32"
+	case 'J':
+		return "int64"
+	case 'S':
+		return "int16"
+	case 'Z':
+		return "bool"
+	case '[':
+		return "*javaio.Array"
+	}
+	className := strings.ReplaceAll(strings.TrimSuffix(strings.TrimPrefix(descriptor, "L"), ";"), "/", ".")
+	if className == "java.lang.String" {
+		return "*javaio.String"
+	}
+	if name, ok := g.typeNames[className]; ok {
+		return "*" + name
+	}
+	return "interface{}"
+}
+
+func (g *generator) registerAll(classes []*class) {
+	g.printf("\n// RegisterAll registers the generated types with dec.\n")
+	g.printf("func RegisterAll(dec *javaio.Decoder) {\n")
+	g.printf("dec.RegisterType(\"java.lang.String\", reflect.TypeOf(javaio.String{}))\n")
+	for _, c := range classes {
+		g.printf("dec.RegisterType(%q, reflect.TypeOf(%s{}))\n", c.name, g.typeNames[c.name])
+	}
+	g.printf("}\n")
+}
+
+// exportedName turns a Java identifier into an exported Go identifier.
+func exportedName(s string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	name := b.String()
+	if name == "" || !unicode.IsLetter([]rune(name)[0]) {
+		name = "X" + name
+	}
+	return name
+}
+
+func uniqueName(name string, used map[string]bool) string {
+	if !used[name] {
+		return name
+	}
+	for i := 2; ; i++ {
+		if n := fmt.Sprintf("%s%d", name, i); !used[n] {
+			return n
+		}
+	}
+}
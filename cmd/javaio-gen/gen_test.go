@@ -0,0 +1,225 @@
+package main
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lujjjh/go-javaio/internal/classfile"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerate(t *testing.T) {
+	assert := assert.New(t)
+	m := newModel()
+	for _, name := range []string{"custom_read_object.ser", "list.ser", "list.ser"} {
+		p, err := ioutil.ReadFile("../../testdata/" + name)
+		if !assert.NoError(err) {
+			return
+		}
+		assert.NoError(m.addStream(p))
+	}
+	src, err := generate("model", m)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(`// Code generated by javaio-gen. Replace the WriteObject and ReadObject
+// stubs before use.
+
+package model
+
+import (
+	"errors"
+	"reflect"
+
+	javaio "github.com/lujjjh/go-javaio"
+)
+
+// A is the Go type for A.
+type A struct {
+	Hello *javaio.String `+"`javaio:\"hello\"`"+`
+}
+
+func (A) ClassName() string {
+	return "A"
+}
+
+func (A) SerialVersionUID() int64 {
+	return 1
+}
+
+// B is the Go type for B.
+type B struct {
+	A
+}
+
+func (B) ClassName() string {
+	return "B"
+}
+
+func (B) SerialVersionUID() int64 {
+	return 1
+}
+
+// WriteObject mirrors the writeObject method of B.
+func (x *B) WriteObject(enc *javaio.Encoder) error {
+	return errors.New("B.WriteObject: not implemented")
+}
+
+// ReadObject mirrors the readObject method of B.
+func (x *B) ReadObject(dec *javaio.Decoder) error {
+	return errors.New("B.ReadObject: not implemented")
+}
+
+// List is the Go type for List.
+type List struct {
+	Value int32 `+"`javaio:\"value\"`"+`
+	Next  *List `+"`javaio:\"next\"`"+`
+}
+
+func (List) ClassName() string {
+	return "List"
+}
+
+func (List) SerialVersionUID() int64 {
+	return 1
+}
+
+// RegisterAll registers the generated types with dec.
+func RegisterAll(dec *javaio.Decoder) {
+	dec.RegisterType("java.lang.String", reflect.TypeOf(javaio.String{}))
+	dec.RegisterType("A", reflect.TypeOf(A{}))
+	dec.RegisterType("B", reflect.TypeOf(B{}))
+	dec.RegisterType("List", reflect.TypeOf(List{}))
+}
+`, string(src))
+}
+
+func TestGenerate_Names(t *testing.T) {
+	assert := assert.New(t)
+	m := newModel()
+	for _, c := range []*class{
+		{name: "com.example.a.Node"},
+		{name: "com.example.b.Node"},
+		{name: "com.example.Outer$Inner", super: "com.example.a.Node", fields: []field{
+			{"node", "[Lcom/example/a/Node;"},
+			{"super", "Lcom/example/b/Node;"},
+			{"this$0", "Lcom/example/Outer;"},
+			{"c", "C"},
+		}},
+	} {
+		assert.NoError(m.add(c))
+	}
+	g := &generator{m: m, typeNames: make(map[string]string)}
+	g.nameTypes(g.classes())
+	assert.Equal(map[string]string{
+		"com.example.a.Node":      "Node",
+		"com.example.b.Node":      "BNode",
+		"com.example.Outer$Inner": "OuterInner",
+	}, g.typeNames)
+
+	src, err := generate("model", m)
+	if assert.NoError(err) {
+		assert.Contains(string(src), "type OuterInner struct {\n\tNode\n\n\tNode2 *javaio.Array `javaio:\"node\"`\n\tSuper *BNode        `javaio:\"super\"`\n\tThis0 interface{}   `javaio:\"this$0\"`\n\tC     uint16        `javaio:\"c\"`\n}")
+	}
+}
+
+func TestModel_Conflict(t *testing.T) {
+	m := newModel()
+	assert.NoError(t, m.add(&class{name: "A", serialVersionUID: 1}))
+	assert.NoError(t, m.add(&class{name: "A", serialVersionUID: 1}))
+	assert.Error(t, m.add(&class{name: "A", serialVersionUID: 2}))
+}
+
+func TestExportedName(t *testing.T) {
+	for in, out := range map[string]string{
+		"value":     "Value",
+		"this$0":    "This0",
+		"max_value": "MaxValue",
+		"1":         "X1",
+		"$":         "X",
+	} {
+		assert.Equal(t, out, exportedName(in), in)
+	}
+}
+
+func TestGenerate_ClassFiles(t *testing.T) {
+	assert := assert.New(t)
+	files, err := filepath.Glob("../../testdata/classes/*.class")
+	if !assert.NoError(err) || !assert.NotEmpty(files) {
+		return
+	}
+	dir, err := ioutil.TempDir("", "javaio-gen")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	jar := filepath.Join(dir, "classes.jar")
+	f, err := os.Create(jar)
+	if !assert.NoError(err) {
+		return
+	}
+	zw := zip.NewWriter(f)
+	for _, name := range files {
+		p, err := ioutil.ReadFile(name)
+		assert.NoError(err)
+		w, err := zw.Create("com/example/" + filepath.Base(name))
+		assert.NoError(err)
+		_, err = w.Write(p)
+		assert.NoError(err)
+	}
+	w, err := zw.Create("META-INF/MANIFEST.MF")
+	assert.NoError(err)
+	_, err = w.Write([]byte("Manifest-Version: 1.0\n"))
+	assert.NoError(err)
+	assert.NoError(zw.Close())
+	assert.NoError(f.Close())
+
+	m := newModel()
+	if !assert.NoError(m.addJar(jar)) || !assert.NoError(m.resolve()) {
+		return
+	}
+	// Marker is an interface and Plain is not serializable.
+	assert.Len(m.classes, 4)
+	assert.Equal(int64(0), m.classes["com.example.Color"].serialVersionUID)
+	assert.Equal(int64(1), m.classes["com.example.Shape"].serialVersionUID)
+	p, _ := ioutil.ReadFile("../../testdata/classes/Point.class")
+	point, _ := classfile.Parse(p)
+	assert.Equal(point.DefaultSerialVersionUID(), m.classes["com.example.Point"].serialVersionUID)
+
+	src, err := generate("shapes", m)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Contains(string(src), `type Circle struct {
+	Shape
+
+	Radius float64       `+"`javaio:\"radius\"`"+`
+	Center *Point        `+"`javaio:\"center\"`"+`
+	Color  interface{}   `+"`javaio:\"color\"`"+`
+	Tags   *javaio.Array `+"`javaio:\"tags\"`"+`
+}`)
+	assert.Contains(string(src), "func (x *Circle) WriteObject(enc *javaio.Encoder) error {")
+	assert.Contains(string(src), "func (x *Circle) ReadObject(dec *javaio.Decoder) error {")
+	assert.False(strings.Contains(string(src), "Color struct"))
+}
+
+func TestModel_ClassFileAndStream(t *testing.T) {
+	assert := assert.New(t)
+	m := newModel()
+	p, _ := ioutil.ReadFile("../../testdata/classes/Shape.class")
+	assert.NoError(m.addClassFile(p))
+	assert.NoError(m.resolve())
+	// The same class described by a stream must match the class file.
+	assert.NoError(m.add(&class{
+		name:             "com.example.Shape",
+		serialVersionUID: 1,
+		flags:            0x02,
+		fields:           []field{{"name", "Ljava/lang/String;"}},
+	}))
+	assert.Error(m.add(&class{name: "com.example.Shape", serialVersionUID: 1, flags: 0x02}))
+}
@@ -0,0 +1,80 @@
+// Command javaio-gen generates Go types for Java classes, described either
+// by sample serialization streams or by compiled class files.
+//
+// Usage:
+//
+//	javaio-gen [-package name] [-o file] input...
+//
+// Inputs ending in .class are class files, inputs ending in .jar are jars
+// of class files, and all other inputs are serialization streams.
+//
+// Every serializable class becomes a struct with javaio tags, ClassName and
+// SerialVersionUID methods and, for subclasses, an embedded superclass.
+// Classes without an explicit serialVersionUID get the default one computed
+// by the JVM. Classes with custom writeObject or readObject methods get
+// WriteObject and ReadObject stubs to fill in. A RegisterAll function
+// registers all generated types with a Decoder.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+func main() {
+	pkg := flag.String("package", "main", "package name of the generated file")
+	output := flag.String("o", "", "write the generated file to `file` instead of standard output")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: javaio-gen [-package name] [-o file] input...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	m := newModel()
+	for _, name := range flag.Args() {
+		if err := addInput(m, name); err != nil {
+			fatal(fmt.Errorf("%s: %v", name, err))
+		}
+	}
+	if err := m.resolve(); err != nil {
+		fatal(err)
+	}
+	src, err := generate(*pkg, m)
+	if err != nil {
+		fatal(err)
+	}
+	if *output == "" {
+		_, err = os.Stdout.Write(src)
+	} else {
+		err = ioutil.WriteFile(*output, src, 0666)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func addInput(m *model, name string) error {
+	if strings.HasSuffix(name, ".jar") {
+		return m.addJar(name)
+	}
+	p, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(name, ".class") {
+		return m.addClassFile(p)
+	}
+	return m.addStream(p)
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "javaio-gen: %v\n", err)
+	os.Exit(1)
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	javaio "github.com/lujjjh/go-javaio"
+	"github.com/lujjjh/go-javaio/internal/classfile"
+	"github.com/lujjjh/go-javaio/internal/stream"
+)
+
+// class describes a serializable Java class independently of where the
+// description came from.
+type class struct {
+	name             string
+	serialVersionUID int64
+	flags            byte
+	fields           []field
+	super            string // empty if the superclass is not serializable
+	readMethod       bool   // whether the class has a readObject method
+}
+
+type field struct {
+	name       string
+	descriptor string // e.g. "I", "Ljava/lang/String;" or "[J"
+}
+
+func (c *class) isEnum() bool {
+	return c.flags&javaio.ScEnum != 0
+}
+
+func (c *class) equal(other *class) bool {
+	if c.name != other.name || c.serialVersionUID != other.serialVersionUID ||
+		c.flags != other.flags || c.super != other.super || len(c.fields) != len(other.fields) {
+		return false
+	}
+	for i := range c.fields {
+		if c.fields[i] != other.fields[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// model collects the classes of all inputs.
+type model struct {
+	classes    map[string]*class
+	classFiles map[string]*classfile.ClassFile
+}
+
+func newModel() *model {
+	return &model{
+		classes:    make(map[string]*class),
+		classFiles: make(map[string]*classfile.ClassFile),
+	}
+}
+
+func (m *model) add(c *class) error {
+	if prev, ok := m.classes[c.name]; ok {
+		if !prev.equal(c) {
+			return fmt.Errorf("conflicting descriptions of class %s", c.name)
+		}
+		prev.readMethod = prev.readMethod || c.readMethod
+		return nil
+	}
+	m.classes[c.name] = c
+	return nil
+}
+
+// addStream adds the classes of all class descriptors in a serialization
+// stream.
+func (m *model) addStream(p []byte) error {
+	contents, err := stream.Parse(bytes.NewReader(p))
+	if err != nil {
+		return err
+	}
+	w := &streamWalker{m: m, seen: make(map[stream.Content]bool)}
+	for _, c := range contents {
+		w.content(c)
+	}
+	return w.err
+}
+
+type streamWalker struct {
+	m    *model
+	seen map[stream.Content]bool
+	err  error
+}
+
+func (w *streamWalker) content(c stream.Content) {
+	if c == nil || w.seen[c] || w.err != nil {
+		return
+	}
+	w.seen[c] = true
+	switch c := c.(type) {
+	case *stream.Reference:
+		w.content(c.Target)
+	case *stream.ClassDesc:
+		w.classDesc(c)
+	case *stream.Object:
+		w.content(c.Class)
+		for _, data := range c.ClassData {
+			w.values(data.Values)
+			for _, annotation := range data.Annotations {
+				w.content(annotation)
+			}
+		}
+	case *stream.Array:
+		w.content(c.Class)
+		w.values(c.Values)
+	case *stream.Enum:
+		w.content(c.Class)
+	case *stream.Class:
+		w.content(c.Class)
+	case *stream.Exception:
+		w.content(c.Throwable)
+	}
+}
+
+func (w *streamWalker) values(values []*stream.Value) {
+	for _, value := range values {
+		w.content(value.Object)
+	}
+}
+
+func (w *streamWalker) classDesc(desc *stream.ClassDesc) {
+	for _, annotation := range desc.Annotations {
+		w.content(annotation)
+	}
+	w.content(desc.Super)
+	// Array classes map to javaio.Array and proxies have no fields.
+	if desc.Proxy || desc.Name == "" || desc.Name[0] == '[' {
+		return
+	}
+	c := &class{
+		name:             desc.Name,
+		serialVersionUID: desc.SerialVersionUID,
+		flags:            desc.Flags,
+	}
+	if super := stream.Resolve(desc.Super); super != nil && !super.Proxy {
+		c.super = super.Name
+	}
+	for _, f := range desc.Fields {
+		descriptor := string(f.TypeCode)
+		if f.ClassName != nil {
+			descriptor = stringValue(f.ClassName)
+		}
+		c.fields = append(c.fields, field{name: f.Name, descriptor: descriptor})
+	}
+	// Custom data can only be read back by a ReadObject method.
+	c.readMethod = c.flags&javaio.ScWriteMethod != 0
+	w.err = w.m.add(c)
+}
+
+func stringValue(c stream.Content) string {
+	if ref, ok := c.(*stream.Reference); ok {
+		c = ref.Target
+	}
+	if s, ok := c.(*stream.String); ok {
+		return s.Value
+	}
+	return ""
+}
+
+// addClassFile adds a class file. Classes from class files are only added
+// to the model by resolve, once all class files are known.
+func (m *model) addClassFile(p []byte) error {
+	cf, err := classfile.Parse(p)
+	if err != nil {
+		return err
+	}
+	m.classFiles[cf.Name] = cf
+	return nil
+}
+
+// addJar adds all class files in a jar.
+func (m *model) addJar(name string) error {
+	r, err := zip.OpenReader(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		if !strings.HasSuffix(f.Name, ".class") || strings.HasPrefix(f.Name, "META-INF/") ||
+			strings.HasSuffix(f.Name, "module-info.class") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		p, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		if err := m.addClassFile(p); err != nil {
+			return fmt.Errorf("%s: %v", f.Name, err)
+		}
+	}
+	return nil
+}
+
+const (
+	serializable   = "java.io.Serializable"
+	externalizable = "java.io.Externalizable"
+)
+
+const (
+	writeObjectDescriptor = "(Ljava/io/ObjectOutputStream;)V"
+	readObjectDescriptor  = "(Ljava/io/ObjectInputStream;)V"
+)
+
+// resolve adds the serializable classes among the class files. A class is
+// serializable if it is an enum or if it, one of its superclasses or one of
+// their interfaces implements java.io.Serializable; other classes that are
+// not part of the input are assumed not to be serializable.
+func (m *model) resolve() error {
+	names := make([]string, 0, len(m.classFiles))
+	for name := range m.classFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cf := m.classFiles[name]
+		if cf.AccessFlags&classfile.AccInterface != 0 {
+			continue
+		}
+		if !isEnum(cf) && !m.implements(name, serializable, externalizable) {
+			continue
+		}
+		if err := m.add(m.classFromFile(cf)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *model) classFromFile(cf *classfile.ClassFile) *class {
+	c := &class{name: cf.Name}
+	if m.implements(cf.SuperName, serializable, externalizable) {
+		c.super = cf.SuperName
+	}
+	switch {
+	case isEnum(cf):
+		// Enums always have a serialVersionUID of 0.
+		c.flags = javaio.ScSerializable | javaio.ScEnum
+		return c
+	case m.implements(cf.Name, externalizable):
+		c.flags = javaio.ScExternalizable | javaio.ScBlockData
+	default:
+		c.flags = javaio.ScSerializable
+		if privateMethod(cf, "writeObject", writeObjectDescriptor) {
+			c.flags |= javaio.ScWriteMethod
+		}
+		c.readMethod = privateMethod(cf, "readObject", readObjectDescriptor)
+		for _, f := range cf.Fields {
+			if f.AccessFlags&(classfile.AccStatic|classfile.AccTransient) == 0 {
+				c.fields = append(c.fields, field{name: f.Name, descriptor: f.Descriptor})
+			}
+		}
+		sortFields(c.fields)
+	}
+	if suid, ok := cf.SerialVersionUID(); ok {
+		c.serialVersionUID = suid
+	} else {
+		c.serialVersionUID = cf.DefaultSerialVersionUID()
+	}
+	return c
+}
+
+// isEnum reports whether cf is an enum class; java.lang.Enum implements
+// Serializable.
+func isEnum(cf *classfile.ClassFile) bool {
+	return cf.SuperName == "java.lang.Enum" && cf.AccessFlags&classfile.AccEnum != 0
+}
+
+// implements reports whether the class or interface name is one of
+// targets or extends or implements one of them.
+func (m *model) implements(name string, targets ...string) bool {
+	seen := make(map[string]bool)
+	var visit func(name string) bool
+	visit = func(name string) bool {
+		if name == "" || seen[name] {
+			return false
+		}
+		seen[name] = true
+		for _, target := range targets {
+			if name == target {
+				return true
+			}
+		}
+		cf, ok := m.classFiles[name]
+		if !ok {
+			return false
+		}
+		for _, iface := range cf.Interfaces {
+			if visit(iface) {
+				return true
+			}
+		}
+		return visit(cf.SuperName)
+	}
+	return visit(name)
+}
+
+func privateMethod(cf *classfile.ClassFile, name, descriptor string) bool {
+	method := cf.Method(name, descriptor)
+	return method != nil && method.AccessFlags&(classfile.AccPrivate|classfile.AccStatic) == classfile.AccPrivate
+}
+
+// sortFields sorts fields the way ObjectStreamClass does: primitive fields
+// first, then by name.
+func sortFields(fields []field) {
+	sort.SliceStable(fields, func(i, j int) bool {
+		pi, pj := isPrimitive(fields[i].descriptor), isPrimitive(fields[j].descriptor)
+		if pi != pj {
+			return pi
+		}
+		return fields[i].name < fields[j].name
+	})
+}
+
+func isPrimitive(descriptor string) bool {
+	return descriptor[0] != 'L' && descriptor[0] != '['
+}
@@ -0,0 +1,299 @@
+package javaio
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"unicode/utf16"
+
+	"github.com/lujjjh/go-javaio/internal/mutf8"
+)
+
+// A DataWriter writes primitive values in the format of
+// java.io.DataOutputStream: big-endian, with strings in modified UTF-8.
+// It writes no stream header and does no buffering.
+type DataWriter struct {
+	w       io.Writer
+	bw      io.ByteWriter // w, if it is an io.ByteWriter
+	n       int64
+	scratch [8]byte
+}
+
+// NewDataWriter returns a DataWriter that writes to w.
+func NewDataWriter(w io.Writer) *DataWriter {
+	dw := &DataWriter{}
+	dw.reset(w)
+	return dw
+}
+
+func (w *DataWriter) reset(dst io.Writer) {
+	w.w = dst
+	w.bw, _ = dst.(io.ByteWriter)
+}
+
+// Size returns the number of bytes written so far, like
+// DataOutputStream.size.
+func (w *DataWriter) Size() int64 {
+	return w.n
+}
+
+func (w *DataWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// WriteBoolean writes a boolean as a single byte, like DataOutput.writeBoolean.
+func (w *DataWriter) WriteBoolean(v bool) error {
+	if v {
+		return w.WriteByte(1)
+	}
+	return w.WriteByte(0)
+}
+
+// WriteByte writes a single byte, like DataOutput.writeByte.
+func (w *DataWriter) WriteByte(v byte) error {
+	if w.bw != nil {
+		if err := w.bw.WriteByte(v); err != nil {
+			return err
+		}
+		w.n++
+		return nil
+	}
+	w.scratch[0] = v
+	_, err := w.Write(w.scratch[:1])
+	return err
+}
+
+// WriteShort writes a 16-bit integer in big-endian order, like
+// DataOutput.writeShort.
+func (w *DataWriter) WriteShort(v int16) error {
+	binary.BigEndian.PutUint16(w.scratch[:2], uint16(v))
+	_, err := w.Write(w.scratch[:2])
+	return err
+}
+
+// WriteChar writes a UTF-16 code unit, like DataOutput.writeChar.
+func (w *DataWriter) WriteChar(v uint16) error {
+	return w.WriteShort(int16(v))
+}
+
+// WriteInt writes a 32-bit integer in big-endian order, like
+// DataOutput.writeInt.
+func (w *DataWriter) WriteInt(v int32) error {
+	binary.BigEndian.PutUint32(w.scratch[:4], uint32(v))
+	_, err := w.Write(w.scratch[:4])
+	return err
+}
+
+// WriteLong writes a 64-bit integer in big-endian order, like
+// DataOutput.writeLong.
+func (w *DataWriter) WriteLong(v int64) error {
+	binary.BigEndian.PutUint64(w.scratch[:8], uint64(v))
+	_, err := w.Write(w.scratch[:8])
+	return err
+}
+
+// WriteFloat writes the IEEE 754 bits of v, like DataOutput.writeFloat.
+func (w *DataWriter) WriteFloat(v float32) error {
+	return w.WriteInt(int32(math.Float32bits(v)))
+}
+
+// WriteDouble writes the IEEE 754 bits of v, like DataOutput.writeDouble.
+func (w *DataWriter) WriteDouble(v float64) error {
+	return w.WriteLong(int64(math.Float64bits(v)))
+}
+
+// WriteBytes writes the low byte of each UTF-16 code unit of s, like
+// DataOutput.writeBytes.
+func (w *DataWriter) WriteBytes(s string) error {
+	units := utf16.Encode([]rune(s))
+	p := make([]byte, len(units))
+	for i, u := range units {
+		p[i] = byte(u)
+	}
+	_, err := w.Write(p)
+	return err
+}
+
+// WriteChars writes the UTF-16 code units of s, like DataOutput.writeChars.
+func (w *DataWriter) WriteChars(s string) error {
+	units := utf16.Encode([]rune(s))
+	p := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.BigEndian.PutUint16(p[2*i:], u)
+	}
+	_, err := w.Write(p)
+	return err
+}
+
+// WriteUTF writes s in modified UTF-8 preceded by its length in bytes, like
+// DataOutput.writeUTF. The encoded string must not exceed 65535 bytes.
+func (w *DataWriter) WriteUTF(s string) error {
+	p := mutf8.Encode(s)
+	if len(p) > math.MaxUint16 {
+		return fmt.Errorf("WriteUTF: encoded string too long: %d bytes", len(p))
+	}
+	if err := w.WriteShort(int16(len(p))); err != nil {
+		return err
+	}
+	_, err := w.Write(p)
+	return err
+}
+
+// A DataReader reads primitive values in the format of
+// java.io.DataInputStream. Reads that stop short return io.EOF if no data
+// was read and io.ErrUnexpectedEOF otherwise.
+type DataReader struct {
+	r       io.Reader
+	br      io.ByteReader // r, if it is an io.ByteReader
+	scratch [8]byte
+}
+
+// NewDataReader returns a DataReader that reads from r.
+func NewDataReader(r io.Reader) *DataReader {
+	dr := &DataReader{}
+	dr.reset(r)
+	return dr
+}
+
+func (r *DataReader) reset(src io.Reader) {
+	r.r = src
+	r.br, _ = src.(io.ByteReader)
+}
+
+func (r *DataReader) Read(p []byte) (int, error) {
+	return r.r.Read(p)
+}
+
+// ReadFully reads exactly len(p) bytes into p, like DataInput.readFully.
+func (r *DataReader) ReadFully(p []byte) error {
+	_, err := io.ReadFull(r.r, p)
+	return err
+}
+
+func (r *DataReader) readScratch(n int) ([]byte, error) {
+	b := r.scratch[:n]
+	if err := r.ReadFully(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// ReadBoolean reads a boolean written by DataOutput.writeBoolean.
+func (r *DataReader) ReadBoolean() (bool, error) {
+	b, err := r.ReadByte()
+	return b != 0, err
+}
+
+// ReadByte reads a single byte. The result is unsigned; convert it to int8
+// to get the value of DataInput.readByte.
+func (r *DataReader) ReadByte() (byte, error) {
+	if r.br != nil {
+		return r.br.ReadByte()
+	}
+	b, err := r.readScratch(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// ReadUnsignedByte reads a single byte, like DataInput.readUnsignedByte.
+func (r *DataReader) ReadUnsignedByte() (uint8, error) {
+	return r.ReadByte()
+}
+
+// ReadShort reads a 16-bit big-endian integer, like DataInput.readShort.
+func (r *DataReader) ReadShort() (int16, error) {
+	v, err := r.ReadUnsignedShort()
+	return int16(v), err
+}
+
+// ReadUnsignedShort reads a 16-bit big-endian unsigned integer, like
+// DataInput.readUnsignedShort.
+func (r *DataReader) ReadUnsignedShort() (uint16, error) {
+	b, err := r.readScratch(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(b), nil
+}
+
+// ReadChar reads a UTF-16 code unit, like DataInput.readChar.
+func (r *DataReader) ReadChar() (uint16, error) {
+	return r.ReadUnsignedShort()
+}
+
+// ReadInt reads a 32-bit big-endian integer, like DataInput.readInt.
+func (r *DataReader) ReadInt() (int32, error) {
+	b, err := r.readScratch(4)
+	if err != nil {
+		return 0, err
+	}
+	return int32(binary.BigEndian.Uint32(b)), nil
+}
+
+// ReadLong reads a 64-bit big-endian integer, like DataInput.readLong.
+func (r *DataReader) ReadLong() (int64, error) {
+	b, err := r.readScratch(8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(b)), nil
+}
+
+// ReadFloat reads a float written by DataOutput.writeFloat.
+func (r *DataReader) ReadFloat() (float32, error) {
+	v, err := r.ReadInt()
+	return math.Float32frombits(uint32(v)), err
+}
+
+// ReadDouble reads a double written by DataOutput.writeDouble.
+func (r *DataReader) ReadDouble() (float64, error) {
+	v, err := r.ReadLong()
+	return math.Float64frombits(uint64(v)), err
+}
+
+var errMalformedUTF = errors.New("ReadUTF: malformed input")
+
+// ReadUTF reads a string written by DataOutput.writeUTF.
+func (r *DataReader) ReadUTF() (string, error) {
+	l, err := r.ReadUnsignedShort()
+	if err != nil {
+		return "", err
+	}
+	p := make([]byte, l)
+	if err := r.ReadFully(p); err != nil {
+		return "", unexpectedEOF(err)
+	}
+	if !mutf8.Valid(p) {
+		return "", errMalformedUTF
+	}
+	return mutf8.Decode(p), nil
+}
+
+// SkipBytes skips up to n bytes, like DataInput.skipBytes. It returns the
+// number of bytes skipped, which is less than n only at the end of the
+// input.
+func (r *DataReader) SkipBytes(n int) (int, error) {
+	var buf [512]byte
+	skipped := 0
+	for skipped < n {
+		p := buf[:]
+		if n-skipped < len(p) {
+			p = p[:n-skipped]
+		}
+		m, err := io.ReadFull(r.r, p)
+		skipped += m
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return skipped, err
+		}
+	}
+	return skipped, nil
+}
@@ -0,0 +1,111 @@
+package javaio
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// dataOutputBytes is what DataOutputStream writes for the values in
+// TestDataWriter.
+var dataOutputBytes = []byte{
+	0x01,
+	0xfe,
+	0xff, 0xfe,
+	0x00, 0xe9,
+	0xff, 0xff, 0xff, 0xfd,
+	0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfc,
+	0x3f, 0xc0, 0x00, 0x00,
+	0xc0, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x61, 0xe9,
+	0x00, 0x61, 0xd8, 0x3d, 0xde, 0x00,
+	0x00, 0x0b, 0x61, 0xc0, 0x80, 0xc3, 0xa9, 0xed, 0xa0, 0xbd, 0xed, 0xb8, 0x80,
+}
+
+func TestDataWriter(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	w := NewDataWriter(&buf)
+	assert.NoError(w.WriteBoolean(true))
+	assert.NoError(w.WriteByte(0xfe))
+	assert.NoError(w.WriteShort(-2))
+	assert.NoError(w.WriteChar('é'))
+	assert.NoError(w.WriteInt(-3))
+	assert.NoError(w.WriteLong(-4))
+	assert.NoError(w.WriteFloat(1.5))
+	assert.NoError(w.WriteDouble(-2.25))
+	assert.NoError(w.WriteBytes("aé"))
+	assert.NoError(w.WriteChars("a😀"))
+	assert.NoError(w.WriteUTF("a\x00é😀"))
+	assert.Error(w.WriteUTF(string(make([]byte, 1<<16))))
+	assert.Equal(dataOutputBytes, buf.Bytes())
+	assert.Equal(int64(len(dataOutputBytes)), w.Size())
+}
+
+func TestDataReader(t *testing.T) {
+	// OneByteReader hides io.ByteReader and returns short reads.
+	for _, r := range []io.Reader{
+		bytes.NewReader(dataOutputBytes),
+		iotest.OneByteReader(bytes.NewReader(dataOutputBytes)),
+	} {
+		assert := assert.New(t)
+		dr := NewDataReader(r)
+		z, err := dr.ReadBoolean()
+		assert.NoError(err)
+		assert.Equal(true, z)
+		b, err := dr.ReadByte()
+		assert.NoError(err)
+		assert.Equal(int8(-2), int8(b))
+		s, err := dr.ReadShort()
+		assert.NoError(err)
+		assert.Equal(int16(-2), s)
+		c, err := dr.ReadChar()
+		assert.NoError(err)
+		assert.Equal(uint16('é'), c)
+		i, err := dr.ReadInt()
+		assert.NoError(err)
+		assert.Equal(int32(-3), i)
+		j, err := dr.ReadLong()
+		assert.NoError(err)
+		assert.Equal(int64(-4), j)
+		f, err := dr.ReadFloat()
+		assert.NoError(err)
+		assert.Equal(float32(1.5), f)
+		d, err := dr.ReadDouble()
+		assert.NoError(err)
+		assert.Equal(-2.25, d)
+		ub, err := dr.ReadUnsignedByte()
+		assert.NoError(err)
+		assert.Equal(uint8('a'), ub)
+		n, err := dr.SkipBytes(1)
+		assert.NoError(err)
+		assert.Equal(1, n)
+		p := make([]byte, 6)
+		assert.NoError(dr.ReadFully(p))
+		assert.Equal([]byte{0x00, 0x61, 0xd8, 0x3d, 0xde, 0x00}, p)
+		str, err := dr.ReadUTF()
+		assert.NoError(err)
+		assert.Equal("a\x00é😀", str)
+
+		_, err = dr.ReadInt()
+		assert.Equal(io.EOF, err)
+	}
+}
+
+func TestDataReader_Errors(t *testing.T) {
+	_, err := NewDataReader(bytes.NewReader([]byte{0x00, 0x00, 0x01})).ReadInt()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	_, err = NewDataReader(bytes.NewReader([]byte{0x00, 0x03, 'a'})).ReadUTF()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	_, err = NewDataReader(bytes.NewReader([]byte{0x00, 0x02, 'a', 0xc3})).ReadUTF()
+	assert.EqualError(t, err, "ReadUTF: malformed input")
+
+	n, err := NewDataReader(bytes.NewReader([]byte{1, 2, 3})).SkipBytes(1000)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+}
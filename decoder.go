@@ -1,31 +1,57 @@
 package javaio
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"reflect"
+	"sort"
 	"strings"
+
+	"github.com/lujjjh/go-javaio/internal/mutf8"
 )
 
 type Decoder struct {
-	r             io.Reader
+	r             *countingReader
 	typs          map[string]reflect.Type
 	handles       []interface{}
+	passHandle    int                     // handle of the object read last, or -1
+	pending       map[int][]reflect.Value // values waiting for objects being read, by handle
 	blockDataMode bool
 	unread        int
+	skipping      int // depth of nested skipCustomData calls
+	capture       func(data *SkippedData)
+	resolveClass  func(dec *Decoder, className string) (reflect.Type, error)
+	resolveObject func(object interface{}) (interface{}, error)
+	validations   []validation
+	reinterpret   bool // see SetReinterpretUnsigned
 
 	curValue reflect.Value
 	curDesc  *classDesc
+	data     DataReader // reads from the Decoder itself
+	scratch  [8]byte
+
+	path        objectPath
+	depth       int
+	customIndex int
 }
 
 type ObjectReader interface {
 	ReadObject(dec *Decoder) error
 }
 
+// An ObjectResolver designates an object to be returned in its place once
+// it has been read, like the readResolve method of a Serializable class.
+type ObjectResolver interface {
+	ReadResolve() (interface{}, error)
+}
+
 func objectReader(object interface{}) ObjectReader {
-	if objectReader, haveObjectReader := object.(ObjectReader); haveObjectReader {
+	if objectReader, haveObjectReader := object.(ObjectReader); haveObjectReader && declares(object, "ReadObject") {
 		return objectReader
 	}
 	return nil
@@ -35,6 +61,7 @@ type classDesc struct {
 	name             string
 	serialVersionUID int64
 	info             classDescInfo
+	typ              reflect.Type // set by the resolveClass hook, if any
 }
 
 type classDescInfo struct {
@@ -49,11 +76,16 @@ type fieldDesc struct {
 	className string
 }
 
+// NewDecoder returns a Decoder that reads from r. If r does not implement
+// io.ByteReader, it is wrapped in a bufio.Reader, and the Decoder may read
+// data from r beyond the end of the stream.
 func NewDecoder(r io.Reader) (*Decoder, error) {
 	dec := &Decoder{
-		r:    r,
-		typs: make(map[string]reflect.Type),
+		r:       newCountingReader(r),
+		typs:    make(map[string]reflect.Type),
+		pending: make(map[int][]reflect.Value),
 	}
+	dec.data.reset(dec)
 	if err := dec.readHeader(); err != nil {
 		return nil, err
 	}
@@ -65,72 +97,334 @@ func (dec *Decoder) RegisterType(name string, typ reflect.Type) {
 	dec.typs[name] = typ
 }
 
+// SetResolveObject sets a function that returns the object to be returned
+// in place of each object, array and string read, after ReadResolve, like
+// the resolveObject method of ObjectInputStream once enableResolveObject is
+// called.
+func (dec *Decoder) SetResolveObject(f func(object interface{}) (interface{}, error)) {
+	dec.resolveObject = f
+}
+
+// SetResolveClass sets a function that is called for every class descriptor,
+// like the resolveClass method of ObjectInputStream. It may read the class
+// annotation with the Read methods of dec; the rest of the annotation is
+// skipped. If it returns a non-nil type, objects of the class are decoded
+// into that type instead of the registered one.
+func (dec *Decoder) SetResolveClass(f func(dec *Decoder, className string) (reflect.Type, error)) {
+	dec.resolveClass = f
+}
+
+// SetReinterpretUnsigned sets whether a negative integer read into an
+// unsigned field is reinterpreted as the bits of its Java type, e.g. the
+// int -1 as a uint32 of 0xffffffff. By default, such a value is an error.
+// A byte read into a Go byte is always reinterpreted.
+func (dec *Decoder) SetReinterpretUnsigned(reinterpret bool) {
+	dec.reinterpret = reinterpret
+}
+
+// SkippedData holds the data that a Decoder skips at the end of a class
+// annotation, or of the data written by a writeObject method that the Go
+// type does not read in full.
+type SkippedData struct {
+	ClassName  string
+	Annotation bool // whether the data is a class annotation
+	// Contents holds a []byte for each run of block data and the objects
+	// in between. Objects that cannot be decoded, such as those of
+	// unregistered classes, are nil.
+	Contents []interface{}
+}
+
+// SetCaptureSkipped sets a function that receives the data the Decoder
+// skips, instead of discarding it. It is not called if nothing is skipped.
+func (dec *Decoder) SetCaptureSkipped(f func(data *SkippedData)) {
+	dec.capture = f
+}
+
 func (dec *Decoder) Read(p []byte) (int, error) {
 	if !dec.blockDataMode {
 		return io.ReadFull(dec.r, p)
 	}
-	if dec.unread == 0 {
-		if err := dec.readBlockHeader(); err != nil {
-			return 0, err
+	n := 0
+	for n < len(p) {
+		for dec.unread == 0 {
+			if err := dec.readBlockHeader(); err != nil {
+				return n, err
+			}
+		}
+		end := len(p)
+		if end-n > dec.unread {
+			end = n + dec.unread
+		}
+		m, err := io.ReadFull(dec.r, p[n:end])
+		n += m
+		dec.unread -= m
+		if err != nil {
+			return n, err
 		}
 	}
-	end := len(p)
-	if len(p) > dec.unread {
-		end = dec.unread
-	}
-	n, err := io.ReadFull(dec.r, p[:end])
-	dec.unread -= n
-	if err != nil {
-		return n, err
-	}
-	if end < len(p) {
-		return dec.Read(p[end:])
-	}
-	return n, err
+	return n, nil
 }
 
+// readBlockHeader reads the header of the next block of data. At the end of
+// the block data, which is marked by any other type code, it returns io.EOF
+// without consuming the type code.
 func (dec *Decoder) readBlockHeader() error {
-	var tc byte
-	if err := binary.Read(dec.r, binary.BigEndian, &tc); err != nil {
+	tc, err := dec.r.PeekByte()
+	if err != nil {
 		return err
 	}
 	switch tc {
 	case TcBlockdata:
-		var l uint8
-		if err := binary.Read(dec.r, binary.BigEndian, &l); err != nil {
-			return err
+		dec.r.ReadByte()
+		l, err := dec.r.ReadByte()
+		if err != nil {
+			return unexpectedEOF(err)
 		}
 		dec.unread = int(l)
 	case TcBlockdatalong:
-		var l int32
-		if err := binary.Read(dec.r, binary.BigEndian, &l); err != nil {
-			return err
+		dec.r.ReadByte()
+		if _, err := io.ReadFull(dec.r, dec.scratch[:4]); err != nil {
+			return unexpectedEOF(err)
 		}
+		l := int32(binary.BigEndian.Uint32(dec.scratch[:4]))
 		if l < 0 {
-			return fmt.Errorf("readBlockHeader: invalid length: %d", l)
+			return dec.syntaxError(dec.offset()-4, tc, "readBlockHeader: invalid length: %d", l)
 		}
 		dec.unread = int(l)
 	default:
-		return fmt.Errorf("readBlockHeader: invalid type code: %02X", tc)
+		if tc < TcNull || tc > TcEnum {
+			return dec.syntaxError(dec.offset(), tc, "readBlockHeader: invalid type code")
+		}
+		return io.EOF
 	}
 	return nil
 }
 
-func (dec *Decoder) readByte() (byte, error) {
-	var p [1]byte
-	if _, err := dec.Read(p[:]); err != nil {
-		return 0, err
+// skipBlockData copies the rest of the current block data to w.
+func (dec *Decoder) skipBlockData(w io.Writer) error {
+	for {
+		if dec.unread > 0 {
+			if _, err := io.CopyN(w, dec.r, int64(dec.unread)); err != nil {
+				return unexpectedEOF(err)
+			}
+			dec.unread = 0
+		}
+		if err := dec.readBlockHeader(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
 	}
-	return p[0], nil
 }
 
-func (dec *Decoder) ReadBinary(dsts ...interface{}) error {
-	return dec.readBinary(dsts...)
+// skipCustomData skips the block data and objects that remain of a class
+// annotation or of the data written by a writeObject method of the class
+// desc, up to and including TC_ENDBLOCKDATA. Objects of unregistered
+// classes, enum constants and classes are skipped too. It leaves block
+// data mode off.
+func (dec *Decoder) skipCustomData(desc *classDesc, annotation bool) error {
+	dec.skipping++
+	defer func() { dec.skipping-- }()
+	var data *SkippedData
+	if dec.capture != nil {
+		data = &SkippedData{ClassName: desc.name, Annotation: annotation}
+	}
+	for {
+		if dec.blockDataMode {
+			var w io.Writer = ioutil.Discard
+			var buf bytes.Buffer
+			if data != nil {
+				w = &buf
+			}
+			if err := dec.skipBlockData(w); err != nil {
+				return err
+			}
+			if buf.Len() > 0 {
+				data.Contents = append(data.Contents, buf.Bytes())
+			}
+			dec.blockDataMode = false
+		}
+		tc, err := dec.r.PeekByte()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		switch tc {
+		case TcBlockdata, TcBlockdatalong:
+			dec.blockDataMode = true
+		case TcEndblockdata:
+			dec.r.ReadByte()
+			if data != nil && len(data.Contents) > 0 {
+				dec.capture(data)
+			}
+			return nil
+		default:
+			object, err := dec.readObject(false)
+			if err != nil {
+				return err
+			}
+			if data != nil {
+				data.Contents = append(data.Contents, object)
+			}
+		}
+	}
+}
+
+// offset returns the number of bytes consumed from the underlying reader.
+func (dec *Decoder) offset() int64 {
+	return dec.r.n
+}
+
+func (dec *Decoder) syntaxError(offset int64, tc byte, format string, args ...interface{}) error {
+	return &SyntaxError{
+		Offset:   offset,
+		TypeCode: tc,
+		Msg:      fmt.Sprintf(format, args...),
+	}
+}
+
+func (dec *Decoder) typeMismatchError(offset int64, value, typ string) error {
+	return &TypeMismatchError{
+		Offset: offset,
+		Path:   dec.path.String(),
+		Value:  value,
+		Type:   typ,
+	}
+}
+
+// unexpectedEOF turns io.EOF into io.ErrUnexpectedEOF, for data that is
+// cut off in the middle.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// ReadBoolean reads a boolean written by DataOutput.writeBoolean.
+func (dec *Decoder) ReadBoolean() (bool, error) {
+	return dec.data.ReadBoolean()
+}
+
+// ReadByte reads a single byte. The result is unsigned; convert it to int8
+// to get the value of DataInput.readByte.
+func (dec *Decoder) ReadByte() (byte, error) {
+	if !dec.blockDataMode {
+		return dec.r.ReadByte()
+	}
+	for dec.unread == 0 {
+		if err := dec.readBlockHeader(); err != nil {
+			return 0, err
+		}
+	}
+	b, err := dec.r.ReadByte()
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	dec.unread--
+	return b, nil
+}
+
+// ReadUnsignedByte reads a single byte, like DataInput.readUnsignedByte.
+func (dec *Decoder) ReadUnsignedByte() (uint8, error) {
+	return dec.data.ReadUnsignedByte()
+}
+
+// ReadShort reads a 16-bit big-endian integer, like DataInput.readShort.
+func (dec *Decoder) ReadShort() (int16, error) {
+	return dec.data.ReadShort()
+}
+
+// ReadUnsignedShort reads a 16-bit big-endian unsigned integer, like
+// DataInput.readUnsignedShort.
+func (dec *Decoder) ReadUnsignedShort() (uint16, error) {
+	return dec.data.ReadUnsignedShort()
+}
+
+// ReadChar reads a UTF-16 code unit, like DataInput.readChar.
+func (dec *Decoder) ReadChar() (uint16, error) {
+	return dec.data.ReadChar()
+}
+
+// ReadInt reads a 32-bit big-endian integer, like DataInput.readInt.
+func (dec *Decoder) ReadInt() (int32, error) {
+	return dec.data.ReadInt()
+}
+
+// ReadLong reads a 64-bit big-endian integer, like DataInput.readLong.
+func (dec *Decoder) ReadLong() (int64, error) {
+	return dec.data.ReadLong()
+}
+
+// ReadFloat reads a float written by DataOutput.writeFloat.
+func (dec *Decoder) ReadFloat() (float32, error) {
+	return dec.data.ReadFloat()
+}
+
+// ReadDouble reads a double written by DataOutput.writeDouble.
+func (dec *Decoder) ReadDouble() (float64, error) {
+	return dec.data.ReadDouble()
+}
+
+// ReadUTF reads a string written by DataOutput.writeUTF.
+func (dec *Decoder) ReadUTF() (string, error) {
+	return dec.data.ReadUTF()
+}
+
+// ReadFully reads exactly len(p) bytes into p, like DataInput.readFully.
+func (dec *Decoder) ReadFully(p []byte) error {
+	return dec.data.ReadFully(p)
 }
 
-func (dec *Decoder) readBinary(dsts ...interface{}) error {
+// SkipBytes skips up to n bytes, like DataInput.skipBytes. It returns the
+// number of bytes skipped, which is less than n only at the end of the
+// stream.
+func (dec *Decoder) SkipBytes(n int) (int, error) {
+	return dec.data.SkipBytes(n)
+}
+
+// ReadBinary reads big-endian binary data into dsts, which must be
+// pointers to fixed-size values or byte slices, like binary.Read.
+func (dec *Decoder) ReadBinary(dsts ...interface{}) error {
 	for _, dst := range dsts {
-		if err := binary.Read(dec, binary.BigEndian, dst); err != nil {
+		var err error
+		switch dst := dst.(type) {
+		case *bool:
+			*dst, err = dec.ReadBoolean()
+		case *int8:
+			var b byte
+			b, err = dec.ReadByte()
+			*dst = int8(b)
+		case *uint8:
+			*dst, err = dec.ReadByte()
+		case *int16:
+			*dst, err = dec.ReadShort()
+		case *uint16:
+			var v int16
+			v, err = dec.ReadShort()
+			*dst = uint16(v)
+		case *int32:
+			*dst, err = dec.ReadInt()
+		case *uint32:
+			var v int32
+			v, err = dec.ReadInt()
+			*dst = uint32(v)
+		case *int64:
+			*dst, err = dec.ReadLong()
+		case *uint64:
+			var v int64
+			v, err = dec.ReadLong()
+			*dst = uint64(v)
+		case *float32:
+			*dst, err = dec.ReadFloat()
+		case *float64:
+			*dst, err = dec.ReadDouble()
+		case []byte:
+			_, err = dec.Read(dst)
+		default:
+			err = binary.Read(dec, binary.BigEndian, dst)
+		}
+		if err != nil {
 			return err
 		}
 	}
@@ -138,41 +432,114 @@ func (dec *Decoder) readBinary(dsts ...interface{}) error {
 }
 
 func (dec *Decoder) readHeader() error {
-	var (
-		magic   uint16
-		version int16
-	)
-	if err := dec.readBinary(&magic, &version); err != nil {
+	if _, err := io.ReadFull(dec.r, dec.scratch[:4]); err != nil {
 		return err
 	}
+	magic := binary.BigEndian.Uint16(dec.scratch[:2])
+	version := int16(binary.BigEndian.Uint16(dec.scratch[2:4]))
 	if magic != StreamMagic {
-		return errors.New("readHeader: invalid stream header")
+		return dec.syntaxError(0, 0, "readHeader: invalid stream header")
 	}
 	if version != StreamVersion {
-		return errors.New("readHeader: unsupported stream version")
+		return dec.syntaxError(2, 0, "readHeader: unsupported stream version")
 	}
 	return nil
 }
 
+// RegisterValidation registers fn to be called once the outermost ReadObject
+// has read the whole object graph, like ObjectInputStream.registerValidation.
+// Functions with higher priorities are called first. If fn returns an error,
+// the outermost ReadObject returns it. RegisterValidation may only be called
+// while an object is being read, such as from a custom ReadObject.
+func (dec *Decoder) RegisterValidation(fn func() error, priority int) error {
+	if dec.depth == 0 {
+		return errors.New("RegisterValidation: not reading an object")
+	}
+	if fn == nil {
+		return errors.New("RegisterValidation: nil function")
+	}
+	dec.validations = append(dec.validations, validation{fn, priority})
+	return nil
+}
+
+type validation struct {
+	fn       func() error
+	priority int
+}
+
 func (dec *Decoder) ReadObject() (interface{}, error) {
-	return dec.readObject()
+	return dec.readObjectOrUnshared(false)
+}
+
+// ReadUnshared reads an object like ReadObject, like
+// ObjectInputStream.readUnshared. It fails if the object is a back reference,
+// and later back references to the object fail too.
+func (dec *Decoder) ReadUnshared() (interface{}, error) {
+	return dec.readObjectOrUnshared(true)
 }
 
-func (dec *Decoder) readObject() (interface{}, error) {
+func (dec *Decoder) readObjectOrUnshared(unshared bool) (interface{}, error) {
+	if dec.depth == 0 {
+		dec.path = dec.path[:0]
+		object, err := dec.readObject(unshared)
+		validations := dec.validations
+		dec.validations = nil
+		if err != nil {
+			return nil, err
+		}
+		sort.SliceStable(validations, func(i, j int) bool {
+			return validations[i].priority > validations[j].priority
+		})
+		for _, v := range validations {
+			if err := v.fn(); err != nil {
+				return nil, err
+			}
+		}
+		return object, nil
+	}
+	// Called from a custom ReadObject.
+	dec.path.pushIndex(dec.customIndex)
+	defer dec.path.pop()
+	dec.customIndex++
+	return dec.readObject(unshared)
+}
+
+// unsharedObject takes the place of objects read by ReadUnshared in the
+// handle table.
+var unsharedObject = &struct{}{}
+
+func (dec *Decoder) readObject(unshared bool) (interface{}, error) {
 	oldBlockDataMode := dec.blockDataMode
 	dec.blockDataMode = false
+	dec.depth++
 	defer func() {
 		dec.blockDataMode = oldBlockDataMode
+		dec.depth--
 	}()
 
-	tc, err := dec.readByte()
+	tc, err := dec.ReadByte()
 	if err != nil {
 		return nil, err
 	}
+	for tc == TcReset {
+		// Like ObjectInputStream, only accept resets between top-level
+		// objects.
+		if dec.depth > 1 {
+			return nil, dec.syntaxError(dec.offset()-1, tc, "readObject: unexpected reset")
+		}
+		dec.handles = nil
+		if tc, err = dec.ReadByte(); err != nil {
+			return nil, err
+		}
+	}
 	switch tc {
 	case TcNull:
+		dec.passHandle = -1
 		return nil, nil
 	case TcReference:
+		if unshared {
+			return nil, dec.syntaxError(dec.offset()-1, tc, "readObject: cannot read back reference as unshared")
+		}
 		v, err := dec.readHandle()
 		if err != nil {
 			return nil, err
@@ -186,54 +553,156 @@ func (dec *Decoder) readObject() (interface{}, error) {
 		if err != nil {
 			return nil, err
 		}
-		return &String{Value: s}, nil
+		dec.passHandle = len(dec.handles) - 1
+		if unshared {
+			dec.handles[dec.passHandle] = unsharedObject
+		}
+		if dec.resolveObject == nil {
+			return &String{Value: s}, nil
+		}
+		return dec.resolve(dec.passHandle, &String{Value: s})
 	case TcArray:
-		return dec.readArray()
+		return dec.readArray(unshared)
 	case TcObject:
-		return dec.readOrdinaryObject()
+		return dec.readOrdinaryObject(unshared)
+	case TcClass:
+		desc, err := dec.readClassDesc()
+		if err != nil {
+			return nil, err
+		}
+		if desc == nil {
+			return nil, dec.syntaxError(dec.offset()-1, tc, "readObject: class descriptor should not be null")
+		}
+		dec.passHandle = dec.assignHandle(nil)
+		return nil, dec.skipOnly("classes")
+	case TcClassdesc:
+		if _, err := dec.readNonProxyDesc(); err != nil {
+			return nil, err
+		}
+		return nil, dec.skipOnly("class descriptors")
+	case TcProxyclassdesc:
+		if _, err := dec.readProxyDesc(); err != nil {
+			return nil, err
+		}
+		return nil, dec.skipOnly("class descriptors")
+	case TcEnum:
+		if _, err := dec.readClassDesc(); err != nil {
+			return nil, err
+		}
+		handle := dec.assignHandle(nil)
+		if _, err := dec.readString(); err != nil {
+			return nil, err
+		}
+		dec.passHandle = handle
+		return nil, dec.skipOnly("enum constants")
+	case TcException:
+		return nil, dec.readFatalException()
 	default:
-		return "", fmt.Errorf("readObject: invalid type code: %02X", tc)
+		return "", dec.syntaxError(dec.offset()-1, tc, "readObject: invalid type code")
 	}
 }
 
+// skipOnly returns an error unless the objects just read, which have no Go
+// representation, are being skipped.
+func (dec *Decoder) skipOnly(what string) error {
+	if dec.skipping > 0 {
+		return nil
+	}
+	return fmt.Errorf("readObject: %s not implemented", what)
+}
+
+// readFatalException reads the exception that ObjectOutputStream writes in
+// place of an object when writing it fails. Like ObjectInputStream, it
+// resets the handle table before and after.
+func (dec *Decoder) readFatalException() error {
+	start := dec.offset() - 1
+	dec.handles = nil
+	dec.skipping++
+	detail, err := dec.readObject(false)
+	dec.skipping--
+	if err != nil {
+		return err
+	}
+	dec.handles = nil
+	return &WriteAbortedError{Offset: start, Detail: detail}
+}
+
 func (dec *Decoder) assignHandle(v interface{}) int {
 	dec.handles = append(dec.handles, v)
 	return len(dec.handles) - 1
 }
 
 func (dec *Decoder) readUTF() (string, error) {
-	var l uint16
-	if err := dec.readBinary(&l); err != nil {
+	l, err := dec.ReadShort()
+	if err != nil {
 		return "", err
 	}
-	p := make([]byte, l)
-	if err := dec.readBinary(p); err != nil {
+	p := make([]byte, uint16(l))
+	if _, err := dec.Read(p); err != nil {
 		return "", err
 	}
-	return string(p), nil
+	return dec.decodeUTF(p, 2+len(p))
 }
 
 func (dec *Decoder) readLongUTF() (string, error) {
-	var l uint64
-	if err := dec.readBinary(l); err != nil {
+	l, err := dec.ReadLong()
+	if err != nil {
 		return "", err
 	}
-	p := make([]byte, l)
-	if err := dec.readBinary(p); err != nil {
+	if l < 0 {
+		return "", dec.syntaxError(dec.offset()-8, 0, "readLongUTF: invalid length: %d", l)
+	}
+	p, err := dec.readBytes(l)
+	if err != nil {
 		return "", err
 	}
-	return string(p), nil
+	return dec.decodeUTF(p, 8+len(p))
+}
+
+// decodeUTF decodes p, the modified UTF-8 data of a string that was read
+// together with its length in n bytes.
+func (dec *Decoder) decodeUTF(p []byte, n int) (string, error) {
+	if !mutf8.Valid(p) {
+		return "", dec.syntaxError(dec.offset()-int64(n), 0, "decodeUTF: malformed modified UTF-8")
+	}
+	return mutf8.Decode(p), nil
+}
+
+// readBytes reads n bytes. The buffer grows as data arrives, so a corrupted
+// length cannot make the decoder allocate more than the stream provides.
+func (dec *Decoder) readBytes(n int64) ([]byte, error) {
+	const chunkSize = 64 * 1024
+	var p []byte
+	for int64(len(p)) < n {
+		size := n - int64(len(p))
+		if size > chunkSize {
+			size = chunkSize
+		}
+		chunk := make([]byte, size)
+		if _, err := dec.Read(chunk); err != nil {
+			return nil, err
+		}
+		p = append(p, chunk...)
+	}
+	if p == nil {
+		p = []byte{}
+	}
+	return p, nil
 }
 
 func (dec *Decoder) readHandle() (interface{}, error) {
-	var handle int32
-	if err := dec.readBinary(&handle); err != nil {
+	handle, err := dec.ReadInt()
+	if err != nil {
 		return nil, err
 	}
 	handle -= baseWireHandle
 	if handle < 0 || int(handle) >= len(dec.handles) {
-		return nil, fmt.Errorf("invalid handle value: %d", handle+baseWireHandle)
+		return nil, dec.syntaxError(dec.offset()-4, 0, "readHandle: invalid handle value: %d", handle+baseWireHandle)
+	}
+	if dec.handles[handle] == unsharedObject {
+		return nil, dec.syntaxError(dec.offset()-4, 0, "readHandle: cannot read back reference to unshared object")
 	}
+	dec.passHandle = int(handle)
 	return dec.handles[handle], nil
 }
 
@@ -246,30 +715,30 @@ func (dec *Decoder) readStringWithTc(tc byte) (string, error) {
 		}
 		s, ok := v.(string)
 		if !ok {
-			return "", fmt.Errorf("readString: reference is not a string")
+			return "", dec.typeMismatchError(dec.offset()-5, fmt.Sprintf("%T", v), "string")
 		}
 		return s, nil
 	case TcString:
 		s, err := dec.readUTF()
 		if err != nil {
-			return "", nil
+			return "", err
 		}
 		dec.assignHandle(s)
 		return s, nil
 	case TcLongstring:
 		s, err := dec.readLongUTF()
 		if err != nil {
-			return "", nil
+			return "", err
 		}
 		dec.assignHandle(s)
 		return s, nil
 	default:
-		return "", fmt.Errorf("readString: invalid type code: %02X", tc)
+		return "", dec.syntaxError(dec.offset()-1, tc, "readString: invalid type code")
 	}
 }
 
 func (dec *Decoder) readString() (string, error) {
-	tc, err := dec.readByte()
+	tc, err := dec.ReadByte()
 	if err != nil {
 		return "", err
 	}
@@ -277,7 +746,7 @@ func (dec *Decoder) readString() (string, error) {
 }
 
 func (dec *Decoder) readClassDesc() (*classDesc, error) {
-	tc, err := dec.readByte()
+	tc, err := dec.ReadByte()
 	if err != nil {
 		return nil, err
 	}
@@ -291,15 +760,15 @@ func (dec *Decoder) readClassDesc() (*classDesc, error) {
 		}
 		desc, ok := v.(*classDesc)
 		if !ok {
-			return nil, fmt.Errorf("readClassDesc: reference is not a classDesc")
+			return nil, dec.typeMismatchError(dec.offset()-5, fmt.Sprintf("%T", v), "class descriptor")
 		}
 		return desc, nil
 	case TcProxyclassdesc:
-		return nil, errors.New("readClassDesc: proxy class not implemented")
+		return dec.readProxyDesc()
 	case TcClassdesc:
 		return dec.readNonProxyDesc()
 	default:
-		return nil, fmt.Errorf("readClassDesc: invalid type code: %02X", tc)
+		return nil, dec.syntaxError(dec.offset()-1, tc, "readClassDesc: invalid type code")
 	}
 }
 
@@ -309,40 +778,91 @@ func (dec *Decoder) readNonProxyDesc() (*classDesc, error) {
 	if err := dec.readClassDescriptor(desc); err != nil {
 		return nil, err
 	}
-	superClassDesc, err := dec.readClassDesc()
+	if err := dec.readSuperClassDesc(desc); err != nil {
+		return nil, err
+	}
+	return desc, nil
+}
+
+// readProxyDesc reads the descriptor of a dynamic proxy class. Proxy
+// classes have no fields and no name in the stream, and cannot be
+// registered, so their objects can only be skipped.
+func (dec *Decoder) readProxyDesc() (*classDesc, error) {
+	desc := &classDesc{name: "$Proxy"}
+	desc.info.flags = ScSerializable
+	dec.assignHandle(desc)
+	n, err := dec.ReadInt()
 	if err != nil {
 		return nil, err
 	}
-	desc.info.superClassDesc = superClassDesc
+	if n < 0 {
+		return nil, dec.syntaxError(dec.offset()-4, TcProxyclassdesc, "readProxyDesc: invalid number of interfaces: %d", n)
+	}
+	for i := 0; i < int(n); i++ {
+		if _, err := dec.readUTF(); err != nil {
+			return nil, err
+		}
+	}
+	oldBlockDataMode := dec.blockDataMode
+	dec.blockDataMode = true
+	err = dec.skipCustomData(desc, true)
+	dec.blockDataMode = oldBlockDataMode
+	if err != nil {
+		return nil, err
+	}
+	if err := dec.readSuperClassDesc(desc); err != nil {
+		return nil, err
+	}
 	return desc, nil
 }
 
+// readSuperClassDesc reads the superclass descriptor of desc. The handle
+// of desc is assigned before its superclass is read, so a stream can make
+// desc its own superclass, directly or through the descriptors in between;
+// such a class could never be read or skipped.
+func (dec *Decoder) readSuperClassDesc(desc *classDesc) error {
+	offset := dec.offset()
+	superClassDesc, err := dec.readClassDesc()
+	if err != nil {
+		return err
+	}
+	for sup := superClassDesc; sup != nil; sup = sup.info.superClassDesc {
+		if sup == desc {
+			return dec.syntaxError(offset, 0, "readSuperClassDesc: class %s is its own superclass", desc.name)
+		}
+	}
+	desc.info.superClassDesc = superClassDesc
+	return nil
+}
+
 func (dec *Decoder) readClassDescriptor(desc *classDesc) error {
 	name, err := dec.readUTF()
 	if err != nil {
 		return err
 	}
 	desc.name = name
-	var suid int64
-	var flags byte
-	if err := dec.readBinary(&suid, &flags); err != nil {
+	suid, err := dec.ReadLong()
+	if err != nil {
+		return err
+	}
+	flags, err := dec.ReadByte()
+	if err != nil {
 		return err
 	}
 	desc.serialVersionUID = suid
 	desc.info.flags = flags
-	if flags&ScEnum != 0 {
-		// TODO: support enum
-		return errors.New("readNonProxyDesc: does not support enum")
-	}
 
-	var numFields int16
-	if err := dec.readBinary(&numFields); err != nil {
+	numFields, err := dec.ReadShort()
+	if err != nil {
 		return err
 	}
+	if numFields < 0 {
+		return dec.syntaxError(dec.offset()-2, 0, "readClassDescriptor: invalid number of fields: %d", numFields)
+	}
 	fields := make([]fieldDesc, 0, int(numFields))
 	for i := 0; i < int(numFields); i++ {
-		var tcode byte
-		if err := dec.readBinary(&tcode); err != nil {
+		tcode, err := dec.ReadByte()
+		if err != nil {
 			return err
 		}
 		fname, err := dec.readUTF()
@@ -364,118 +884,391 @@ func (dec *Decoder) readClassDescriptor(desc *classDesc) error {
 	}
 	desc.info.fields = fields
 
-	tc, err := dec.readByte()
-	if err != nil {
-		return err
-	}
-	if tc != TcEndblockdata {
-		return fmt.Errorf("readClassDescriptor: expected TC_ENDBLOCKDATA, got %02X", tc)
+	// The class annotation is written by annotateClass.
+	oldBlockDataMode := dec.blockDataMode
+	defer func() {
+		dec.blockDataMode = oldBlockDataMode
+	}()
+	dec.blockDataMode = true
+	if dec.resolveClass != nil {
+		prevCustomIndex := dec.customIndex
+		dec.customIndex = 0
+		desc.typ, err = dec.resolveClass(dec, name)
+		dec.customIndex = prevCustomIndex
+		if err != nil {
+			return err
+		}
 	}
-
-	return nil
+	return dec.skipCustomData(desc, true)
 }
 
-func (dec *Decoder) readArray() (interface{}, error) {
+func (dec *Decoder) readArray(unshared bool) (interface{}, error) {
+	start := dec.offset() - 1
 	desc, err := dec.readClassDesc()
 	if err != nil {
 		return nil, err
 	}
+	if desc == nil {
+		return nil, dec.syntaxError(start, TcArray, "readArray: class descriptor should not be null")
+	}
+	if len(dec.path) == 0 {
+		dec.path.push(simpleClassName(desc.name))
+		defer dec.path.pop()
+	}
 	array := &Array{}
-	dec.assignHandle(array)
-	var l int32
-	if err := dec.readBinary(&l); err != nil {
+	handle := dec.assignHandle(array)
+	if unshared {
+		dec.handles[handle] = unsharedObject
+	}
+	dec.pending[handle] = nil
+	l, err := dec.ReadInt()
+	if err != nil {
 		return nil, err
 	}
+	if l < 0 {
+		return nil, dec.syntaxError(dec.offset()-4, TcArray, "readArray: invalid length: %d", l)
+	}
 
 	typ, err := dec.typFromFieldDescriptor(desc.name)
 	if err != nil {
+		if _, ok := err.(*UnregisteredClassError); ok && dec.skipping > 0 {
+			return nil, dec.skipArrayElements(desc.name, int(l))
+		}
 		return nil, err
 	}
 	if typ.Kind() != reflect.Slice {
-		return nil, fmt.Errorf("readArray: expected slice, got '%s'", typ.Kind())
+		return nil, dec.typeMismatchError(start, desc.name, "slice")
 	}
-	switch typ.Elem() {
-	// TODO: process other primitive types.
-	case reflect.TypeOf(byte(0)):
-		b := make([]byte, l)
-		if err := dec.readBinary(&b); err != nil {
+	switch code := desc.name[1]; {
+	case code == 'B':
+		b, err := dec.readBytes(int64(l))
+		if err != nil {
 			return nil, err
 		}
 		array.value = reflect.ValueOf(b)
+	case isPrimitiveTypeCode(code):
+		elems, err := dec.readPrimitiveElements(code, int(l))
+		if err != nil {
+			return nil, err
+		}
+		array.value = reflect.ValueOf(elems)
 	default:
-		array.value = reflect.MakeSlice(reflect.SliceOf(reflect.PtrTo(typ.Elem())), int(l), int(l))
+		elemTyp := reflect.PtrTo(typ.Elem())
+		// Grow the slice while reading instead of trusting l up front.
+		capacity := int(l)
+		if capacity > 1024 {
+			capacity = 1024
+		}
+		value := reflect.MakeSlice(reflect.SliceOf(elemTyp), 0, capacity)
 		for i := 0; i < int(l); i++ {
-			data, err := dec.readObject()
+			dec.path.pushIndex(i)
+			elemStart := dec.offset()
+			data, err := dec.readObject(false)
 			if err != nil {
 				return nil, err
 			}
 			dataVal := reflect.ValueOf(data)
-			elem := array.value.Index(i)
-			if !dataVal.Type().AssignableTo(elem.Type()) {
-				return nil, fmt.Errorf("readArray: type %s is not assignable to type %s", dataVal.Type(), elem.Type())
+			if !dataVal.IsValid() {
+				dataVal = reflect.Zero(elemTyp)
+			}
+			if !dataVal.Type().AssignableTo(elemTyp) {
+				return nil, dec.typeMismatchError(elemStart, dataVal.Type().String(), elemTyp.String())
 			}
-			elem.Set(dataVal)
+			value = reflect.Append(value, dataVal)
+			dec.path.pop()
 		}
+		array.value = value
 	}
-	return array, nil
+	return dec.finish(handle, array)
 }
 
-func (dec *Decoder) readOrdinaryObject() (interface{}, error) {
+// readPrimitiveElements reads the l elements of an array of the primitive
+// type with the given type code, other than byte, into a slice.
+func (dec *Decoder) readPrimitiveElements(code byte, l int) (interface{}, error) {
+	// Grow the slice while reading instead of trusting l up front.
+	capacity := l
+	if capacity > 1024 {
+		capacity = 1024
+	}
+	var err error
+	switch code {
+	case 'C':
+		elems := make([]uint16, 0, capacity)
+		for i := 0; i < l && err == nil; i++ {
+			var v uint16
+			v, err = dec.ReadChar()
+			elems = append(elems, v)
+		}
+		return elems, err
+	case 'D':
+		elems := make([]float64, 0, capacity)
+		for i := 0; i < l && err == nil; i++ {
+			var v float64
+			v, err = dec.ReadDouble()
+			elems = append(elems, v)
+		}
+		return elems, err
+	case 'F':
+		elems := make([]float32, 0, capacity)
+		for i := 0; i < l && err == nil; i++ {
+			var v float32
+			v, err = dec.ReadFloat()
+			elems = append(elems, v)
+		}
+		return elems, err
+	case 'I':
+		elems := make([]int32, 0, capacity)
+		for i := 0; i < l && err == nil; i++ {
+			var v int32
+			v, err = dec.ReadInt()
+			elems = append(elems, v)
+		}
+		return elems, err
+	case 'J':
+		elems := make([]int64, 0, capacity)
+		for i := 0; i < l && err == nil; i++ {
+			var v int64
+			v, err = dec.ReadLong()
+			elems = append(elems, v)
+		}
+		return elems, err
+	case 'S':
+		elems := make([]int16, 0, capacity)
+		for i := 0; i < l && err == nil; i++ {
+			var v int16
+			v, err = dec.ReadShort()
+			elems = append(elems, v)
+		}
+		return elems, err
+	case 'Z':
+		elems := make([]bool, 0, capacity)
+		for i := 0; i < l && err == nil; i++ {
+			var v bool
+			v, err = dec.ReadBoolean()
+			elems = append(elems, v)
+		}
+		return elems, err
+	}
+	return nil, dec.syntaxError(dec.offset(), TcArray, "readPrimitiveElements: invalid type code: %q", code)
+}
+
+func (dec *Decoder) readOrdinaryObject(unshared bool) (interface{}, error) {
+	start := dec.offset() - 1
 	desc, err := dec.readClassDesc()
 	if err != nil {
 		return nil, err
 	}
-	typ, err := dec.getTypeFromClassName(desc.name)
+	if desc == nil {
+		return nil, dec.syntaxError(start, TcObject, "readOrdinaryObject: class descriptor should not be null")
+	}
+	if len(dec.path) == 0 {
+		dec.path.push(simpleClassName(desc.name))
+		defer dec.path.pop()
+	}
+	typ := desc.typ
+	if typ == nil {
+		typ, err = dec.getTypeFromClassName(desc.name)
+	}
 	if err != nil {
+		if _, ok := err.(*UnregisteredClassError); ok && dec.skipping > 0 {
+			dec.assignHandle(nil)
+			return nil, dec.skipSerialData(desc)
+		}
 		return nil, err
 	}
 	object := reflect.New(typ)
-	dec.assignHandle(object.Interface())
+	construct(object.Interface())
+	handle := dec.assignHandle(object.Interface())
+	if unshared {
+		dec.handles[handle] = unsharedObject
+	}
+	dec.pending[handle] = nil
 	if desc.info.flags&ScExternalizable != 0 {
 		return nil, errors.New("readOrdinaryObject: SC_EXTERNALIZABLE not implemented")
 	}
 	if err := dec.readSerialData(object, desc); err != nil {
 		return nil, err
 	}
-	return object.Interface(), nil
+	return dec.finish(handle, object.Interface())
+}
+
+// construct calls the Construct method of the first superclass part of
+// object that is not serializable.
+func construct(object interface{}) {
+	for {
+		if f, ok := superField(reflect.ValueOf(object)); ok && f.Kind() == reflect.Ptr && f.IsNil() && f.CanSet() {
+			f.Set(reflect.New(f.Type().Elem()))
+		}
+		if object = superPart(object); object == nil {
+			return
+		}
+		if isNonSerializable(object) {
+			if c, ok := object.(Constructor); ok {
+				c.Construct()
+			}
+			return
+		}
+	}
+}
+
+// finish resolves the object with the given handle once it has been read
+// in full, and stores it in the values that were waiting for it.
+func (dec *Decoder) finish(handle int, object interface{}) (interface{}, error) {
+	rep, err := dec.resolve(handle, object)
+	if err != nil {
+		return nil, err
+	}
+	dsts := dec.pending[handle]
+	delete(dec.pending, handle)
+	v := reflect.ValueOf(rep)
+	for _, dst := range dsts {
+		if !v.IsValid() {
+			continue
+		}
+		if v.Kind() != reflect.Ptr || !v.Type().Elem().AssignableTo(dst.Type()) {
+			return nil, dec.typeMismatchError(dec.offset(), v.Type().String(), dst.Type().String())
+		}
+		dst.Set(v.Elem())
+	}
+	dec.passHandle = handle
+	return rep, nil
+}
+
+// resolve returns the object to be returned in place of object, as
+// designated by ReadResolve and by the ResolveObject function. The
+// replacement takes the place of object in the handle table, so later
+// references to object return it too.
+func (dec *Decoder) resolve(handle int, object interface{}) (interface{}, error) {
+	rep := object
+	if resolver, ok := object.(ObjectResolver); ok && declares(object, "ReadResolve") {
+		var err error
+		if rep, err = resolver.ReadResolve(); err != nil {
+			return nil, err
+		}
+	}
+	if dec.resolveObject != nil {
+		var err error
+		if rep, err = dec.resolveObject(rep); err != nil {
+			return nil, err
+		}
+	}
+	if dec.handles[handle] == unsharedObject {
+		return rep, nil
+	}
+	if s, ok := rep.(*String); ok {
+		// Strings are stored as such in the handle table.
+		dec.handles[handle] = s.Value
+	} else {
+		dec.handles[handle] = rep
+	}
+	return rep, nil
 }
 
 func (dec *Decoder) readSerialData(value reflect.Value, desc *classDesc) error {
+	if v := reflect.Indirect(value); v.Kind() == reflect.Struct {
+		if info := cachedStructInfo(v.Type()); info.err != nil {
+			err := info.error()
+			if typeErr, ok := err.(*UnsupportedTypeError); ok {
+				typeErr.Offset, typeErr.Path = dec.offset(), dec.path.String()
+			}
+			return err
+		}
+	}
 	if desc.info.superClassDesc != nil {
+		if f, ok := superField(value); ok && f.Kind() == reflect.Ptr && f.IsNil() {
+			f.Set(reflect.New(f.Type().Elem()))
+		}
 		superVal := reflect.ValueOf(super(value.Interface()))
+		if !superVal.IsValid() || isNilPointer(superVal.Interface()) {
+			return dec.typeMismatchError(dec.offset(), "superclass "+desc.info.superClassDesc.name, value.Type().String())
+		}
 		if err := dec.readSerialData(superVal, desc.info.superClassDesc); err != nil {
 			return err
 		}
 	}
 	if or := objectReader(value.Interface()); or != nil {
 		dec.blockDataMode = true
-		prevValue, prevDesc := dec.curValue, dec.curDesc
-		dec.curValue, dec.curDesc = value, desc
+		prevValue, prevDesc, prevCustomIndex := dec.curValue, dec.curDesc, dec.customIndex
+		dec.curValue, dec.curDesc, dec.customIndex = value, desc, 0
 		if err := or.ReadObject(dec); err != nil {
-			dec.curValue, dec.curDesc = prevValue, prevDesc
+			dec.curValue, dec.curDesc, dec.customIndex = prevValue, prevDesc, prevCustomIndex
 			return err
 		}
-		dec.curValue, dec.curDesc = prevValue, prevDesc
+		dec.curValue, dec.curDesc, dec.customIndex = prevValue, prevDesc, prevCustomIndex
 	} else {
 		dec.blockDataMode = false
 		if err := dec.defaultReadFields(value, desc); err != nil {
 			return err
 		}
 	}
-	dec.blockDataMode = false
 	if desc.info.flags&ScWriteMethod != 0 {
-		tc, err := dec.readByte()
-		if err != nil {
+		// Skip whatever ReadObject did not read, or all of the custom data
+		// if there is no ReadObject.
+		if err := dec.skipCustomData(desc, false); err != nil {
+			return err
+		}
+	}
+	dec.blockDataMode = false
+	return nil
+}
+
+// skipSerialData reads and discards the data of an object whose class is
+// not registered.
+func (dec *Decoder) skipSerialData(desc *classDesc) error {
+	if desc.info.flags&ScExternalizable != 0 {
+		if desc.info.flags&ScBlockData == 0 {
+			return fmt.Errorf("skipSerialData: cannot skip %s: SC_EXTERNALIZABLE without SC_BLOCK_DATA", desc.name)
+		}
+		return dec.skipCustomData(desc, false)
+	}
+	if desc.info.superClassDesc != nil {
+		if err := dec.skipSerialData(desc.info.superClassDesc); err != nil {
 			return err
 		}
-		if tc != TcEndblockdata {
-			return fmt.Errorf("readSerialData: expected TC_ENDBLOCKDATA, got %02X", tc)
+	}
+	for _, field := range desc.info.fields {
+		if _, err := dec.readFieldValue(field.typeCode); err != nil {
+			return err
 		}
 	}
+	if desc.info.flags&ScWriteMethod != 0 {
+		return dec.skipCustomData(desc, false)
+	}
+	return nil
+}
 
+// skipArrayElements reads and discards the l elements of an array of the
+// given class, whose element type is not registered.
+func (dec *Decoder) skipArrayElements(className string, l int) error {
+	if len(className) < 2 {
+		return fmt.Errorf("skipArrayElements: invalid array class name: %s", className)
+	}
+	for i := 0; i < l; i++ {
+		if _, err := dec.readFieldValue(className[1]); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// ReadObjectInto reads an object from within a custom ReadObject and stores
+// it in the value pointed to by ptr, the way DefaultReadFields stores
+// fields. If ptr points to a struct rather than a pointer, and the object
+// is still being read, the struct is set once the object has been read in
+// full.
+func (dec *Decoder) ReadObjectInto(ptr interface{}) error {
+	dst := reflect.ValueOf(ptr)
+	if dst.Kind() != reflect.Ptr || dst.IsNil() {
+		return fmt.Errorf("ReadObjectInto: non-pointer or nil %T", ptr)
+	}
+	start := dec.offset()
+	v, err := dec.ReadObject()
+	if err != nil {
+		return err
+	}
+	return dec.setField(dst.Elem(), v, dec.passHandle, start)
+}
+
 func (dec *Decoder) DefaultReadFields() (err error) {
 	dec.blockDataMode = false
 	err = dec.defaultReadFields(dec.curValue, dec.curDesc)
@@ -484,88 +1277,196 @@ func (dec *Decoder) DefaultReadFields() (err error) {
 }
 
 func (dec *Decoder) defaultReadFields(value reflect.Value, desc *classDesc) error {
-	dataMap := make(map[string]interface{})
+	value = reflect.Indirect(value)
+	if value.Kind() != reflect.Struct {
+		return dec.typeMismatchError(dec.offset(), value.Type().String(), "struct")
+	}
+	info := cachedStructInfo(value.Type())
 	for _, field := range desc.info.fields {
+		dec.path.pushField(field.name)
+		start := dec.offset()
 		var v interface{}
-		switch field.typeCode {
-		default:
-			fieldTyp, err := dec.typFromFieldDescriptor(string(field.typeCode))
-			if err != nil {
-				return err
-			}
-			fieldData := reflect.New(fieldTyp).Interface()
-			if err := dec.readBinary(fieldData); err != nil {
-				return err
-			}
-			v = reflect.Indirect(reflect.ValueOf(fieldData)).Interface()
-		case '[':
-			tc, err := dec.readByte()
-			if err != nil {
-				return err
-			}
-			if tc != TcArray {
-				return fmt.Errorf("readSerialData: expected TC_ARRAY, got %02X", tc)
-			}
-			v, err = dec.readArray()
-			if err != nil {
-				return err
+		v, err := dec.readFieldValue(field.typeCode)
+		if err != nil {
+			return err
+		}
+		if i, ok := info.byName[field.name]; ok {
+			f := value.Field(info.fields[i].index)
+			if intBits(field.typeCode) != 0 && isIntegerKind(unpackPointerType(f.Type()).Kind()) {
+				if v, err = dec.convertInt(v, field.typeCode, f.Type(), start); err != nil {
+					return err
+				}
+			} else if info.fields[i].convert {
+				if v, ok = convertPrimitive(v, f.Type()); !ok {
+					value := fmt.Sprintf("%T", v)
+					if isPrimitiveTypeCode(field.typeCode) {
+						value = fmt.Sprintf("%s %v", javaTypeName(field.typeCode), v)
+					}
+					return dec.typeMismatchError(start, value, f.Type().String())
+				}
 			}
-		case 'L':
-			var err error
-			v, err = dec.readObject()
-			if err != nil {
+			if err := dec.setField(f, v, dec.passHandle, start); err != nil {
 				return err
 			}
 		}
-		dataMap[field.name] = v
+		dec.path.pop()
 	}
-	value = reflect.Indirect(value)
-	if value.Kind() != reflect.Struct {
-		return fmt.Errorf("readSerialData: value should be a struct, got '%s'", value.Kind())
-	}
-	numField := value.NumField()
-	t := value.Type()
-	for i := 0; i < numField; i++ {
-		tf := t.Field(i)
-		// Skip unexported fields.
-		if tf.PkgPath != "" {
-			continue
+	return nil
+}
+
+// readFieldValue reads the value of a field with the given type code.
+func (dec *Decoder) readFieldValue(typeCode byte) (interface{}, error) {
+	switch typeCode {
+	case 'B':
+		return dec.ReadByte()
+	case 'C':
+		v, err := dec.ReadShort()
+		return uint16(v), err
+	case 'D':
+		return dec.ReadDouble()
+	case 'F':
+		return dec.ReadFloat()
+	case 'I':
+		return dec.ReadInt()
+	case 'J':
+		return dec.ReadLong()
+	case 'S':
+		return dec.ReadShort()
+	case 'Z':
+		return dec.ReadBoolean()
+	case '[', 'L':
+		return dec.readObject(false)
+	}
+	return nil, dec.syntaxError(dec.offset(), 0, "readFieldValue: invalid type code: %q", typeCode)
+}
+
+// convertInt converts v, a value of the Java integral type with the given
+// type code, to typ, which holds an integer. It fails if v is out of the
+// range of typ, unless typ is unsigned and the bits of v may be
+// reinterpreted.
+func (dec *Decoder) convertInt(v interface{}, code byte, typ reflect.Type, offset int64) (interface{}, error) {
+	var n int64
+	switch v := v.(type) {
+	case byte:
+		n = int64(int8(v)) // Java bytes are signed
+	case uint16:
+		n = int64(v)
+	default:
+		n = reflect.ValueOf(v).Int()
+	}
+	elemTyp := unpackPointerType(typ)
+	bits := uint(elemTyp.Bits())
+	result := reflect.New(elemTyp)
+	var ok bool
+	if k := elemTyp.Kind(); k >= reflect.Int && k <= reflect.Int64 {
+		ok = n>>(bits-1) == 0 || n>>(bits-1) == -1
+		result.Elem().SetInt(n)
+	} else {
+		u := uint64(n)
+		ok = n >= 0
+		if !ok && (dec.reinterpret || k == reflect.Uint8 && code == 'B') {
+			u &= uint64(1)<<intBits(code) - 1
+			ok = true
 		}
-		fieldName := tf.Tag.Get("javaio")
-		if fieldName == "-" {
-			continue
+		ok = ok && (bits == 64 || u>>bits == 0)
+		result.Elem().SetUint(u)
+	}
+	if !ok {
+		return nil, dec.typeMismatchError(offset, fmt.Sprintf("%s %d", javaTypeName(code), n), typ.String())
+	}
+	if typ.Kind() != reflect.Ptr {
+		result = result.Elem()
+	}
+	return result.Interface(), nil
+}
+
+// convertPrimitive converts v, a boolean or a number, to typ, which holds
+// the field value given by the type= tag option. A float converts to an
+// integer only if it is integral and in range.
+func convertPrimitive(v interface{}, typ reflect.Type) (interface{}, bool) {
+	if b, ok := v.(byte); ok {
+		v = int8(b) // Java bytes are signed
+	}
+	rv := reflect.ValueOf(v)
+	elemTyp := unpackPointerType(typ)
+	if !rv.IsValid() || !isPrimitiveKind(rv.Kind()) || !isPrimitiveKind(elemTyp.Kind()) {
+		return v, false
+	}
+	var result reflect.Value
+	switch {
+	case rv.Kind() == elemTyp.Kind():
+		result = rv.Convert(elemTyp)
+	case (rv.Kind() == reflect.Float32 || rv.Kind() == reflect.Float64) && isIntegerKind(elemTyp.Kind()):
+		f := rv.Float()
+		bits := elemTyp.Bits()
+		lo, hi := -math.Ldexp(1, bits-1), math.Ldexp(1, bits-1)
+		if k := elemTyp.Kind(); k >= reflect.Uint && k <= reflect.Uintptr {
+			lo, hi = 0, math.Ldexp(1, bits)
 		}
-		if fieldName == "" {
-			fieldName = lowerCamelCase(tf.Name)
+		if f != math.Trunc(f) || !(f >= lo && f < hi) {
+			return v, false
 		}
-		fieldData, ok := dataMap[fieldName]
-		if !ok {
-			continue
+		result = rv.Convert(elemTyp)
+	case elemTyp.Kind() == reflect.Bool:
+		result = reflect.ValueOf(rv.Convert(reflect.TypeOf(float64(0))).Float() != 0).Convert(elemTyp)
+	case rv.Kind() == reflect.Bool:
+		n := 0
+		if rv.Bool() {
+			n = 1
 		}
-		fieldDataValue := reflect.ValueOf(fieldData)
-		if fieldDataValue.IsValid() {
-			f := value.Field(i)
-			if f.Type() == reflect.TypeOf(&Serializable{}) && fieldDataValue.Type() != reflect.TypeOf(&Serializable{}) {
-				fieldDataValue = reflect.ValueOf(&Serializable{
-					Value: fieldData,
-				})
-			}
-			if !fieldDataValue.Type().AssignableTo(f.Type()) {
-				return fmt.Errorf("readSerialData: %s is not assignable to %s", fieldDataValue.Type(), f.Type())
-			}
-			f.Set(fieldDataValue)
+		result = reflect.ValueOf(n).Convert(elemTyp)
+	default:
+		result = rv.Convert(elemTyp)
+	}
+	if typ.Kind() == reflect.Ptr {
+		p := reflect.New(elemTyp)
+		p.Elem().Set(result)
+		result = p
+	}
+	return result.Interface(), true
+}
+
+// setField stores v, the object with the given handle, in f. If f holds a
+// value rather than a pointer, it is set to a copy of the object; if the
+// object is still being read, which happens in cyclic graphs, f is set once
+// the object has been read in full.
+func (dec *Decoder) setField(f reflect.Value, v interface{}, handle int, offset int64) error {
+	fieldDataValue := reflect.ValueOf(v)
+	if !fieldDataValue.IsValid() {
+		return nil
+	}
+	if _, ok := v.(*Serializable); !ok {
+		switch f.Type() {
+		case reflect.TypeOf(&Serializable{}):
+			fieldDataValue = reflect.ValueOf(&Serializable{Value: v})
+		case reflect.TypeOf(Serializable{}):
+			fieldDataValue = reflect.ValueOf(Serializable{Value: v})
 		}
 	}
-	return nil
+	if fieldDataValue.Type().AssignableTo(f.Type()) {
+		f.Set(fieldDataValue)
+		return nil
+	}
+	if fieldDataValue.Kind() == reflect.Ptr && fieldDataValue.Type().Elem().AssignableTo(f.Type()) {
+		if dsts, ok := dec.pending[handle]; ok {
+			dec.pending[handle] = append(dsts, f)
+			return nil
+		}
+		f.Set(fieldDataValue.Elem())
+		return nil
+	}
+	return dec.typeMismatchError(offset, fieldDataValue.Type().String(), f.Type().String())
 }
 
 func (dec *Decoder) typFromFieldDescriptor(fieldDesc string) (reflect.Type, error) {
 	if len(fieldDesc) == 0 {
-		return nil, errors.New("typFromFieldDescriptor: field descriptor should not be empty")
+		return nil, dec.syntaxError(dec.offset(), 0, "typFromFieldDescriptor: field descriptor should not be empty")
 	}
 	switch fieldDesc[0] {
 	case 'B':
 		return reflect.TypeOf(byte(0)), nil
+	case 'C':
+		return reflect.TypeOf(uint16(0)), nil
 	case 'D':
 		return reflect.TypeOf(float64(0)), nil
 	case 'F':
@@ -580,7 +1481,7 @@ func (dec *Decoder) typFromFieldDescriptor(fieldDesc string) (reflect.Type, erro
 		return reflect.TypeOf(false), nil
 	case 'L':
 		if ch := fieldDesc[len(fieldDesc)-1]; ch != ';' {
-			return nil, fmt.Errorf("typFromFieldDescriptor: expected ';', got '%c'", ch)
+			return nil, dec.syntaxError(dec.offset(), 0, "typFromFieldDescriptor: expected ';', got '%c'", ch)
 		}
 		className := strings.ReplaceAll(fieldDesc[1:len(fieldDesc)-1], "/", ".")
 		return dec.getTypeFromClassName(className)
@@ -591,14 +1492,18 @@ func (dec *Decoder) typFromFieldDescriptor(fieldDesc string) (reflect.Type, erro
 		}
 		return reflect.SliceOf(elemTyp), nil
 	default:
-		return nil, fmt.Errorf("typFromFieldDescriptor: invalid field descriptor: %s", fieldDesc)
+		return nil, dec.syntaxError(dec.offset(), 0, "typFromFieldDescriptor: invalid field descriptor: %s", fieldDesc)
 	}
 }
 
 func (dec *Decoder) getTypeFromClassName(className string) (reflect.Type, error) {
 	typ, ok := dec.typs[className]
 	if !ok {
-		return nil, fmt.Errorf("typFromFieldDescriptor: class '%s' not registered", className)
+		return nil, &UnregisteredClassError{
+			Offset:    dec.offset(),
+			Path:      dec.path.String(),
+			ClassName: className,
+		}
 	}
 	return typ, nil
 }
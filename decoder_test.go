@@ -2,7 +2,13 @@ package javaio
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -95,3 +101,1143 @@ func TestDecoder_ReadObjectWithCustomReadObject(t *testing.T) {
 	assert.Equal(t, &String{Value: "world"}, b.super.Hello)
 	assert.Equal(t, int32(1), b.value)
 }
+
+func TestDecoder_ReadObjectMalformed(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		p    []byte
+	}{
+		{"NullArrayClassDesc", []byte{0xac, 0xed, 0x00, 0x05, 0x75, 0x70, 0x00, 0x00, 0x00, 0x00}},
+		{"NullObjectClassDesc", []byte{0xac, 0xed, 0x00, 0x05, 0x73, 0x70}},
+		{"NegativeArrayLength", []byte{
+			0xac, 0xed, 0x00, 0x05, 0x75, 0x72, 0x00, 0x02, 0x5b, 0x42, 0xac, 0xf3, 0x17, 0xf8, 0x06, 0x08,
+			0x54, 0xe0, 0x02, 0x00, 0x00, 0x78, 0x70, 0xff, 0xff, 0xff, 0xff,
+		}},
+		{"TruncatedHugeArray", []byte{
+			0xac, 0xed, 0x00, 0x05, 0x75, 0x72, 0x00, 0x02, 0x5b, 0x42, 0xac, 0xf3, 0x17, 0xf8, 0x06, 0x08,
+			0x54, 0xe0, 0x02, 0x00, 0x00, 0x78, 0x70, 0x7f, 0xff, 0xff, 0xff, 0x01,
+		}},
+		{"NegativeFieldCount", []byte{
+			0xac, 0xed, 0x00, 0x05, 0x73, 0x72, 0x00, 0x04, 0x4c, 0x69, 0x73, 0x74, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x01, 0x02, 0xff, 0xff,
+		}},
+		{"NegativeLongStringLength", []byte{
+			0xac, 0xed, 0x00, 0x05, 0x7c, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		}},
+		{"TruncatedString", []byte{0xac, 0xed, 0x00, 0x05, 0x74, 0x00, 0x05, 0x68, 0x65}},
+		{"UnexpectedSuperclass", []byte{
+			0xac, 0xed, 0x00, 0x05, 0x73, 0x72, 0x00, 0x04, 0x4c, 0x69, 0x73, 0x74, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x01, 0x02, 0x00, 0x00, 0x78, 0x72, 0x00, 0x01, 0x41, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x01, 0x02, 0x00, 0x00, 0x78, 0x70,
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dec, err := NewDecoder(bytes.NewReader(tc.p))
+			assert.NoError(t, err)
+			dec.RegisterType("List", reflect.TypeOf(List{}))
+			_, err = dec.ReadObject()
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestDecoder_ReadObjectNullArrayElement(t *testing.T) {
+	r := bytes.NewReader([]byte{
+		0xac, 0xed, 0x00, 0x05, 0x75, 0x72, 0x00, 0x13, 0x5b, 0x4c, 0x6a, 0x61, 0x76, 0x61, 0x2e, 0x6c,
+		0x61, 0x6e, 0x67, 0x2e, 0x53, 0x74, 0x72, 0x69, 0x6e, 0x67, 0x3b, 0xad, 0xd2, 0x56, 0xe7, 0xe9,
+		0x1d, 0x7b, 0x47, 0x02, 0x00, 0x00, 0x78, 0x70, 0x00, 0x00, 0x00, 0x02, 0x70, 0x74, 0x00, 0x01,
+		0x61,
+	})
+	dec, err := NewDecoder(r)
+	assert.NoError(t, err)
+	dec.RegisterType("java.lang.String", reflect.TypeOf(String{}))
+	object, err := dec.ReadObject()
+	assert.NoError(t, err)
+	array := object.(*Array)
+	assert.Equal(t, 2, array.Len())
+	assert.Nil(t, array.Index(0))
+	assert.Equal(t, &String{Value: "a"}, array.Index(1))
+}
+
+func TestDecoder_ReadObjectPrimitiveArrays(t *testing.T) {
+	for _, tc := range []struct {
+		value interface{}
+		want  interface{} // value if nil
+	}{
+		{value: []byte{1, 0xff}},
+		{value: []int16{1, -2}},
+		{value: []uint16{1, 2}, want: []int16{1, 2}},
+		{value: []int32{1, -2, 3}},
+		{value: []int64{1, -2}},
+		{value: []float32{1.5, -2}},
+		{value: []float64{1.5, -2}},
+		{value: []bool{true, false}},
+		{value: []int32{}},
+	} {
+		t.Run(fmt.Sprintf("%T", tc.value), func(t *testing.T) {
+			var buf bytes.Buffer
+			enc, err := NewEncoder(&buf)
+			assert.NoError(t, err)
+			assert.NoError(t, enc.WriteObject(MustNewArray(tc.value)))
+			assert.NoError(t, enc.Close())
+
+			dec, err := NewDecoder(&buf)
+			assert.NoError(t, err)
+			object, err := dec.ReadObject()
+			if assert.NoError(t, err) {
+				want := tc.want
+				if want == nil {
+					want = tc.value
+				}
+				assert.Equal(t, want, object.(*Array).value.Interface())
+			}
+		})
+	}
+}
+
+func TestDecoder_ReadObjectCharArray(t *testing.T) {
+	// new char[] {'a', '\uffff'}
+	r := bytes.NewReader([]byte{
+		0xac, 0xed, 0x00, 0x05, 0x75, 0x72, 0x00, 0x02, 0x5b, 0x43, 0xb0, 0x26, 0x66, 0xb0, 0xe2, 0x5d,
+		0x84, 0xac, 0x02, 0x00, 0x00, 0x78, 0x70, 0x00, 0x00, 0x00, 0x02, 0x00, 0x61, 0xff, 0xff,
+	})
+	dec, err := NewDecoder(r)
+	assert.NoError(t, err)
+	object, err := dec.ReadObject()
+	if assert.NoError(t, err) {
+		assert.Equal(t, []uint16{'a', 0xffff}, object.(*Array).value.Interface())
+	}
+}
+
+func TestDecoder_ReadObjectIntArraySeed(t *testing.T) {
+	p, err := ioutil.ReadFile("testdata/int_array.ser")
+	assert.NoError(t, err)
+	dec, err := NewDecoder(bytes.NewReader(p))
+	assert.NoError(t, err)
+	object, err := dec.ReadObject()
+	if assert.NoError(t, err) {
+		assert.Equal(t, []int32{1, 2, 3}, object.(*Array).value.Interface())
+	}
+}
+
+func TestDecoder_ReadObjectLongString(t *testing.T) {
+	r := bytes.NewReader([]byte{
+		0xac, 0xed, 0x00, 0x05, 0x7c, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, 0x66, 0x6f, 0x6f,
+	})
+	dec, err := NewDecoder(r)
+	assert.NoError(t, err)
+	object, err := dec.ReadObject()
+	assert.NoError(t, err)
+	assert.Equal(t, &String{Value: "foo"}, object)
+}
+
+func TestDecoder_ReadObjectModifiedUTF8(t *testing.T) {
+	// ObjectOutputStream.writeObject("\u0000\uD83D\uDE00")
+	r := bytes.NewReader([]byte{
+		0xac, 0xed, 0x00, 0x05, 0x74, 0x00, 0x08, 0xc0, 0x80, 0xed, 0xa0, 0xbd, 0xed, 0xb8, 0x80,
+	})
+	dec, err := NewDecoder(r)
+	assert.NoError(t, err)
+	object, err := dec.ReadObject()
+	assert.NoError(t, err)
+	assert.Equal(t, &String{Value: "\x00\U0001F600"}, object)
+
+	// Java rejects UTF-8 four-byte sequences.
+	r = bytes.NewReader([]byte{
+		0xac, 0xed, 0x00, 0x05, 0x74, 0x00, 0x04, 0xf0, 0x9f, 0x98, 0x80,
+	})
+	dec, err = NewDecoder(r)
+	assert.NoError(t, err)
+	_, err = dec.ReadObject()
+	assert.EqualError(t, err, "javaio: decodeUTF: malformed modified UTF-8 (offset 5)")
+}
+
+type primitives struct {
+	b byte
+	z bool
+	s int16
+	i int32
+	j int64
+	f float32
+	d float64
+	p []byte
+}
+
+func (primitives) ClassName() string {
+	return "Primitives"
+}
+
+func (primitives) SerialVersionUID() int64 {
+	return 1
+}
+
+func (p *primitives) WriteObject(enc *Encoder) error {
+	for _, err := range []error{
+		enc.WriteByte(p.b),
+		enc.WriteBoolean(p.z),
+		enc.WriteShort(p.s),
+		enc.WriteInt(p.i),
+		enc.WriteLong(p.j),
+		enc.WriteFloat(p.f),
+		enc.WriteDouble(p.d),
+		enc.WriteInt(int32(len(p.p))),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	_, err := enc.Write(p.p)
+	return err
+}
+
+func (p *primitives) ReadObject(dec *Decoder) error {
+	var err error
+	if p.b, err = dec.ReadByte(); err != nil {
+		return err
+	}
+	if p.z, err = dec.ReadBoolean(); err != nil {
+		return err
+	}
+	if p.s, err = dec.ReadShort(); err != nil {
+		return err
+	}
+	if p.i, err = dec.ReadInt(); err != nil {
+		return err
+	}
+	if p.j, err = dec.ReadLong(); err != nil {
+		return err
+	}
+	if p.f, err = dec.ReadFloat(); err != nil {
+		return err
+	}
+	if p.d, err = dec.ReadDouble(); err != nil {
+		return err
+	}
+	var l int32
+	// ReadBinary is kept for compatibility.
+	if err := dec.ReadBinary(&l); err != nil {
+		return err
+	}
+	p.p = make([]byte, l)
+	return dec.ReadBinary(p.p)
+}
+
+func TestDecoder_ReadPrimitives(t *testing.T) {
+	// The data is longer than a block, so the values straddle block
+	// boundaries.
+	expected := &primitives{
+		b: 0xfe, z: true, s: -2, i: -3, j: -4, f: 1.5, d: -2.25,
+		p: bytes.Repeat([]byte("0123456789"), 300),
+	}
+	var buf bytes.Buffer
+	enc, err := NewEncoder(&buf)
+	assert.NoError(t, err)
+	assert.NoError(t, enc.WriteObject(expected))
+	assert.NoError(t, enc.Flush())
+
+	dec, err := NewDecoder(&buf)
+	assert.NoError(t, err)
+	dec.RegisterType("Primitives", reflect.TypeOf(primitives{}))
+	actual, err := dec.ReadObject()
+	assert.NoError(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+func TestDecoder_ReadBinary(t *testing.T) {
+	type pair struct{ A, B int16 }
+	dec, err := NewDecoder(bytes.NewReader([]byte{
+		0xac, 0xed, 0x00, 0x05, 0x77, 0x10,
+		0x01, 0xff, 0xff, 0xfe, 0x00, 0x00, 0x00, 0x03, 0x3f, 0xc0, 0x00, 0x00, 0x00, 0x04, 0x00, 0x05,
+	}))
+	assert.NoError(t, err)
+	var (
+		z bool
+		b int8
+		u uint16
+		i uint32
+		f float32
+		p pair
+	)
+	assert.NoError(t, dec.ReadBinary(&z, &b, &u, &i, &f, &p))
+	assert.Equal(t, true, z)
+	assert.Equal(t, int8(-1), b)
+	assert.Equal(t, uint16(0xfffe), u)
+	assert.Equal(t, uint32(3), i)
+	assert.Equal(t, float32(1.5), f)
+	assert.Equal(t, pair{4, 5}, p)
+	assert.Equal(t, io.EOF, dec.ReadBinary(&i))
+}
+
+type dataInput struct {
+	c    uint16
+	s    string
+	ub   uint8
+	us   uint16
+	full []byte
+}
+
+func (dataInput) ClassName() string {
+	return "DataInput"
+}
+
+func (d *dataInput) WriteObject(enc *Encoder) error {
+	for _, err := range []error{
+		enc.WriteChar(d.c),
+		enc.WriteUTF(d.s),
+		enc.WriteByte(d.ub),
+		enc.WriteShort(int16(d.us)),
+		enc.WriteBytes("skipped"),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	_, err := enc.Write(d.full)
+	return err
+}
+
+func (d *dataInput) ReadObject(dec *Decoder) error {
+	var err error
+	if d.c, err = dec.ReadChar(); err != nil {
+		return err
+	}
+	if d.s, err = dec.ReadUTF(); err != nil {
+		return err
+	}
+	if d.ub, err = dec.ReadUnsignedByte(); err != nil {
+		return err
+	}
+	if d.us, err = dec.ReadUnsignedShort(); err != nil {
+		return err
+	}
+	if n, err := dec.SkipBytes(len("skipped")); err != nil || n != len("skipped") {
+		return fmt.Errorf("SkipBytes: %d, %v", n, err)
+	}
+	d.full = make([]byte, 2000)
+	return dec.ReadFully(d.full)
+}
+
+func TestDecoder_ReadDataInput(t *testing.T) {
+	expected := &dataInput{
+		c:    'é',
+		s:    "a\x00é😀",
+		ub:   0xff,
+		us:   0xfffe,
+		full: bytes.Repeat([]byte{1, 2, 3, 4}, 500),
+	}
+	var buf bytes.Buffer
+	enc, err := NewEncoder(&buf)
+	assert.NoError(t, err)
+	assert.NoError(t, enc.WriteObject(expected))
+	assert.NoError(t, enc.Flush())
+
+	dec, err := NewDecoder(&buf)
+	assert.NoError(t, err)
+	dec.RegisterType("DataInput", reflect.TypeOf(dataInput{}))
+	actual, err := dec.ReadObject()
+	assert.NoError(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+func TestDecoder_SkipBytes(t *testing.T) {
+	dec, err := NewDecoder(bytes.NewReader([]byte{0xac, 0xed, 0x00, 0x05, 0x77, 0x03, 0x01, 0x02, 0x03}))
+	assert.NoError(t, err)
+	n, err := dec.SkipBytes(2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	n, err = dec.SkipBytes(10)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+type customData struct {
+	Value int32
+}
+
+func (customData) ClassName() string {
+	return "Custom"
+}
+
+type partialReader struct {
+	value int32
+	err   error
+}
+
+func (partialReader) ClassName() string {
+	return "Custom"
+}
+
+func (p *partialReader) ReadObject(dec *Decoder) error {
+	var err error
+	if p.value, err = dec.ReadInt(); err != nil {
+		return err
+	}
+	// Reading past the block data fails without consuming the next object.
+	_, p.err = dec.ReadInt()
+	return nil
+}
+
+// streamOf concatenates bytes and strings into a stream.
+func streamOf(parts ...interface{}) []byte {
+	p := []byte{0xac, 0xed, 0x00, 0x05}
+	for _, part := range parts {
+		switch part := part.(type) {
+		case byte:
+			p = append(p, part)
+		case []byte:
+			p = append(p, part...)
+		case string:
+			p = append(p, part...)
+		}
+	}
+	return p
+}
+
+func TestDecoder_SkipCustomData(t *testing.T) {
+	classDesc := func(flags byte) []byte {
+		return streamOf(TcClassdesc, []byte{0x00, 0x06}, "Custom", []byte{0, 0, 0, 0, 0, 0, 0, 1}, flags,
+			[]byte{0x00, 0x01, 'I', 0x00, 0x05}, "value")[4:]
+	}
+	for _, tc := range []struct {
+		name   string
+		stream []byte
+		typ    reflect.Type
+		object interface{}
+	}{
+		{
+			name: "write method without ReadObject",
+			stream: streamOf(
+				TcObject, classDesc(ScSerializable|ScWriteMethod), TcEndblockdata, TcNull,
+				[]byte{0x00, 0x00, 0x00, 0x2a},
+				[]byte{TcBlockdata, 0x04, 0xde, 0xad, 0xbe, 0xef},
+				// An object of an unregistered class.
+				TcObject, TcClassdesc, []byte{0x00, 0x07}, "Unknown", []byte{0, 0, 0, 0, 0, 0, 0, 1}, ScSerializable,
+				[]byte{0x00, 0x01, 'L', 0x00, 0x01, 's', TcString, 0x00, 0x12}, "Ljava/lang/String;",
+				TcEndblockdata, TcNull,
+				[]byte{TcString, 0x00, 0x03}, "foo",
+				[]byte{TcBlockdatalong, 0x00, 0x00, 0x00, 0x02, 0x01, 0x02},
+				TcEndblockdata,
+				[]byte{TcReference, 0x00, 0x7e, 0x00, 0x05},
+			),
+			typ:    reflect.TypeOf(customData{}),
+			object: &customData{Value: 42},
+		},
+		{
+			name: "class annotation",
+			stream: streamOf(
+				TcObject, classDesc(ScSerializable),
+				[]byte{TcBlockdata, 0x01, 0xff, TcString, 0x00, 0x03}, "foo", TcNull, TcEndblockdata, TcNull,
+				[]byte{0x00, 0x00, 0x00, 0x2a},
+				[]byte{TcReference, 0x00, 0x7e, 0x00, 0x01},
+			),
+			typ:    reflect.TypeOf(customData{}),
+			object: &customData{Value: 42},
+		},
+		{
+			name: "ReadObject reads part of the data",
+			stream: streamOf(
+				TcObject, classDesc(ScSerializable|ScWriteMethod), TcEndblockdata, TcNull,
+				[]byte{TcBlockdata, 0x04, 0x00, 0x00, 0x00, 0x2a},
+				[]byte{TcString, 0x00, 0x03}, "foo",
+				TcEndblockdata,
+				[]byte{TcReference, 0x00, 0x7e, 0x00, 0x02},
+			),
+			typ:    reflect.TypeOf(partialReader{}),
+			object: &partialReader{value: 42, err: io.EOF},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dec, err := NewDecoder(bytes.NewReader(tc.stream))
+			assert.NoError(t, err)
+			dec.RegisterType("Custom", tc.typ)
+			object, err := dec.ReadObject()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.object, object)
+			s, err := dec.ReadObject()
+			assert.NoError(t, err)
+			assert.Equal(t, &String{Value: "foo"}, s)
+		})
+	}
+}
+
+func TestDecoder_SkipCustomDataUnregisteredClass(t *testing.T) {
+	// Outside of skipped data, unregistered classes are still an error.
+	dec, err := NewDecoder(bytes.NewReader(streamOf(
+		TcObject, TcClassdesc, []byte{0x00, 0x07}, "Unknown", []byte{0, 0, 0, 0, 0, 0, 0, 1}, ScSerializable,
+		[]byte{0x00, 0x00}, TcEndblockdata, TcNull,
+	)))
+	assert.NoError(t, err)
+	_, err = dec.ReadObject()
+	var classErr *UnregisteredClassError
+	assert.True(t, errors.As(err, &classErr))
+}
+
+func TestDecoder_SetCaptureSkipped(t *testing.T) {
+	assert := assert.New(t)
+	stream := streamOf(
+		TcObject, TcClassdesc, []byte{0x00, 0x06}, "Custom", []byte{0, 0, 0, 0, 0, 0, 0, 1}, ScSerializable|ScWriteMethod,
+		[]byte{0x00, 0x01, 'I', 0x00, 0x05}, "value", TcEndblockdata, TcNull,
+		[]byte{0x00, 0x00, 0x00, 0x2a},
+		[]byte{TcBlockdata, 0x02, 0x01, 0x02},
+		[]byte{TcString, 0x00, 0x03}, "bar",
+		// An enum constant.
+		TcEnum, TcClassdesc, []byte{0x00, 0x05}, "Color", []byte{0, 0, 0, 0, 0, 0, 0, 0}, ScSerializable|ScEnum,
+		[]byte{0x00, 0x00}, TcEndblockdata,
+		TcClassdesc, []byte{0x00, 0x0e}, "java.lang.Enum", []byte{0, 0, 0, 0, 0, 0, 0, 0}, ScSerializable|ScEnum,
+		[]byte{0x00, 0x00}, TcEndblockdata, TcNull,
+		[]byte{TcString, 0x00, 0x03}, "RED",
+		// A class.
+		TcClass, []byte{TcReference, 0x00, 0x7e, 0x00, 0x03},
+		// A proxy implementing Runnable.
+		TcObject, TcProxyclassdesc, []byte{0x00, 0x00, 0x00, 0x01, 0x00, 0x12}, "java.lang.Runnable", TcEndblockdata,
+		TcClassdesc, []byte{0x00, 0x17}, "java.lang.reflect.Proxy", []byte{0xe1, 0x27, 0xda, 0x20, 0xcc, 0x10, 0x43, 0xcb}, ScSerializable,
+		[]byte{0x00, 0x01, 'L', 0x00, 0x01, 'h', TcString, 0x00, 0x25}, "Ljava/lang/reflect/InvocationHandler;",
+		TcEndblockdata, TcNull,
+		TcNull,
+		TcEndblockdata,
+		[]byte{TcReference, 0x00, 0x7e, 0x00, 0x06},
+	)
+	dec, err := NewDecoder(bytes.NewReader(stream))
+	assert.NoError(err)
+	dec.RegisterType("Custom", reflect.TypeOf(customData{}))
+	var captured []*SkippedData
+	dec.SetCaptureSkipped(func(data *SkippedData) {
+		captured = append(captured, data)
+	})
+	object, err := dec.ReadObject()
+	assert.NoError(err)
+	assert.Equal(&customData{Value: 42}, object)
+	assert.Equal([]*SkippedData{{
+		ClassName: "Custom",
+		Contents:  []interface{}{[]byte{0x01, 0x02}, &String{Value: "bar"}, nil, nil, nil},
+	}}, captured)
+	object, err = dec.ReadObject()
+	assert.NoError(err)
+	assert.Equal(&String{Value: "RED"}, object)
+}
+
+func TestDecoder_ReadObjectReset(t *testing.T) {
+	assert := assert.New(t)
+	dec, err := NewDecoder(bytes.NewReader(streamOf(
+		[]byte{TcString, 0x00, 0x01}, "a",
+		TcReset,
+		[]byte{TcString, 0x00, 0x01}, "b",
+		[]byte{TcReference, 0x00, 0x7e, 0x00, 0x00},
+	)))
+	assert.NoError(err)
+	for _, want := range []string{"a", "b", "b"} {
+		object, err := dec.ReadObject()
+		assert.NoError(err)
+		assert.Equal(&String{Value: want}, object)
+	}
+
+	// Resets within an object are an error, as in Java.
+	dec, err = NewDecoder(bytes.NewReader(streamOf(
+		TcObject, TcClassdesc, []byte{0x00, 0x06}, "Custom", []byte{0, 0, 0, 0, 0, 0, 0, 1}, ScSerializable|ScWriteMethod,
+		[]byte{0x00, 0x01, 'I', 0x00, 0x05}, "value", TcEndblockdata, TcNull,
+		[]byte{0x00, 0x00, 0x00, 0x2a},
+		TcReset, TcEndblockdata,
+	)))
+	assert.NoError(err)
+	dec.RegisterType("Custom", reflect.TypeOf(customData{}))
+	_, err = dec.ReadObject()
+	assert.EqualError(err, "javaio: readObject: unexpected reset (type code 79 at offset 39)")
+}
+
+func TestDecoder_ReadObjectCyclicSuperClass(t *testing.T) {
+	suid := []byte{0, 0, 0, 0, 0, 0, 0, 1}
+	for _, tc := range []struct {
+		name   string
+		stream []byte
+		err    string
+	}{
+		{
+			// The annotation of A holds an object of class B, which
+			// names itself as its superclass.
+			"Self",
+			streamOf(
+				TcObject, TcClassdesc, []byte{0x00, 0x01}, "A", suid, ScSerializable, []byte{0x00, 0x00},
+				TcObject, TcClassdesc, []byte{0x00, 0x01}, "B", suid, ScSerializable, []byte{0x00, 0x00},
+				TcEndblockdata, []byte{TcReference, 0x00, 0x7e, 0x00, 0x01},
+				TcEndblockdata, TcNull,
+			),
+			"javaio: readSuperClassDesc: class B is its own superclass (offset 37)",
+		},
+		{
+			"Indirect",
+			streamOf(
+				TcObject, TcClassdesc, []byte{0x00, 0x01}, "A", suid, ScSerializable, []byte{0x00, 0x00}, TcEndblockdata,
+				TcClassdesc, []byte{0x00, 0x01}, "B", suid, ScSerializable, []byte{0x00, 0x00}, TcEndblockdata,
+				[]byte{TcReference, 0x00, 0x7e, 0x00, 0x00},
+			),
+			"javaio: readSuperClassDesc: class A is its own superclass (offset 21)",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dec, err := NewDecoder(bytes.NewReader(tc.stream))
+			assert.NoError(t, err)
+			_, err = dec.ReadObject()
+			var syntaxErr *SyntaxError
+			assert.True(t, errors.As(err, &syntaxErr), "%v", err)
+			assert.EqualError(t, err, tc.err)
+		})
+	}
+}
+
+func TestDecoder_ReadObjectException(t *testing.T) {
+	assert := assert.New(t)
+	dec, err := NewDecoder(bytes.NewReader(streamOf(
+		[]byte{TcString, 0x00, 0x01}, "a",
+		TcException,
+		TcObject, TcClassdesc, []byte{0x00, 0x13}, "java.io.IOException", []byte{0, 0, 0, 0, 0, 0, 0, 1}, ScSerializable,
+		[]byte{0x00, 0x00}, TcEndblockdata, TcNull,
+		[]byte{TcString, 0x00, 0x01}, "b",
+		[]byte{TcReference, 0x00, 0x7e, 0x00, 0x00},
+	)))
+	assert.NoError(err)
+	_, err = dec.ReadObject()
+	assert.NoError(err)
+	_, err = dec.ReadObject()
+	var abortErr *WriteAbortedError
+	if assert.True(errors.As(err, &abortErr), "%v", err) {
+		assert.Equal(int64(8), abortErr.Offset)
+		assert.Nil(abortErr.Detail)
+	}
+	// The handle table is reset after the exception.
+	for i := 0; i < 2; i++ {
+		object, err := dec.ReadObject()
+		assert.NoError(err)
+		assert.Equal(&String{Value: "b"}, object)
+	}
+}
+
+type resolvedList struct {
+	Value int32
+}
+
+func TestDecoder_SetResolveClass(t *testing.T) {
+	var buf bytes.Buffer
+	enc, err := NewEncoder(&buf)
+	assert.NoError(t, err)
+	enc.SetAnnotateClass(func(enc *Encoder, className string) error {
+		if err := enc.WriteUTF("codebase"); err != nil {
+			return err
+		}
+		return enc.WriteObject(&String{Value: "http://example.com/" + className})
+	})
+	assert.NoError(t, enc.WriteObject(&List{Value: 17}))
+	assert.NoError(t, enc.WriteObject(&customData{Value: 19}))
+	assert.NoError(t, enc.Flush())
+
+	dec, err := NewDecoder(&buf)
+	assert.NoError(t, err)
+	dec.RegisterType("List", reflect.TypeOf(List{}))
+	var annotations []interface{}
+	dec.SetResolveClass(func(dec *Decoder, className string) (reflect.Type, error) {
+		if className != "List" {
+			// The annotation is skipped.
+			return reflect.TypeOf(resolvedList{}), nil
+		}
+		tag, err := dec.ReadUTF()
+		if err != nil {
+			return nil, err
+		}
+		codebase, err := dec.ReadObject()
+		if err != nil {
+			return nil, err
+		}
+		annotations = append(annotations, tag, codebase)
+		return nil, nil
+	})
+	v, err := dec.ReadObject()
+	assert.NoError(t, err)
+	assert.Equal(t, &List{Value: 17}, v)
+	v, err = dec.ReadObject()
+	assert.NoError(t, err)
+	assert.Equal(t, &resolvedList{Value: 19}, v)
+	assert.Equal(t, []interface{}{"codebase", &String{Value: "http://example.com/List"}}, annotations)
+}
+
+func TestDecoder_ReadResolve(t *testing.T) {
+	var buf bytes.Buffer
+	enc, err := NewEncoder(&buf)
+	assert.NoError(t, err)
+	d := &duration{seconds: 42}
+	assert.NoError(t, enc.WriteObject(d))
+	assert.NoError(t, enc.WriteObject(d))
+	assert.NoError(t, enc.Flush())
+
+	dec, err := NewDecoder(&buf)
+	assert.NoError(t, err)
+	dec.RegisterType("Ser", reflect.TypeOf(durationSer{}))
+	v1, err := dec.ReadObject()
+	assert.NoError(t, err)
+	assert.Equal(t, d, v1)
+	// The reference resolves to the same object.
+	v2, err := dec.ReadObject()
+	assert.NoError(t, err)
+	assert.True(t, v1 == v2)
+}
+
+func TestDecoder_SetResolveObject(t *testing.T) {
+	var buf bytes.Buffer
+	enc, err := NewEncoder(&buf)
+	assert.NoError(t, err)
+	assert.NoError(t, enc.WriteObject(&List{Value: 17}))
+	assert.NoError(t, enc.WriteObject(&String{Value: "foo"}))
+	assert.NoError(t, enc.WriteObject(&String{Value: "foo"}))
+	assert.NoError(t, enc.Flush())
+
+	dec, err := NewDecoder(&buf)
+	assert.NoError(t, err)
+	dec.RegisterType("List", reflect.TypeOf(List{}))
+	dec.SetResolveObject(func(object interface{}) (interface{}, error) {
+		switch object := object.(type) {
+		case *List:
+			return &List{Value: object.Value + 1}, nil
+		case *String:
+			return &String{Value: strings.ToUpper(object.Value)}, nil
+		}
+		return object, nil
+	})
+	v, err := dec.ReadObject()
+	assert.NoError(t, err)
+	assert.Equal(t, &List{Value: 18}, v)
+	for i := 0; i < 2; i++ {
+		v, err = dec.ReadObject()
+		assert.NoError(t, err)
+		assert.Equal(t, &String{Value: "FOO"}, v)
+	}
+}
+
+type validatedList struct {
+	Value int32
+	Next  *validatedList
+}
+
+func (validatedList) ClassName() string {
+	return "List"
+}
+
+// validationLog records the values validated by validatedList.
+var validationLog []string
+
+func (l *validatedList) ReadObject(dec *Decoder) error {
+	if err := dec.DefaultReadFields(); err != nil {
+		return err
+	}
+	value := l.Value
+	return dec.RegisterValidation(func() error {
+		validationLog = append(validationLog, fmt.Sprint(value))
+		if value < 0 {
+			return fmt.Errorf("invalid value %d", value)
+		}
+		return nil
+	}, int(value%3))
+}
+
+func TestDecoder_RegisterValidation(t *testing.T) {
+	encode := func(values ...int32) []byte {
+		var list *List
+		for i := len(values) - 1; i >= 0; i-- {
+			list = &List{Value: values[i], Next: list}
+		}
+		var buf bytes.Buffer
+		enc, err := NewEncoder(&buf)
+		assert.NoError(t, err)
+		assert.NoError(t, enc.WriteObject(list))
+		assert.NoError(t, enc.Flush())
+		return buf.Bytes()
+	}
+
+	dec, err := NewDecoder(bytes.NewReader(encode(1, 2, 3, 4, 5)))
+	assert.NoError(t, err)
+	dec.RegisterType("List", reflect.TypeOf(validatedList{}))
+	assert.Error(t, dec.RegisterValidation(func() error { return nil }, 0))
+	validationLog = nil
+	v, err := dec.ReadObject()
+	assert.NoError(t, err)
+	assert.NotNil(t, v)
+	// By priority, then in the order of registration.
+	assert.Equal(t, []string{"5", "2", "4", "1", "3"}, validationLog)
+
+	dec, err = NewDecoder(bytes.NewReader(encode(1, -2, -3)))
+	assert.NoError(t, err)
+	dec.RegisterType("List", reflect.TypeOf(validatedList{}))
+	validationLog = nil
+	_, err = dec.ReadObject()
+	assert.EqualError(t, err, "invalid value -3")
+	assert.Equal(t, []string{"1", "-3"}, validationLog)
+}
+
+func TestDecoder_ReadUnshared(t *testing.T) {
+	var buf bytes.Buffer
+	enc, err := NewEncoder(&buf)
+	assert.NoError(t, err)
+	list := &List{Value: 17}
+	assert.NoError(t, enc.WriteUnshared(list))
+	assert.NoError(t, enc.WriteObject(list))
+	assert.NoError(t, enc.WriteObject(list))
+	assert.NoError(t, enc.Flush())
+	p := buf.Bytes()
+
+	dec, err := NewDecoder(bytes.NewReader(p))
+	assert.NoError(t, err)
+	dec.RegisterType("List", reflect.TypeOf(List{}))
+	v1, err := dec.ReadUnshared()
+	assert.NoError(t, err)
+	v2, err := dec.ReadObject()
+	assert.NoError(t, err)
+	v3, err := dec.ReadObject()
+	assert.NoError(t, err)
+	assert.Equal(t, list, v1)
+	assert.Equal(t, list, v2)
+	assert.False(t, v1 == v2)
+	assert.True(t, v2 == v3)
+
+	// A back reference to the unshared object.
+	dec, err = NewDecoder(bytes.NewReader(append(p[:55:55], TcReference, 0x00, 0x7e, 0x00, 0x02)))
+	assert.NoError(t, err)
+	dec.RegisterType("List", reflect.TypeOf(List{}))
+	_, err = dec.ReadUnshared()
+	assert.NoError(t, err)
+	_, err = dec.ReadObject()
+	assert.EqualError(t, err, "javaio: readHandle: cannot read back reference to unshared object (offset 56)")
+
+	// A back reference read as unshared.
+	dec, err = NewDecoder(bytes.NewReader(p))
+	assert.NoError(t, err)
+	dec.RegisterType("List", reflect.TypeOf(List{}))
+	_, err = dec.ReadUnshared()
+	assert.NoError(t, err)
+	_, err = dec.ReadObject()
+	assert.NoError(t, err)
+	_, err = dec.ReadUnshared()
+	assert.EqualError(t, err, "javaio: readObject: cannot read back reference as unshared (type code 71 at offset 65)")
+}
+
+type parentNode struct {
+	Name  *String
+	Child *childNode
+}
+
+func (parentNode) ClassName() string {
+	return "Parent"
+}
+
+type childNode struct {
+	Parent *parentNode
+}
+
+func (childNode) ClassName() string {
+	return "Child"
+}
+
+// childValue refers back to its parent by value.
+type childValue struct {
+	Parent parentValue
+}
+
+type parentValue struct {
+	Name  *String
+	Child *childValue
+}
+
+// childReader reads its parent by value in a custom ReadObject.
+type childReader struct {
+	Parent parentOfReader
+}
+
+type parentOfReader struct {
+	Name  *String
+	Child *childReader
+}
+
+func (c *childReader) ReadObject(dec *Decoder) error {
+	return dec.ReadObjectInto(&c.Parent)
+}
+
+func TestDecoder_ReadObjectCycle(t *testing.T) {
+	parent := &parentNode{Name: &String{Value: "root"}}
+	parent.Child = &childNode{Parent: parent}
+	var buf bytes.Buffer
+	enc, err := NewEncoder(&buf)
+	assert.NoError(t, err)
+	assert.NoError(t, enc.WriteObject(parent))
+	assert.NoError(t, enc.Flush())
+	p := buf.Bytes()
+
+	dec, err := NewDecoder(bytes.NewReader(p))
+	assert.NoError(t, err)
+	dec.RegisterType("Parent", reflect.TypeOf(parentValue{}))
+	dec.RegisterType("Child", reflect.TypeOf(childValue{}))
+	v, err := dec.ReadObject()
+	assert.NoError(t, err)
+	if assert.IsType(t, &parentValue{}, v) {
+		root := v.(*parentValue)
+		assert.Equal(t, "root", root.Child.Parent.Name.Value)
+		assert.True(t, root.Child.Parent.Child == root.Child)
+	}
+
+	dec, err = NewDecoder(bytes.NewReader(p))
+	assert.NoError(t, err)
+	dec.RegisterType("Parent", reflect.TypeOf(parentOfReader{}))
+	dec.RegisterType("Child", reflect.TypeOf(childReader{}))
+	v, err = dec.ReadObject()
+	assert.NoError(t, err)
+	if assert.IsType(t, &parentOfReader{}, v) {
+		root := v.(*parentOfReader)
+		assert.Equal(t, "root", root.Child.Parent.Name.Value)
+		assert.True(t, root.Child.Parent.Child == root.Child)
+	}
+
+	assert.EqualError(t, dec.ReadObjectInto(childReader{}), "ReadObjectInto: non-pointer or nil javaio.childReader")
+}
+
+// nilSuperA returns its superclass part from a pointer that is never set.
+type nilSuperA struct {
+	base *B
+
+	IntValue int32
+}
+
+func (nilSuperA) ClassName() string {
+	return "A"
+}
+
+func (a *nilSuperA) Super() interface{} {
+	return a.base
+}
+
+func TestDecoder_NilSuper(t *testing.T) {
+	var buf bytes.Buffer
+	enc, err := NewEncoder(&buf)
+	assert.NoError(t, err)
+	assert.NoError(t, enc.WriteObject(&A{IntValue: 42}))
+	assert.NoError(t, enc.Flush())
+
+	dec, err := NewDecoder(&buf)
+	assert.NoError(t, err)
+	dec.RegisterType("A", reflect.TypeOf(nilSuperA{}))
+	_, err = dec.ReadObject()
+	var mismatchErr *TypeMismatchError
+	assert.True(t, errors.As(err, &mismatchErr), "%v", err)
+}
+
+func TestDecoder_EmbeddedSuper(t *testing.T) {
+	a := &A{IntValue: 42, LongValue: -42, StringValue: &String{Value: "foo"}}
+	a.super.SerializableValue = &Serializable{Value: &String{Value: "bar"}}
+	var buf bytes.Buffer
+	enc, err := NewEncoder(&buf)
+	assert.NoError(t, err)
+	assert.NoError(t, enc.WriteObject(a))
+	assert.NoError(t, enc.Flush())
+	p := buf.Bytes()
+
+	for _, typ := range []reflect.Type{reflect.TypeOf(EmbeddedA{}), reflect.TypeOf(TaggedA{})} {
+		dec, err := NewDecoder(bytes.NewReader(p))
+		assert.NoError(t, err)
+		dec.RegisterType("A", typ)
+		dec.RegisterType("B", reflect.TypeOf(B{}))
+		dec.RegisterType("java.lang.String", reflect.TypeOf(String{}))
+		v, err := dec.ReadObject()
+		assert.NoError(t, err)
+		var super *B
+		switch v := v.(type) {
+		case *EmbeddedA:
+			assert.Equal(t, int32(42), v.IntValue)
+			super = &v.B
+		case *TaggedA:
+			assert.Equal(t, int64(-42), v.LongValue)
+			super = v.Base
+		default:
+			t.Fatalf("unexpected %T", v)
+		}
+		if assert.NotNil(t, super) && assert.NotNil(t, super.SerializableValue) {
+			assert.Equal(t, &String{Value: "bar"}, super.SerializableValue.Value)
+		}
+	}
+}
+
+func TestDecoder_NonSerializableSuper(t *testing.T) {
+	var buf bytes.Buffer
+	enc, err := NewEncoder(&buf)
+	assert.NoError(t, err)
+	assert.NoError(t, enc.WriteObject(&Circle{Shape: Shape{Sides: 1}, Radius: 2}))
+	assert.NoError(t, enc.Flush())
+
+	dec, err := NewDecoder(&buf)
+	assert.NoError(t, err)
+	dec.RegisterType("Circle", reflect.TypeOf(Circle{}))
+	v, err := dec.ReadObject()
+	assert.NoError(t, err)
+	assert.Equal(t, &Circle{Shape: Shape{Sides: -1}, Radius: 2}, v)
+}
+
+type convertedFields struct {
+	Byte  float64 `javaio:"b,type=B"`
+	Flag  bool    `javaio:"z,type=B"`
+	Int   int32   `javaio:"d,type=D"`
+	Small uint8   `javaio:"f,type=F"`
+}
+
+func (convertedFields) ClassName() string {
+	return "Converted"
+}
+
+type convertedSource struct {
+	B int8    `javaio:"b"`
+	Z int8    `javaio:"z"`
+	D float64 `javaio:"d"`
+	F float32 `javaio:"f"`
+}
+
+func (convertedSource) ClassName() string {
+	return "Converted"
+}
+
+func TestDecoder_ReadObjectConvertedFields(t *testing.T) {
+	decode := func(object interface{}) (interface{}, error) {
+		var buf bytes.Buffer
+		enc, err := NewEncoder(&buf)
+		assert.NoError(t, err)
+		assert.NoError(t, enc.WriteObject(object))
+		assert.NoError(t, enc.Flush())
+		dec, err := NewDecoder(&buf)
+		assert.NoError(t, err)
+		dec.RegisterType("Converted", reflect.TypeOf(convertedFields{}))
+		return dec.ReadObject()
+	}
+
+	// Both ways through the type= conversions.
+	object := &convertedFields{Byte: -1, Flag: true, Int: 7, Small: 200}
+	v, err := decode(object)
+	if assert.NoError(t, err) {
+		assert.Equal(t, object, v)
+	}
+
+	v, err = decode(&convertedSource{B: -1, Z: -1, D: -1 << 31, F: 255})
+	if assert.NoError(t, err) {
+		assert.Equal(t, &convertedFields{Byte: -1, Flag: true, Int: -1 << 31, Small: 255}, v)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		object *convertedSource
+		value  string
+	}{
+		{"Fraction", &convertedSource{D: 1.5}, "double 1.5"},
+		{"NaN", &convertedSource{D: math.NaN()}, "double NaN"},
+		{"Overflow", &convertedSource{D: 1 << 31}, "double 2.147483648e+09"},
+		{"Negative", &convertedSource{F: -1}, "float -1"},
+		{"Unsigned", &convertedSource{F: 256}, "float 256"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := decode(tc.object)
+			var typeErr *TypeMismatchError
+			if assert.True(t, errors.As(err, &typeErr), "%v", err) {
+				assert.Equal(t, tc.value, typeErr.Value)
+			}
+		})
+	}
+}
+
+type signedInts struct {
+	V8  int8  `javaio:"v8"`
+	V16 int16 `javaio:"v16"`
+	V32 int32 `javaio:"v32"`
+	V64 int64 `javaio:"v64"`
+}
+
+func (signedInts) ClassName() string {
+	return "Ints"
+}
+
+type unsignedInts struct {
+	V8  uint8   `javaio:"v8"`
+	V16 *uint16 `javaio:"v16"`
+	V32 uint32  `javaio:"v32"`
+	V64 uint    `javaio:"v64"`
+}
+
+type goInts struct {
+	V32 int     `javaio:"v32"`
+	V64 uintptr `javaio:"v64"`
+}
+
+type narrowInts struct {
+	V32 int8 `javaio:"v32"`
+}
+
+func TestDecoder_ReadObjectIntegers(t *testing.T) {
+	u16 := uint16(2)
+	for _, tc := range []struct {
+		name        string
+		object      signedInts
+		typ         reflect.Type
+		reinterpret bool
+		want        interface{}
+		err         string
+	}{
+		{
+			name:   "Unsigned",
+			object: signedInts{V8: 1, V16: 2, V32: 3, V64: 4},
+			typ:    reflect.TypeOf(unsignedInts{}),
+			want:   &unsignedInts{V8: 1, V16: &u16, V32: 3, V64: 4},
+		},
+		{
+			// Java int and long fields are both read into int and uintptr.
+			name:   "Int",
+			object: signedInts{V32: -3, V64: 4},
+			typ:    reflect.TypeOf(goInts{}),
+			want:   &goInts{V32: -3, V64: 4},
+		},
+		{
+			name:   "Byte",
+			object: signedInts{V8: -1},
+			typ:    reflect.TypeOf(unsignedInts{}),
+			want:   &unsignedInts{V8: 0xff, V16: new(uint16)},
+		},
+		{
+			name:   "Negative",
+			object: signedInts{V32: -1},
+			typ:    reflect.TypeOf(unsignedInts{}),
+			err:    "javaio: Ints.v32: cannot use int -1 as uint32 (offset 50)",
+		},
+		{
+			name:        "Reinterpret",
+			object:      signedInts{V32: -1, V64: -1},
+			typ:         reflect.TypeOf(unsignedInts{}),
+			reinterpret: true,
+			want:        &unsignedInts{V16: new(uint16), V32: 0xffffffff, V64: ^uint(0)},
+		},
+		{
+			name:        "Narrow",
+			object:      signedInts{V32: 300},
+			typ:         reflect.TypeOf(narrowInts{}),
+			reinterpret: true,
+			err:         "javaio: Ints.v32: cannot use int 300 as int8 (offset 50)",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			enc, err := NewEncoder(&buf)
+			assert.NoError(t, err)
+			assert.NoError(t, enc.WriteObject(&tc.object))
+			assert.NoError(t, enc.Close())
+
+			dec, err := NewDecoder(&buf)
+			assert.NoError(t, err)
+			dec.RegisterType("Ints", tc.typ)
+			dec.SetReinterpretUnsigned(tc.reinterpret)
+			v, err := dec.ReadObject()
+			if tc.err != "" {
+				var typeErr *TypeMismatchError
+				assert.True(t, errors.As(err, &typeErr), "%v", err)
+				assert.EqualError(t, err, tc.err)
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, tc.want, v)
+			}
+		})
+	}
+}
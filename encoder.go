@@ -1,73 +1,197 @@
 package javaio
 
 import (
+	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math"
 	"reflect"
 	"strings"
-	"unicode"
-	"unsafe"
+
+	"github.com/lujjjh/go-javaio/internal/mutf8"
 )
 
-type classNameHolder struct {
-	ClassName string
-}
+// defaultBlockDataSize is the block data size used by ObjectOutputStream.
+const defaultBlockDataSize = 1024
+
+var errEncoderClosed = errors.New("javaio: write to closed Encoder")
 
 type Encoder struct {
-	w                  io.Writer
-	handleMap          map[unsafe.Pointer]refElem
-	classNameHolders   map[string]*classNameHolder
-	stringHolders      map[string]*string
-	blockDataMode      bool
-	blockDataBuffer    [1024]byte
-	blockDataBufferPos int
+	w             *countingWriter
+	bw            *bufio.Writer
+	dst           io.Writer
+	closed        bool
+	handles       map[interface{}]int32 // by identityKey
+	handleCount   int32
+	identity      Identity
+	blockDataMode bool
+	blockData     []byte
+	blockDataSize int
+	data          DataWriter // writes to the Encoder itself
+	scratch       [8]byte
+	annotateClass func(enc *Encoder, className string) error
+	replaceObject func(object interface{}) (interface{}, error)
+	replacements  map[interface{}]interface{} // objects replaced so far, by identityKey
+	reinterpret   bool                        // see SetReinterpretUnsigned
+
+	path        objectPath
+	depth       int
+	customIndex int
 }
 
 type ObjectWriter interface {
 	WriteObject(enc *Encoder) error
 }
 
+// An ObjectReplacer designates an object to be written in its place, like
+// the writeReplace method of a Serializable class. If the replacement is an
+// ObjectReplacer of a different type, it is replaced in turn.
+type ObjectReplacer interface {
+	WriteReplace() interface{}
+}
+
+// A ClassAnnotator writes the annotation of its class descriptor, like the
+// annotateClass method of ObjectOutputStream. The annotation is written in
+// block data mode, and may contain both primitive data and objects.
+type ClassAnnotator interface {
+	AnnotateClass(enc *Encoder) error
+}
+
 type Field struct {
 	Name  string
 	Typ   reflect.Type
 	Value reflect.Value
 }
 
+// NewEncoder returns an Encoder that writes to w. The output is buffered;
+// call Flush or Close to write it to w.
 func NewEncoder(w io.Writer) (*Encoder, error) {
+	bw := bufio.NewWriter(w)
 	stream := &Encoder{
-		w:                w,
-		handleMap:        map[unsafe.Pointer]refElem{},
-		classNameHolders: make(map[string]*classNameHolder),
-		stringHolders:    make(map[string]*string),
-	}
+		w:             &countingWriter{w: bw},
+		bw:            bw,
+		dst:           w,
+		handles:       make(map[interface{}]int32),
+		blockDataSize: defaultBlockDataSize,
+		replacements:  make(map[interface{}]interface{}),
+	}
+	stream.data.reset(stream)
 	if err := stream.writeHeader(); err != nil {
 		return nil, err
 	}
+	// Like ObjectOutputStream, primitive data written between objects goes
+	// in data blocks.
+	stream.blockDataModeOn()
 	return stream, nil
 }
 
+// SetIdentity sets how the Encoder decides whether an object has been
+// written before. The default is IdentityStrings.
+func (enc *Encoder) SetIdentity(identity Identity) {
+	enc.identity = identity
+}
+
+// SetReinterpretUnsigned sets whether an unsigned integer too large for
+// its signed Java type is written as its two's complement bits, e.g. a
+// uint32 of 0xffffffff as the int -1. By default, such a value is an error.
+// A byte is always written as its bits.
+func (enc *Encoder) SetReinterpretUnsigned(reinterpret bool) {
+	enc.reinterpret = reinterpret
+}
+
+// SetBlockDataSize sets the maximum length of the block data records
+// written by custom WriteObject methods. The default is 1024, as in Java;
+// readers accept blocks of up to 1<<31 - 1 bytes.
+func (enc *Encoder) SetBlockDataSize(size int) error {
+	if size <= 0 || int64(size) > math.MaxInt32 {
+		return fmt.Errorf("SetBlockDataSize: invalid size: %d", size)
+	}
+	if err := enc.flush(); err != nil {
+		return err
+	}
+	enc.blockDataSize = size
+	return nil
+}
+
+// SetAnnotateClass sets a function that writes the annotation of every class
+// descriptor whose type does not implement ClassAnnotator, like a subclass
+// of ObjectOutputStream that overrides annotateClass.
+func (enc *Encoder) SetAnnotateClass(f func(enc *Encoder, className string) error) {
+	enc.annotateClass = f
+}
+
+// SetReplaceObject sets a function that returns the object to be written in
+// place of each object, after WriteReplace, like the replaceObject method of
+// ObjectOutputStream once enableReplaceObject is called.
+func (enc *Encoder) SetReplaceObject(f func(object interface{}) (interface{}, error)) {
+	enc.replaceObject = f
+}
+
+// Flush writes any buffered data, including pending block data, to the
+// underlying writer.
+func (enc *Encoder) Flush() error {
+	if enc.closed {
+		return errEncoderClosed
+	}
+	if err := enc.flush(); err != nil {
+		return err
+	}
+	return enc.bw.Flush()
+}
+
+// Close flushes the Encoder and closes the underlying writer if it is an
+// io.Closer. Writing to a closed Encoder returns an error.
+func (enc *Encoder) Close() error {
+	if enc.closed {
+		return errEncoderClosed
+	}
+	err := enc.Flush()
+	enc.closed = true
+	enc.blockDataMode = false
+	if c, ok := enc.dst.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
 func (enc *Encoder) Write(p []byte) (int, error) {
+	if enc.closed {
+		return 0, errEncoderClosed
+	}
 	if !enc.blockDataMode {
 		return enc.w.Write(p)
 	}
-	l := len(p)
-	for l > 0 {
-		if enc.blockDataBufferPos >= len(enc.blockDataBuffer) {
+	n := 0
+	for n < len(p) {
+		if len(enc.blockData) >= enc.blockDataSize {
 			if err := enc.flush(); err != nil {
-				return 0, err
+				return n, err
 			}
 		}
-		wLen := l
-		if maxWLen := len(enc.blockDataBuffer) - enc.blockDataBufferPos; wLen > maxWLen {
-			wLen = maxWLen
+		// Write full blocks directly rather than copying them.
+		if len(enc.blockData) == 0 && len(p)-n >= enc.blockDataSize {
+			if err := enc.writeBlockHeader(enc.blockDataSize); err != nil {
+				return n, err
+			}
+			m, err := enc.w.Write(p[n : n+enc.blockDataSize])
+			n += m
+			if err != nil {
+				return n, err
+			}
+			continue
 		}
-		copy(enc.blockDataBuffer[enc.blockDataBufferPos:], p[:wLen])
-		enc.blockDataBufferPos += wLen
-		l -= wLen
+		m := len(p) - n
+		if free := enc.blockDataSize - len(enc.blockData); m > free {
+			m = free
+		}
+		enc.blockData = append(enc.blockData, p[n:n+m]...)
+		n += m
 	}
-	return len(p), nil
+	return n, nil
 }
 
 func (enc *Encoder) blockDataModeOn() {
@@ -86,85 +210,325 @@ func (enc *Encoder) flush() error {
 	if !enc.blockDataMode {
 		return nil
 	}
-	if enc.blockDataBufferPos == 0 {
+	if len(enc.blockData) == 0 {
 		return nil
 	}
-	if err := enc.writeBlockHeader(enc.blockDataBufferPos); err != nil {
+	if err := enc.writeBlockHeader(len(enc.blockData)); err != nil {
 		return err
 	}
-	_, err := enc.w.Write(enc.blockDataBuffer[:enc.blockDataBufferPos])
+	_, err := enc.w.Write(enc.blockData)
 	if err != nil {
 		return err
 	}
-	enc.blockDataBufferPos = 0
+	enc.blockData = enc.blockData[:0]
 	return nil
 }
 
 func (enc *Encoder) writeBlockHeader(i int) error {
+	b := enc.scratch[:]
 	if i <= 0xFF {
-		_, err := enc.w.Write([]byte{TcBlockdata, byte(i)})
+		b[0], b[1] = TcBlockdata, byte(i)
+		_, err := enc.w.Write(b[:2])
 		return err
 	}
-	if _, err := enc.w.Write([]byte{TcBlockdatalong}); err != nil {
-		return err
-	}
-	return binary.Write(enc.w, binary.BigEndian, int32(i))
+	b[0] = TcBlockdatalong
+	binary.BigEndian.PutUint32(b[1:5], uint32(i))
+	_, err := enc.w.Write(b[:5])
+	return err
 }
 
+// WriteObject writes object, like ObjectOutputStream.writeObject. A boolean
+// or number outside of any struct field is written as primitive data.
+//
+// Go int, uint and uintptr are written as long wherever they occur: as
+// fields, as primitive data, and as elements, so that an []int is a long[]
+// of class [J. Only the type= tag option of a struct field narrows them;
+// write an int[] from an []int32.
 func (enc *Encoder) WriteObject(object interface{}) error {
-	return enc.writeObject(object)
+	return enc.writeObjectOrUnshared(object, false)
 }
 
-func (enc *Encoder) classNameHolder(className string) *classNameHolder {
-	holder, ok := enc.classNameHolders[className]
-	if !ok {
-		holder = &classNameHolder{
-			ClassName: className,
-		}
-		enc.classNameHolders[className] = holder
+// WriteUnshared writes object as a new object even if it has been written
+// before, like ObjectOutputStream.writeUnshared. The object is assigned a
+// handle, but later writes never refer back to it.
+func (enc *Encoder) WriteUnshared(object interface{}) error {
+	return enc.writeObjectOrUnshared(object, true)
+}
+
+func (enc *Encoder) writeObjectOrUnshared(object interface{}, unshared bool) error {
+	if enc.depth == 0 {
+		enc.path = enc.path[:0]
+		return enc.writeObject(object, unshared)
+	}
+	if !isObject(object) {
+		return enc.writeObject(object, unshared)
+	}
+	// Called from a custom WriteObject.
+	enc.path.pushIndex(enc.customIndex)
+	defer enc.path.pop()
+	enc.customIndex++
+	return enc.writeObject(object, unshared)
+}
+
+// isObject reports whether object is written as an object rather than
+// as primitive data.
+func isObject(object interface{}) bool {
+	return !isPrimitiveKind(unpackPointer(reflect.ValueOf(object)).Kind())
+}
+
+func isPrimitiveKind(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+func isIntegerKind(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
 	}
-	return holder
+	return false
 }
 
-func (enc *Encoder) stringHolder(s string) *string {
-	holder, ok := enc.stringHolders[s]
-	if !ok {
-		holder = &s
-		enc.stringHolders[s] = holder
+// intBits returns the width of the Java integral type with the given type
+// code, or 0 if the type is not integral.
+func intBits(code byte) uint {
+	switch code {
+	case 'B':
+		return 8
+	case 'C', 'S':
+		return 16
+	case 'I':
+		return 32
+	case 'J':
+		return 64
 	}
-	return holder
+	return 0
 }
 
-func (enc *Encoder) writeBinary(values ...interface{}) error {
-	for _, value := range values {
-		if err := binary.Write(enc, binary.BigEndian, value); err != nil {
-			return err
+// javaTypeName returns the name of the Java primitive type with the given
+// type code.
+func javaTypeName(code byte) string {
+	switch code {
+	case 'B':
+		return "byte"
+	case 'C':
+		return "char"
+	case 'D':
+		return "double"
+	case 'F':
+		return "float"
+	case 'I':
+		return "int"
+	case 'J':
+		return "long"
+	case 'S':
+		return "short"
+	case 'Z':
+		return "boolean"
+	}
+	return string(code)
+}
+
+// offset returns the number of bytes written so far, including buffered
+// block data.
+func (enc *Encoder) offset() int64 {
+	return enc.w.n + int64(len(enc.blockData))
+}
+
+// typeError fills in the location of an *UnsupportedTypeError returned by
+// one of the type mapping functions.
+func (enc *Encoder) typeError(err error) error {
+	if typeErr, ok := err.(*UnsupportedTypeError); ok && typeErr.Path == "" {
+		typeErr.Offset = enc.offset()
+		typeErr.Path = enc.path.String()
+	}
+	return err
+}
+
+func (enc *Encoder) typeMismatchError(value, typ string) error {
+	return &TypeMismatchError{
+		Offset: enc.offset(),
+		Path:   enc.path.String(),
+		Value:  value,
+		Type:   typ,
+	}
+}
+
+// WriteBoolean writes a boolean as a single byte, like DataOutput.writeBoolean.
+func (enc *Encoder) WriteBoolean(v bool) error {
+	return enc.data.WriteBoolean(v)
+}
+
+// WriteByte writes a single byte, like DataOutput.writeByte.
+func (enc *Encoder) WriteByte(v byte) error {
+	if enc.blockDataMode && len(enc.blockData) < enc.blockDataSize {
+		enc.blockData = append(enc.blockData, v)
+		return nil
+	}
+	enc.scratch[0] = v
+	_, err := enc.Write(enc.scratch[:1])
+	return err
+}
+
+// WriteShort writes a 16-bit integer in big-endian order, like
+// DataOutput.writeShort.
+func (enc *Encoder) WriteShort(v int16) error {
+	return enc.data.WriteShort(v)
+}
+
+// WriteChar writes a UTF-16 code unit, like DataOutput.writeChar.
+func (enc *Encoder) WriteChar(v uint16) error {
+	return enc.data.WriteChar(v)
+}
+
+// WriteInt writes a 32-bit integer in big-endian order, like
+// DataOutput.writeInt.
+func (enc *Encoder) WriteInt(v int32) error {
+	return enc.data.WriteInt(v)
+}
+
+// WriteLong writes a 64-bit integer in big-endian order, like
+// DataOutput.writeLong.
+func (enc *Encoder) WriteLong(v int64) error {
+	return enc.data.WriteLong(v)
+}
+
+// WriteFloat writes the IEEE 754 bits of v, like DataOutput.writeFloat.
+func (enc *Encoder) WriteFloat(v float32) error {
+	return enc.data.WriteFloat(v)
+}
+
+// WriteDouble writes the IEEE 754 bits of v, like DataOutput.writeDouble.
+func (enc *Encoder) WriteDouble(v float64) error {
+	return enc.data.WriteDouble(v)
+}
+
+// WriteBytes writes the low byte of each UTF-16 code unit of s, like
+// DataOutput.writeBytes.
+func (enc *Encoder) WriteBytes(s string) error {
+	return enc.data.WriteBytes(s)
+}
+
+// WriteChars writes the UTF-16 code units of s, like DataOutput.writeChars.
+func (enc *Encoder) WriteChars(s string) error {
+	return enc.data.WriteChars(s)
+}
+
+// WriteUTF writes s in modified UTF-8 preceded by its length in bytes, like
+// DataOutput.writeUTF. The encoded string must not exceed 65535 bytes.
+func (enc *Encoder) WriteUTF(s string) error {
+	return enc.data.WriteUTF(s)
+}
+
+// writePrimitive writes the value of a field or array element of a
+// primitive type.
+func (enc *Encoder) writePrimitive(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		return enc.WriteBoolean(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		code, err := typeCode(v.Type())
+		if err != nil {
+			return enc.typeError(err)
 		}
+		return enc.writeInt(code, v)
+	case reflect.Float32:
+		return enc.WriteFloat(float32(v.Float()))
+	case reflect.Float64:
+		return enc.WriteDouble(v.Float())
 	}
-	return nil
+	return enc.typeError(&UnsupportedTypeError{
+		Type: v.Type(),
+		Msg:  fmt.Sprintf("kind %s has no Java equivalent", v.Kind()),
+	})
+}
+
+// writeInt writes v, an integer, as a value of the Java integral type with
+// the given type code. It fails if v is out of the range of that type,
+// unless v is unsigned and its bits may be reinterpreted.
+func (enc *Encoder) writeInt(code byte, v reflect.Value) error {
+	bits := intBits(code)
+	var n int64
+	var ok bool
+	if k := v.Kind(); k >= reflect.Int && k <= reflect.Int64 {
+		n = v.Int()
+		if code == 'C' {
+			ok = n >= 0 && n <= math.MaxUint16
+		} else {
+			ok = n>>(bits-1) == 0 || n>>(bits-1) == -1
+		}
+	} else {
+		u := v.Uint()
+		n = int64(u)
+		if code == 'C' {
+			ok = u <= math.MaxUint16
+		} else if ok = u>>(bits-1) == 0; !ok && (enc.reinterpret || k == reflect.Uint8) {
+			// Sign-extend the bits of u, if they fit.
+			ok = bits == 64 || u>>bits == 0
+			n = int64(u<<(64-bits)) >> (64 - bits)
+		}
+	}
+	if !ok {
+		return enc.typeMismatchError(fmt.Sprintf("%s %v", v.Type(), v), javaTypeName(code))
+	}
+	switch code {
+	case 'B':
+		return enc.WriteByte(byte(n))
+	case 'C':
+		return enc.WriteChar(uint16(n))
+	case 'S':
+		return enc.WriteShort(int16(n))
+	case 'I':
+		return enc.WriteInt(int32(n))
+	}
+	return enc.WriteLong(n)
 }
 
 func (enc *Encoder) writeHeader() error {
-	return enc.writeBinary(StreamMagic, StreamVersion)
+	binary.BigEndian.PutUint16(enc.scratch[:2], StreamMagic)
+	binary.BigEndian.PutUint16(enc.scratch[2:4], uint16(StreamVersion))
+	_, err := enc.Write(enc.scratch[:4])
+	return err
 }
 
-func (enc *Encoder) writeRefOr(object interface{}, f func() error) error {
-	if handle := enc.findHandle(object); handle != -1 {
-		return enc.writeBinary(TcReference, handle)
+// writeRefOr writes a reference to the object identified by key if it has
+// been written before, and calls f otherwise.
+func (enc *Encoder) writeRefOr(key interface{}, f func() error) error {
+	if handle := enc.findHandle(key); handle != -1 {
+		if err := enc.WriteByte(TcReference); err != nil {
+			return err
+		}
+		return enc.WriteInt(handle)
 	}
 	return f()
 }
 
-func (enc *Encoder) writeObject(object interface{}) error {
+func (enc *Encoder) writeObject(object interface{}, unshared bool) error {
 	v := unpackPointer(reflect.ValueOf(object))
-	if !v.IsValid() {
-		return enc.writeBinary(TcNull)
-	}
-	code := typeCode(unpackPointerType(v.Type()))
-	if code != '[' && code != 'L' {
-		return enc.writeBinary(v.Interface())
+	code := byte('L')
+	if v.IsValid() {
+		var err error
+		code, err = typeCode(unpackPointerType(v.Type()))
+		if err != nil {
+			return enc.typeError(err)
+		}
+		if code != '[' && code != 'L' {
+			return enc.writePrimitive(v)
+		}
 	}
 
+	enc.depth++
+	defer func() {
+		enc.depth--
+	}()
 	oldBlockDataMode := enc.blockDataMode
 	if err := enc.blockDataModeOffAndFlush(); err != nil {
 		return err
@@ -174,75 +538,158 @@ func (enc *Encoder) writeObject(object interface{}) error {
 			enc.blockDataModeOn()
 		}
 	}()
+	if !v.IsValid() {
+		return enc.WriteByte(TcNull)
+	}
 	if v, ok := object.(*Serializable); ok {
 		object = v.Value
 	}
+	object, err := enc.replace(object)
+	if err != nil {
+		return err
+	}
+	if v = unpackPointer(reflect.ValueOf(object)); !v.IsValid() {
+		return enc.WriteByte(TcNull)
+	}
+	if code, err = typeCode(unpackPointerType(v.Type())); err != nil {
+		return enc.typeError(err)
+	}
+	var key interface{}
+	if !unshared {
+		key = enc.identityKey(object)
+	}
 	if v, ok := object.(*String); ok {
 		object = v.Value
 	}
 	if v, ok := object.(string); ok {
-		return enc.writeString(v)
+		return enc.writeString(v, key)
 	}
-	return enc.writeRefOr(object, func() error {
+	return enc.writeRefOr(key, func() error {
 		switch code {
 		case 'L':
-			return enc.newObject(object)
+			return enc.newObject(object, key)
 		case '[':
-			return enc.newArray(object)
+			return enc.newArray(object, key)
 		default:
-			return fmt.Errorf("cannot serialize type: %T", object)
+			return enc.typeMismatchError(fmt.Sprintf("%T", object), "object")
 		}
 	})
 }
 
-func (enc *Encoder) newObject(object interface{}) error {
-	if array, ok := object.(*Array); ok {
-		if err := enc.writeBinary(TcArray); err != nil {
-			return err
-		}
-		if err := enc.writeBinary(TcClassdesc); err != nil {
-			return err
-		}
+func objectReplacer(object interface{}) ObjectReplacer {
+	if replacer, ok := object.(ObjectReplacer); ok && declares(object, "WriteReplace") {
+		return replacer
+	}
+	return nil
+}
 
-		if err := enc.writeClassDesc(array); err != nil {
-			return err
-		}
-		if err := enc.writeBinary(serialVersionUID(object)); err != nil {
-			return err
+// replace returns the object to be written in place of object, as
+// designated by WriteReplace and the ReplaceObject function. Later writes
+// of object are replaced by the same object.
+func (enc *Encoder) replace(object interface{}) (interface{}, error) {
+	if objectReplacer(object) == nil && enc.replaceObject == nil {
+		return object, nil
+	}
+	key := enc.identityKey(object)
+	if rep, ok := enc.replacements[key]; ok {
+		return rep, nil
+	}
+	if enc.findHandle(key) != -1 {
+		return object, nil
+	}
+	rep := object
+	for {
+		replacer := objectReplacer(rep)
+		if replacer == nil {
+			break
 		}
-		if err := enc.classDescInfo(object); err != nil {
-			return err
+		next := replacer.WriteReplace()
+		if next == nil || reflect.TypeOf(next) == reflect.TypeOf(rep) {
+			rep = next
+			break
 		}
-		enc.newHandle(object)
-		l := array.Len()
-		if err := enc.writeBinary(int32(l)); err != nil {
-			return err
+		rep = next
+	}
+	if enc.replaceObject != nil {
+		var err error
+		if rep, err = enc.replaceObject(rep); err != nil {
+			return nil, err
 		}
-		for i := 0; i < l; i++ {
-			if err := enc.writeObject(array.Index(i)); err != nil {
-				return err
-			}
+	}
+	if key != nil {
+		enc.replacements[key] = rep
+	}
+	return rep, nil
+}
+
+func (enc *Encoder) newObject(object interface{}, key interface{}) error {
+	if array, ok := object.(*Array); ok {
+		return enc.writeArray(array, key)
+	}
+	if len(enc.path) == 0 {
+		name, err := className(object)
+		if err != nil {
+			return enc.typeError(err)
 		}
-		return nil
+		enc.path.push(simpleClassName(name))
+		defer enc.path.pop()
 	}
-	if err := enc.writeBinary(TcObject); err != nil {
+	if err := enc.WriteByte(TcObject); err != nil {
 		return err
 	}
 	if err := enc.classDesc(object); err != nil {
 		return err
 	}
-	enc.newHandle(object)
+	enc.newHandle(key)
 	return enc.classData(object)
 }
 
-func (enc *Encoder) writeClassDesc(array *Array) error {
-	if array.Len() < 1 {
-		return enc.writeBinary(TcNull)
+// arrayClassName returns the name of the class of array, as returned by
+// Class.getName, e.g. "[Ljava.lang.String;".
+func arrayClassName(array *Array) (string, error) {
+	desc, err := fieldDescriptor(reflect.SliceOf(arrayElemType(array)))
+	if err != nil {
+		return "", err
 	}
-	return enc.writeUTF("[L" + classNameFromTyp(unpackPointerType(reflect.TypeOf(array.Index(0)))) + ";")
+	return strings.ReplaceAll(desc, "/", "."), nil
 }
 
+// arrayElemType returns the element type of array. The element class of a
+// slice of interfaces is taken from its first element.
+func arrayElemType(array *Array) reflect.Type {
+	typ := array.value.Type().Elem()
+	if typ.Kind() == reflect.Interface && array.Len() > 0 && array.Index(0) != nil {
+		typ = reflect.TypeOf(array.Index(0))
+	}
+	return unpackPointerType(typ)
+}
+
+// super returns the part of object that belongs to its serializable
+// superclass, or nil if its superclass is not serializable.
 func super(object interface{}) interface{} {
+	sup := superPart(object)
+	if sup == nil || isNonSerializable(sup) {
+		return nil
+	}
+	return sup
+}
+
+// superPart returns the part of object that belongs to its superclass: the
+// struct it embeds, or else the result of its Super method. An embedded
+// struct is returned as a pointer if it is addressable.
+func superPart(object interface{}) interface{} {
+	if f, ok := superField(reflect.ValueOf(object)); ok {
+		switch {
+		case f.Kind() == reflect.Ptr && f.IsNil():
+			return reflect.New(f.Type().Elem()).Interface()
+		case f.Kind() == reflect.Ptr:
+			return f.Interface()
+		case f.CanAddr():
+			return f.Addr().Interface()
+		default:
+			return f.Interface()
+		}
+	}
 	type Superer interface {
 		Super() interface{}
 	}
@@ -252,65 +699,98 @@ func super(object interface{}) interface{} {
 	return nil
 }
 
+func isNilPointer(object interface{}) bool {
+	v := reflect.ValueOf(object)
+	return v.Kind() == reflect.Ptr && v.IsNil()
+}
+
 func (enc *Encoder) classDesc(object interface{}) error {
 	if object == nil {
-		return enc.writeBinary(TcNull)
+		return enc.WriteByte(TcNull)
+	}
+	if isNilPointer(object) {
+		// A nil superclass part from Super, whose methods may not take
+		// a nil pointer.
+		return enc.typeMismatchError(fmt.Sprintf("%T", object), "struct")
+	}
+	name, err := className(object)
+	if err != nil {
+		return enc.typeError(err)
 	}
-	return enc.writeRefOr(enc.classNameHolder(className(object)), func() error {
+	return enc.writeRefOr(classNameKey(name), func() error {
 		return enc.newClassDesc(object)
 	})
 }
 
+// writeUTF writes a class or field name in modified UTF-8 preceded by its
+// length in bytes, which must not exceed 65535.
 func (enc *Encoder) writeUTF(s string) error {
-	p := []byte(s)
-	return enc.writeBinary(uint16(len(p)), p)
-}
-
-func (enc *Encoder) writeLongUTF(s string) error {
-	p := []byte(s)
-	return enc.writeBinary(uint64(len(p)), p)
+	p := mutf8.Encode(s)
+	if len(p) > math.MaxUint16 {
+		return fmt.Errorf("writeUTF: encoded name too long: %d bytes", len(p))
+	}
+	if err := enc.WriteShort(int16(len(p))); err != nil {
+		return err
+	}
+	_, err := enc.Write(p)
+	return err
 }
 
-func className(object interface{}) string {
+func className(object interface{}) (string, error) {
 	type ClassNamer interface {
 		ClassName() string
 	}
 	if classNamer, haveClassNamer := object.(ClassNamer); haveClassNamer {
-		return classNamer.ClassName()
+		return classNamer.ClassName(), nil
+	}
+	return "", &UnsupportedTypeError{
+		Type: reflect.TypeOf(object),
+		Msg:  "type does not implement ClassName() string",
 	}
-	log.Panicf("object %v does not implement ClassNamer", object)
-	return ""
 }
 
 func serialVersionUID(object interface{}) int64 {
 	type SerialVersionUIDer interface {
 		SerialVersionUID() int64
 	}
-	if serialVersionUIDer, haveSerialVersionUIDer := object.(SerialVersionUIDer); haveSerialVersionUIDer {
+	if serialVersionUIDer, haveSerialVersionUIDer := object.(SerialVersionUIDer); haveSerialVersionUIDer && declares(object, "SerialVersionUID") {
 		return serialVersionUIDer.SerialVersionUID()
 	}
 	return 0
 }
 
 func (enc *Encoder) newClassDesc(object interface{}) error {
-	if err := enc.writeBinary(TcClassdesc); err != nil {
+	name, err := className(object)
+	if err != nil {
+		return enc.typeError(err)
+	}
+	if sup := super(object); sup != nil && !isNilPointer(sup) {
+		// A ClassName method promoted from an embedded superclass.
+		if superName, _ := className(sup); superName == name {
+			return enc.typeError(&UnsupportedTypeError{
+				Type: reflect.TypeOf(object),
+				Msg:  "same class name as its superclass " + name,
+			})
+		}
+	}
+	if err := enc.WriteByte(TcClassdesc); err != nil {
 		return err
 	}
-	if err := enc.writeUTF(className(object)); err != nil {
+	if err := enc.writeUTF(name); err != nil {
 		return err
 	}
-	if err := enc.writeBinary(serialVersionUID(object)); err != nil {
+	if err := enc.WriteLong(serialVersionUID(object)); err != nil {
 		return err
 	}
-	enc.newHandle(enc.classNameHolder(className(object)))
-	if err := enc.classDescInfo(object); err != nil {
+	enc.newHandle(classNameKey(name))
+	if err := enc.classDescInfo(object, name); err != nil {
 		return err
 	}
 	return nil
 }
 
 func writeObjecter(object interface{}) ObjectWriter {
-	if writeObjecter, haveWriteObjecter := object.(ObjectWriter); haveWriteObjecter {
+	if writeObjecter, haveWriteObjecter := object.(ObjectWriter); haveWriteObjecter && declares(object, "WriteObject") {
 		return writeObjecter
 	}
 	return nil
@@ -321,21 +801,18 @@ func classDescFlags(object interface{}) (flags byte) {
 	if writeObjecter(object) != nil {
 		flags |= ScWriteMethod
 	}
-	//if sup := super(object); sup != nil {
-	//	flags |= classDescFlags(sup)
-	//}
 	// TODO: Enum?...
 	return flags
 }
 
-func (enc *Encoder) classDescInfo(object interface{}) error {
-	if err := enc.writeBinary(classDescFlags(object)); err != nil {
+func (enc *Encoder) classDescInfo(object interface{}, name string) error {
+	if err := enc.WriteByte(classDescFlags(object)); err != nil {
 		return err
 	}
 	if err := enc.fields(object); err != nil {
 		return err
 	}
-	if err := enc.classAnnotation(object); err != nil {
+	if err := enc.classAnnotation(object, name); err != nil {
 		return err
 	}
 	if err := enc.superClassDesc(object); err != nil {
@@ -347,178 +824,153 @@ func (enc *Encoder) classDescInfo(object interface{}) error {
 func (enc *Encoder) fields(object interface{}) error {
 	v := unpackPointer(reflect.ValueOf(object))
 	if v.Kind() != reflect.Struct {
-		return fmt.Errorf("fields: object must be a struct")
-	}
-	numField := v.NumField()
-	fields := make([]Field, 0, numField)
-	for i := 0; i < numField; i++ {
-		t := v.Type()
-		tf := t.Field(i)
-		// Skip unexported fields.
-		if tf.PkgPath != "" {
-			continue
-		}
-		// TODO: optimization.
-		var fieldName string
-		if tag := tf.Tag.Get("javaio"); tag != "" {
-			if tag == "-" {
-				continue
-			}
-			fieldName = tag
-		} else {
-			fieldName = lowerCamelCase(tf.Name)
-		}
-		fields = append(fields, Field{
-			Name:  fieldName,
-			Typ:   unpackPointerType(tf.Type),
-			Value: v.Field(i),
-		})
+		return enc.typeMismatchError(fmt.Sprintf("%T", object), "struct")
 	}
-	if err := enc.writeBinary(int16(len(fields))); err != nil {
+	info := cachedStructInfo(v.Type())
+	if info.err != nil {
+		return enc.typeError(info.error())
+	}
+	if err := enc.WriteShort(int16(len(info.fields))); err != nil {
 		return err
 	}
-
-	enc.sort(fields)
-	for _, field := range fields {
-		if err := enc.fieldDesc(field); err != nil {
+	for i := range info.fields {
+		f := &info.fields[i]
+		enc.path.pushField(f.name)
+		if err := enc.fieldDesc(f, v.Field(f.index)); err != nil {
 			return err
 		}
+		enc.path.pop()
 	}
 	return nil
 }
 
-func (enc *Encoder) sort(fields []Field) {
-	len := len(fields)
-	if len < 2 {
-		return
-	}
-	if len >= 32 {
-		return
-	}
-	index := enc.compare(fields)
-	var pri Field
-	for ; index < len; index++ {
-		left := 0
-		right := index
-		mid := 0
-		pivot := fields[index]
-		for left < right {
-			mid = (left + right) >> 1
-			if !enc.compireTo(pivot, fields[mid]) {
-				right = mid
-				continue
-			}
-			left = mid + 1
+func (enc *Encoder) fieldDesc(f *structField, value reflect.Value) error {
+	if f.err != nil {
+		return enc.typeError(f.error())
+	}
+	typeCode, desc := f.typeCode, f.descriptor
+	if typeCode == 0 {
+		var err error
+		if typeCode, desc, err = dynamicFieldDescriptor(value); err != nil {
+			return enc.typeError(err)
 		}
-
-		n := index - left
-		switch n {
-		case 2:
-			fields[left+2] = fields[left+1]
-			fields[left+1] = fields[left]
-		case 1:
-			fields[left+1] = fields[left]
-		default:
-			var tmp Field
-			for i := 1; i <= n; i++ {
-				if pri.Typ == nil {
-					pri = fields[left+i]
-					fields[left+i] = fields[left+i-1]
-					continue
-				}
-				tmp = fields[left+i]
-				fields[left+i] = pri
-				pri = tmp
-			}
-		}
-		fields[left] = pivot
 	}
-}
-
-func (enc *Encoder) compare(fields []Field) int {
-	index := 1
-	for ; index < len(fields); index++ {
-		if !enc.compireTo(fields[index], fields[index-1]) {
-			break
-		}
+	if err := enc.WriteByte(typeCode); err != nil {
+		return err
 	}
-	if index == 0 {
-		index++
+	if err := enc.writeUTF(f.name); err != nil {
+		return err
 	}
-	return index
-}
-
-func (enc *Encoder) compireTo(now, pri Field) bool {
-	code := now.Typ.Kind()
-	lastCode := pri.Typ.Kind()
-	primitive := code >= reflect.Bool && code <= reflect.Uint64 || code == reflect.Float32 || code == reflect.Float64
-	lastType := lastCode >= reflect.Bool && lastCode <= reflect.Uint64 || lastCode == reflect.Float32 || lastCode == reflect.Float64
-
-	if lastType == primitive {
-		return now.Name > pri.Name
+	switch typeCode {
+	case 'L', '[':
+		return enc.writeString(desc, stringKey(desc))
 	}
-	return !primitive
+	return nil
 }
 
-func lowerCamelCase(name string) string {
-	runes := []rune(name)
-	if len(runes) > 0 {
-		runes[0] = unicode.ToLower(runes[0])
+// dynamicFieldDescriptor returns the type code and descriptor of an
+// interface or *Array field, which depend on the value of the field.
+func dynamicFieldDescriptor(value reflect.Value) (byte, string, error) {
+	if value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			// The declared type is unknown; use the most general one.
+			return 'L', "Ljava/lang/Object;", nil
+		}
+		if err := checkObjectField(value); err != nil {
+			return 0, "", err
+		}
+		value = value.Elem()
 	}
-	return string(runes)
-}
-
-func (enc *Encoder) fieldDesc(field Field) error {
-	if field.Typ.Kind() == reflect.Interface {
-		field.Typ = unpackPointerType(reflect.TypeOf(field.Value.Interface()))
+	if array, ok := value.Interface().(*Array); ok {
+		if array == nil {
+			return '[', "[Ljava/lang/Object;", nil
+		}
+		return '[', strings.ReplaceAll(array.ClassName(), ".", "/"), nil
 	}
-	typeCode := typeCode(field.Typ)
-	array, ok := field.Value.Interface().(*Array)
-	if ok {
-		typeCode = '['
+	typ := unpackPointerType(value.Type())
+	typeCode, err := typeCode(typ)
+	if err != nil {
+		return 0, "", err
 	}
-	if err := enc.writeBinary(typeCode); err != nil {
-		return err
+	var desc string
+	if typeCode == 'L' || typeCode == '[' {
+		if desc, err = fieldDescriptor(typ); err != nil {
+			return 0, "", err
+		}
 	}
-	if err := enc.writeUTF(field.Name); err != nil {
-		return err
+	return typeCode, desc, nil
+}
+
+// checkObjectField returns an error if value, the value of an object field,
+// holds a boolean or a number. The field sorts among the objects, but the
+// value would be written as a primitive, which Java rejects; it must be
+// given as an object such as a java.lang.Integer instead.
+func checkObjectField(value reflect.Value) error {
+	if value.Kind() != reflect.Interface || value.IsNil() {
+		return nil
 	}
-	switch typeCode {
-	case 'L', '[':
-		if array != nil {
-			return enc.writeString(array.ClassName())
+	typ := value.Elem().Type()
+	if code, err := typeCode(unpackPointerType(typ)); err == nil && isPrimitiveTypeCode(code) {
+		return &UnsupportedTypeError{
+			Type: typ,
+			Msg:  "primitive value in an object field",
 		}
-		return enc.writeString(fieldDescriptor(field.Typ))
 	}
 	return nil
 }
 
-func (enc *Encoder) classAnnotation(object interface{}) error {
-	// TODO
-	return enc.writeBinary(TcEndblockdata)
+func (enc *Encoder) classAnnotation(object interface{}, name string) error {
+	var annotate func(enc *Encoder) error
+	if annotator, ok := object.(ClassAnnotator); ok && declares(object, "AnnotateClass") {
+		annotate = annotator.AnnotateClass
+	} else if enc.annotateClass != nil {
+		annotate = func(enc *Encoder) error {
+			return enc.annotateClass(enc, name)
+		}
+	}
+	if annotate != nil {
+		enc.blockDataModeOn()
+		prevCustomIndex := enc.customIndex
+		enc.customIndex = 0
+		err := annotate(enc)
+		enc.customIndex = prevCustomIndex
+		if err != nil {
+			return err
+		}
+		if err := enc.blockDataModeOffAndFlush(); err != nil {
+			return err
+		}
+	}
+	return enc.WriteByte(TcEndblockdata)
 }
 
 func (enc *Encoder) superClassDesc(object interface{}) error {
 	return enc.classDesc(super(object))
 }
 
-func (enc *Encoder) writeString(s string) error {
-	holder := enc.stringHolder(s)
-	return enc.writeRefOr(holder, func() error {
-		p := []byte(s)
-		l := len(p)
-		if l <= 0xFFFF {
-			if err := enc.writeBinary(TcString); err != nil {
+// writeString writes s as a String object identified by key.
+func (enc *Encoder) writeString(s string, key interface{}) error {
+	return enc.writeRefOr(key, func() error {
+		p := mutf8.Encode(s)
+		if len(p) <= math.MaxUint16 {
+			if err := enc.WriteByte(TcString); err != nil {
+				return err
+			}
+			enc.newHandle(key)
+			if err := enc.WriteShort(int16(len(p))); err != nil {
+				return err
+			}
+		} else {
+			if err := enc.WriteByte(TcLongstring); err != nil {
+				return err
+			}
+			enc.newHandle(key)
+			if err := enc.WriteLong(int64(len(p))); err != nil {
 				return err
 			}
-			enc.newHandle(holder)
-			return enc.writeUTF(s)
-		}
-		if err := enc.writeBinary(TcLongstring); err != nil {
-			return err
 		}
-		enc.newHandle(s)
-		return enc.writeLongUTF(s)
+		_, err := enc.Write(p)
+		return err
 	})
 }
 
@@ -534,14 +986,17 @@ func (enc *Encoder) classData(object interface{}) error {
 			return enc.nowrclass(object)
 		} else {
 			enc.blockDataModeOn()
+			prevCustomIndex := enc.customIndex
+			enc.customIndex = 0
 			err := writeObjecter(object).WriteObject(enc)
+			enc.customIndex = prevCustomIndex
 			if err != nil {
 				return err
 			}
 			if err := enc.blockDataModeOffAndFlush(); err != nil {
 				return err
 			}
-			return enc.writeBinary(TcEndblockdata)
+			return enc.WriteByte(TcEndblockdata)
 		}
 	}
 	return fmt.Errorf("classData: flags %d not supported", int(flags))
@@ -550,60 +1005,134 @@ func (enc *Encoder) classData(object interface{}) error {
 func (enc *Encoder) nowrclass(object interface{}) error {
 	v := unpackPointer(reflect.ValueOf(object))
 	if v.Kind() != reflect.Struct {
-		return fmt.Errorf("fields: object must be a struct")
-	}
-	numField := v.NumField()
-	t := v.Type()
-	fields := make([]Field, 0, numField)
-	for i := 0; i < numField; i++ {
-		tf := t.Field(i)
-		// Skip unexported fields.
-		if tf.PkgPath != "" {
-			continue
-		}
-		if tag := tf.Tag.Get("javaio"); tag == "-" {
-			continue
-		}
-		fields = append(fields, Field{
-			Name:  lowerCamelCase(tf.Name),
-			Typ:   unpackPointerType(tf.Type),
-			Value: v.Field(i),
-		})
-	}
-	enc.sort(fields)
-	for _, f := range fields {
-		if err := enc.writeObject(f.Value.Interface()); err != nil {
+		return enc.typeMismatchError(fmt.Sprintf("%T", object), "struct")
+	}
+	info := cachedStructInfo(v.Type())
+	for i := range info.fields {
+		f := &info.fields[i]
+		enc.path.pushField(f.name)
+		if f.convert {
+			if err := enc.writePrimitiveAs(f.typeCode, unpackPointer(v.Field(f.index))); err != nil {
+				return err
+			}
+		} else if err := checkObjectField(v.Field(f.index)); err != nil {
+			return enc.typeError(err)
+		} else if err := enc.writeObject(v.Field(f.index).Interface(), false); err != nil {
 			return err
 		}
+		enc.path.pop()
 	}
 	return nil
 }
 
-func (enc *Encoder) newArray(object interface{}) error {
-	array := NewArray(object)
-	if err := enc.writeBinary(TcArray); err != nil {
+// writePrimitiveAs writes v, a boolean or a number, as a value of the Java
+// primitive type with the given type code. A nil pointer is written as
+// zero.
+func (enc *Encoder) writePrimitiveAs(code byte, v reflect.Value) error {
+	if isIntegerKind(v.Kind()) && intBits(code) != 0 {
+		return enc.writeInt(code, v)
+	}
+	var i int64
+	var f float64
+	switch v.Kind() {
+	case reflect.Invalid:
+	case reflect.Bool:
+		if v.Bool() {
+			i, f = 1, 1
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i = v.Int()
+		f = float64(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		i = int64(v.Uint())
+		f = float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		f = v.Float()
+		if bits := intBits(code); bits != 0 {
+			lo, hi := -math.Ldexp(1, int(bits)-1), math.Ldexp(1, int(bits)-1)
+			if code == 'C' {
+				lo, hi = 0, math.MaxUint16+1
+			}
+			if !(f >= lo && f < hi) {
+				return enc.typeMismatchError(fmt.Sprintf("%s %v", v.Type(), v), javaTypeName(code))
+			}
+		}
+		i = int64(f)
+	default:
+		return enc.typeMismatchError(v.Type().String(), string(code))
+	}
+	switch code {
+	case 'Z':
+		return enc.WriteBoolean(i != 0 || f != 0)
+	case 'B':
+		return enc.WriteByte(byte(i))
+	case 'C':
+		return enc.WriteChar(uint16(i))
+	case 'S':
+		return enc.WriteShort(int16(i))
+	case 'I':
+		return enc.WriteInt(int32(i))
+	case 'J':
+		return enc.WriteLong(i)
+	case 'F':
+		return enc.WriteFloat(float32(f))
+	case 'D':
+		return enc.WriteDouble(f)
+	}
+	return enc.typeMismatchError(v.Type().String(), string(code))
+}
+
+func (enc *Encoder) newArray(object interface{}, key interface{}) error {
+	array, err := NewArray(object)
+	if err != nil {
+		return enc.typeError(err)
+	}
+	return enc.writeArray(array, key)
+}
+
+func (enc *Encoder) writeArray(array *Array, key interface{}) error {
+	if err := enc.WriteByte(TcArray); err != nil {
 		return err
 	}
 	if err := enc.classDesc(array); err != nil {
 		return err
 	}
-	enc.newHandle(object)
+	enc.newHandle(key)
+	return enc.arrayElements(array)
+}
+
+func (enc *Encoder) arrayElements(array *Array) error {
 	l := array.Len()
-	if err := enc.writeBinary(int32(l)); err != nil {
+	if err := enc.WriteInt(int32(l)); err != nil {
+		return err
+	}
+	elemKind := array.value.Type().Elem().Kind()
+	if elemKind == reflect.Uint8 && array.value.Kind() == reflect.Slice {
+		_, err := enc.Write(array.value.Bytes())
 		return err
 	}
+	if isPrimitiveKind(elemKind) {
+		for i := 0; i < l; i++ {
+			if err := enc.writePrimitive(array.value.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 	for i := 0; i < l; i++ {
-		if err := enc.writeObject(array.Index(i)); err != nil {
+		enc.path.pushIndex(i)
+		if err := enc.writeObject(array.Index(i), false); err != nil {
 			return err
 		}
+		enc.path.pop()
 	}
 	return nil
 }
 
-func typeCode(typ reflect.Type) byte {
+func typeCode(typ reflect.Type) (byte, error) {
 	var typeCode byte
 	switch kind := typ.Kind(); kind {
-	case reflect.Uint8:
+	case reflect.Int8, reflect.Uint8:
 		typeCode = 'B'
 	// TODO: char?
 	case reflect.Float64:
@@ -612,7 +1141,10 @@ func typeCode(typ reflect.Type) byte {
 		typeCode = 'F'
 	case reflect.Int32, reflect.Uint32:
 		typeCode = 'I'
-	case reflect.Int64, reflect.Uint64:
+	case reflect.Int64, reflect.Uint64, reflect.Int, reflect.Uint, reflect.Uintptr:
+		// Whatever their size, int, uint and uintptr are long: the type
+		// code is cached with the struct and names array classes, so it
+		// cannot depend on the Encoder. The type= option narrows a field.
 		typeCode = 'J'
 	case reflect.Int16, reflect.Uint16:
 		typeCode = 'S'
@@ -623,22 +1155,40 @@ func typeCode(typ reflect.Type) byte {
 	case reflect.Struct, reflect.String:
 		typeCode = 'L'
 	default:
-		log.Panicf("unsupported type: %v", typ)
+		return 0, &UnsupportedTypeError{
+			Type: typ,
+			Msg:  fmt.Sprintf("kind %s has no Java equivalent", typ.Kind()),
+		}
 	}
-	return typeCode
+	return typeCode, nil
 }
 
-func fieldDescriptor(typ reflect.Type) string {
-	code := string(typeCode(typ))
+func fieldDescriptor(typ reflect.Type) (string, error) {
+	code, err := typeCode(typ)
+	if err != nil {
+		return "", err
+	}
 	switch code {
-	case "L":
-		return code + strings.ReplaceAll(classNameFromTyp(typ), ".", "/") + ";"
-	case "[":
-		return code + fieldDescriptor(unpackPointerType(typ.Elem()))
+	case 'L':
+		name, err := classNameFromTyp(typ)
+		if err != nil {
+			return "", err
+		}
+		return "L" + strings.ReplaceAll(name, ".", "/") + ";", nil
+	case '[':
+		elemDesc, err := fieldDescriptor(unpackPointerType(typ.Elem()))
+		if err != nil {
+			return "", err
+		}
+		return "[" + elemDesc, nil
 	}
-	return code
+	return string(code), nil
 }
 
-func classNameFromTyp(typ reflect.Type) string {
-	return className(reflect.New(typ).Interface())
+func classNameFromTyp(typ reflect.Type) (string, error) {
+	name, err := className(reflect.New(typ).Interface())
+	if err != nil && typ.Kind() == reflect.String {
+		return String{}.ClassName(), nil
+	}
+	return name, err
 }
@@ -2,8 +2,11 @@ package javaio
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"math"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -34,8 +37,9 @@ func TestEncoder_WriteObject_1(t *testing.T) {
 	var buf bytes.Buffer
 	enc, err := NewEncoder(&buf)
 	assert.NoError(t, err)
-	assert.NoError(t, enc.writeObject(list1))
-	assert.NoError(t, enc.writeObject(list2))
+	assert.NoError(t, enc.writeObject(list1, false))
+	assert.NoError(t, enc.writeObject(list2, false))
+	assert.NoError(t, enc.Flush())
 	assert.Equal(t, []byte{
 		0xac, 0xed, 0x0, 0x5, 0x73, 0x72, 0x0, 0x4, 0x4c, 0x69, 0x73, 0x74, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x2, 0x0, 0x2,
 		0x49, 0x0, 0x5, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x4c, 0x0, 0x4, 0x6e, 0x65, 0x78, 0x74, 0x74, 0x0, 0x6, 0x4c, 0x4c, 0x69,
@@ -87,6 +91,7 @@ func TestEncoder_WriteObject_2(t *testing.T) {
 	enc, err := NewEncoder(&buf)
 	assert.NoError(t, err)
 	assert.NoError(t, enc.WriteObject(a))
+	assert.NoError(t, enc.Flush())
 	assert.Equal(t, []byte{
 		0xac, 0xed, 0x00, 0x05, 0x73, 0x72, 0x00, 0x01, 0x41, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
 		0x01, 0x02, 0x00, 0x03, 0x49, 0x00, 0x08, 0x69, 0x6e, 0x74, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x4a,
@@ -110,6 +115,9 @@ func TestEncoder_Write(t *testing.T) {
 	if err := enc.WriteObject(list); err != nil {
 		panic(err)
 	}
+	if err := enc.Flush(); err != nil {
+		panic(err)
+	}
 
 	dec, _ := NewDecoder(&buf)
 	type ClassName interface {
@@ -140,6 +148,9 @@ func TestNewEncoder(t *testing.T) {
 	if err := enc.WriteObject(pkg); err != nil {
 		t.Fatal(err)
 	}
+	if err := enc.Flush(); err != nil {
+		t.Fatal(err)
+	}
 	assert.Equal(t, []byte{
 		0xac, 0xed, 0x0, 0x5, 0x73, 0x72, 0x0, 0x31, 0x63, 0x6f, 0x6d, 0x2e, 0x74, 0x61, 0x6f, 0x62, 0x61, 0x6f, 0x2e, 0x63, 0x6f,
 		0x6e, 0x66, 0x69, 0x67, 0x2e, 0x63, 0x6f, 0x6d, 0x6d, 0x6f, 0x6e, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x63, 0x6f, 0x6c,
@@ -167,7 +178,7 @@ func TestNewEncoder(t *testing.T) {
 		0x7e, 0x0, 0x6, 0x4c, 0x0, 0x8, 0x72, 0x65, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x74, 0x0, 0x23, 0x4c, 0x63, 0x6f, 0x6d, 0x2f, 0x74,
 		0x61, 0x6f, 0x62, 0x61, 0x6f, 0x2f, 0x63, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x2f, 0x63, 0x6f, 0x6d, 0x6d, 0x6f, 0x6e, 0x2f, 0x52, 0x65,
 		0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x3b, 0x78, 0x70, 0x1, 0x75, 0x72, 0x0, 0x13, 0x5b, 0x4c, 0x6a, 0x61, 0x76, 0x61, 0x2e, 0x6c,
-		0x61, 0x6e, 0x67, 0x2e, 0x53, 0x74, 0x72, 0x69, 0x6e, 0x67, 0x3b, 0x43, 0xbc, 0xed, 0x3, 0x1d, 0xbc, 0x8, 0xdd, 0x2, 0x0, 0x0,
+		0x61, 0x6e, 0x67, 0x2e, 0x53, 0x74, 0x72, 0x69, 0x6e, 0x67, 0x3b, 0xad, 0xd2, 0x56, 0xe7, 0xe9, 0x1d, 0x7b, 0x47, 0x2, 0x0, 0x0,
 		0x78, 0x70, 0x0, 0x0, 0x0, 0x1, 0x74, 0x0, 0xe, 0x72, 0x65, 0x67, 0x69, 0x73, 0x74, 0x72, 0x79, 0x2e, 0x4b, 0x65, 0x79, 0x28,
 		0x29, 0x73, 0x72, 0x0, 0x14, 0x6a, 0x61, 0x76, 0x61, 0x2e, 0x75, 0x74, 0x69, 0x6c, 0x2e, 0x4c, 0x69, 0x6e, 0x6b, 0x65, 0x64,
 		0x4c, 0x69, 0x73, 0x74, 0xc, 0x29, 0x53, 0x5d, 0x4a, 0x60, 0x88, 0x22, 0x3, 0x0, 0x0, 0x78, 0x70, 0x77, 0x4, 0x0, 0x0, 0x0,
@@ -180,7 +191,7 @@ func TestNewEncoder(t *testing.T) {
 		0x72, 0x0, 0x21, 0x63, 0x6f, 0x6d, 0x2e, 0x74, 0x61, 0x6f, 0x62, 0x61, 0x6f, 0x2e, 0x63, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x2e,
 		0x63, 0x6f, 0x6d, 0x6d, 0x6f, 0x6e, 0x2e, 0x52, 0x65, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
 		0x1, 0x2, 0x0, 0x1, 0x4a, 0x0, 0x8, 0x72, 0x65, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x78, 0x70, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
-		0x0, 0x2, 0x71, 0x0, 0x7e, 0x0, 0xd, 0x78,
+		0x0, 0x2, 0x71, 0x0, 0x7e, 0x0, 0xe, 0x78,
 	}, reader.Bytes())
 }
 
@@ -228,7 +239,7 @@ func NewPackage() *Package {
 }
 
 func (Packet) ClassName() string {
-	return "cn.Packet"
+	return "com.taobao.config.common.protocol.ProtocolPacket"
 }
 
 func (Packet) SerialVersionUID() int64 {
@@ -281,7 +292,7 @@ func (packet *Packet) WriteObject(w *Encoder) error {
 }
 
 func (Package) ClassName() string {
-	return "cn.Package"
+	return "com.taobao.config.common.protocol.ProtocolPackage"
 }
 
 func (Package) SerialVersionUID() int64 {
@@ -366,7 +377,7 @@ func (packet *RegReqPacket) SetAttribute(name *String, value *Serializable) {
 }
 
 func (Version) ClassName() string {
-	return "cn.Version"
+	return "com.taobao.config.common.protocol.VersionElement"
 }
 
 func (Version) SerialVersionUID() int64 {
@@ -378,15 +389,15 @@ func (Version) UID() int32 {
 }
 
 type UserData struct {
-	ID       *String   `javaio:"id"`
+	ID       *String   `javaio:"dataId"`
 	Revision *Revision `javaio:"revision"`
-	IDs      *Array    `javaio:"ids"`
+	IDs      *Array    `javaio:"clientIds"`
 	Data     *LinkedList
-	Ack      bool `javaio:"ack"`
+	Ack      bool `javaio:"needAck"`
 }
 
 func (UserData) ClassName() string {
-	return "cn.UserData"
+	return "com.taobao.config.common.protocol.UserDataElement"
 }
 
 func (UserData) SerialVersionUID() int64 {
@@ -428,11 +439,11 @@ func (u *UserData) UnwrappedValues() (result []interface{}) {
 
 type Publisher struct {
 	super UserData
-	Id    *String `javaio:"id"`
+	Id    *String `javaio:"clientId"`
 }
 
 func (Publisher) ClassName() string {
-	return "cn.Publisher"
+	return "com.taobao.config.common.protocol.PublisherDataElement"
 }
 
 func (Publisher) SerialVersionUID() int64 {
@@ -457,7 +468,7 @@ func NewPublisherDataElement(dataId *String, clientId *String, data *LinkedList)
 			Ack:      true,
 			ID:       dataId,
 			Data:     data,
-			IDs:      NewArray([]*String{clientId}),
+			IDs:      MustNewArray([]*String{clientId}),
 			Revision: &Revision{2},
 		},
 		Id: clientId,
@@ -510,7 +521,7 @@ type Swizzle struct {
 }
 
 func (Swizzle) ClassName() string {
-	return "cn.Swizzle"
+	return "com.taobao.config.common.protocol.Swizzle"
 }
 
 func (Swizzle) SerialVersionUID() int64 {
@@ -557,6 +568,9 @@ func (s Swizzle) WriteObject(enc *Encoder) error {
 	if err = encoder.WriteObject(s.Object); err != nil {
 		return err
 	}
+	if err = encoder.Flush(); err != nil {
+		return err
+	}
 	if err = enc.WriteObject(int32(buf.Len())); err != nil {
 		return err
 	}
@@ -599,3 +613,942 @@ func (p *PublisherPacket) SetAttribute(name *String, value *Serializable) {
 func (PublisherPacket) UID() int32 {
 	return 10 // PACKET_PUBLISHER_REG_REQUEST
 }
+
+type unsupportedHolder struct {
+	Value interface{}
+}
+
+func (unsupportedHolder) ClassName() string {
+	return "com.example.Holder"
+}
+
+type noClassName struct {
+	Value int32
+}
+
+func TestEncoder_WriteObjectUnsupportedType(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		value interface{}
+		typ   reflect.Type
+	}{
+		{"Complex", complex(1, 2), reflect.TypeOf(complex128(0))},
+		{"Map", map[string]int32{}, reflect.TypeOf(map[string]int32{})},
+		{"Chan", make(chan int32), reflect.TypeOf(make(chan int32))},
+		{"Func", func() {}, reflect.TypeOf(func() {})},
+		{"NoClassName", &noClassName{}, reflect.TypeOf(&noClassName{})},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			enc, err := NewEncoder(&bytes.Buffer{})
+			assert.NoError(t, err)
+			err = enc.WriteObject(tc.value)
+			var typeErr *UnsupportedTypeError
+			if assert.True(t, errors.As(err, &typeErr), "%v", err) {
+				assert.Equal(t, tc.typ, typeErr.Type)
+				assert.Equal(t, "", typeErr.Path)
+			}
+
+			enc, err = NewEncoder(&bytes.Buffer{})
+			assert.NoError(t, err)
+			err = enc.WriteObject(&unsupportedHolder{Value: tc.value})
+			if assert.True(t, errors.As(err, &typeErr), "%v", err) {
+				assert.Equal(t, tc.typ, typeErr.Type)
+				assert.Equal(t, "Holder.value", typeErr.Path)
+			}
+		})
+	}
+}
+
+func TestEncoder_WriteObjectNilInterfaceField(t *testing.T) {
+	var buf bytes.Buffer
+	enc, err := NewEncoder(&buf)
+	assert.NoError(t, err)
+	assert.NoError(t, enc.WriteObject(&unsupportedHolder{}))
+	assert.NoError(t, enc.Flush())
+	assert.Contains(t, buf.String(), "Ljava/lang/Object;")
+}
+
+type numberHolder struct {
+	Value interface{} `javaio:",class=java.lang.Number"`
+}
+
+func (numberHolder) ClassName() string {
+	return "com.example.NumberHolder"
+}
+
+func TestEncoder_WriteObjectPrimitiveInObjectField(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		objects []interface{}
+		path    string
+	}{
+		{"Interface", []interface{}{&unsupportedHolder{Value: int32(1)}}, "Holder.value"},
+		{"Pointer", []interface{}{&unsupportedHolder{Value: new(float64)}}, "Holder.value"},
+		// The descriptor written for the first object declares an Object.
+		{"Cached", []interface{}{&unsupportedHolder{}, &unsupportedHolder{Value: true}}, "Holder.value"},
+		{"Class", []interface{}{&numberHolder{Value: int64(1)}}, "NumberHolder.value"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			enc, err := NewEncoder(&bytes.Buffer{})
+			assert.NoError(t, err)
+			last := len(tc.objects) - 1
+			for _, object := range tc.objects[:last] {
+				assert.NoError(t, enc.WriteObject(object))
+			}
+			err = enc.WriteObject(tc.objects[last])
+			var typeErr *UnsupportedTypeError
+			if assert.True(t, errors.As(err, &typeErr), "%v", err) {
+				assert.Equal(t, tc.path, typeErr.Path)
+			}
+		})
+	}
+}
+
+type writeRecorder struct {
+	bytes.Buffer
+	writes int
+	closed bool
+}
+
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func (w *writeRecorder) Close() error {
+	w.closed = true
+	return nil
+}
+
+func TestEncoder_WriteObjectModifiedUTF8(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	enc, err := NewEncoder(&buf)
+	assert.NoError(err)
+	assert.NoError(enc.WriteObject(&String{Value: "a\x00\U0001F600"}))
+	assert.NoError(enc.Flush())
+	// As written by ObjectOutputStream.writeObject("a\u0000\uD83D\uDE00").
+	assert.Equal([]byte{
+		0xac, 0xed, 0x00, 0x05, TcString, 0x00, 0x09,
+		'a', 0xc0, 0x80, 0xed, 0xa0, 0xbd, 0xed, 0xb8, 0x80,
+	}, buf.Bytes())
+
+	// 40000 NULs take 80000 bytes in modified UTF-8.
+	buf.Reset()
+	enc, err = NewEncoder(&buf)
+	assert.NoError(err)
+	assert.NoError(enc.WriteObject(&String{Value: strings.Repeat("\x00", 40000)}))
+	assert.NoError(enc.Flush())
+	assert.Equal([]byte{0xac, 0xed, 0x00, 0x05, TcLongstring, 0, 0, 0, 0, 0, 0x01, 0x38, 0x80}, buf.Bytes()[:13])
+	assert.Equal(13+80000, buf.Len())
+}
+
+type longClassName struct{}
+
+func (longClassName) ClassName() string {
+	return strings.Repeat("\u00e9", 40000)
+}
+
+func TestEncoder_WriteObjectLongClassName(t *testing.T) {
+	enc, err := NewEncoder(&bytes.Buffer{})
+	assert.NoError(t, err)
+	assert.EqualError(t, enc.WriteObject(&longClassName{}), "writeUTF: encoded name too long: 80000 bytes")
+}
+
+func TestEncoder_Flush(t *testing.T) {
+	var w writeRecorder
+	enc, err := NewEncoder(&w)
+	assert.NoError(t, err)
+	assert.NoError(t, enc.WriteObject(&List{Value: 17, Next: &List{Value: 19}}))
+	assert.Equal(t, 0, w.writes)
+	assert.NoError(t, enc.Flush())
+	assert.Equal(t, 1, w.writes)
+
+	dec, err := NewDecoder(&w)
+	assert.NoError(t, err)
+	dec.RegisterType("List", reflect.TypeOf(List{}))
+	v, err := dec.ReadObject()
+	assert.NoError(t, err)
+	assert.Equal(t, &List{Value: 17, Next: &List{Value: 19}}, v)
+}
+
+func TestEncoder_Close(t *testing.T) {
+	var w writeRecorder
+	enc, err := NewEncoder(&w)
+	assert.NoError(t, err)
+	assert.NoError(t, enc.WriteObject(&List{Value: 17}))
+	assert.NoError(t, enc.Close())
+	assert.True(t, w.closed)
+	assert.NotZero(t, w.Len())
+
+	assert.Error(t, enc.WriteObject(&List{Value: 19}))
+	assert.Error(t, enc.Flush())
+	assert.Error(t, enc.Close())
+}
+
+func TestEncoder_SetBlockDataSize(t *testing.T) {
+	enc, err := NewEncoder(&bytes.Buffer{})
+	assert.NoError(t, err)
+	assert.Error(t, enc.SetBlockDataSize(0))
+	assert.Error(t, enc.SetBlockDataSize(-1))
+
+	p := bytes.Repeat([]byte("0123456789"), 300)
+	for _, tc := range []struct {
+		size   int
+		header []byte // of the first block
+	}{
+		{100, []byte{TcBlockdata, 100}},
+		{1024, []byte{TcBlockdatalong, 0x00, 0x00, 0x04, 0x00}},
+		{1 << 20, []byte{TcBlockdatalong}},
+	} {
+		var buf bytes.Buffer
+		enc, err := NewEncoder(&buf)
+		assert.NoError(t, err)
+		assert.NoError(t, enc.SetBlockDataSize(tc.size))
+		expected := &primitives{p: p}
+		assert.NoError(t, enc.WriteObject(expected))
+		assert.NoError(t, enc.Flush())
+
+		// The block data starts right after the class descriptor.
+		end := bytes.Index(buf.Bytes(), []byte{TcEndblockdata, TcNull})
+		if assert.NotEqual(t, -1, end, "size %d", tc.size) {
+			assert.Equal(t, tc.header, buf.Bytes()[end+2:end+2+len(tc.header)], "size %d", tc.size)
+		}
+
+		dec, err := NewDecoder(&buf)
+		assert.NoError(t, err)
+		dec.RegisterType("Primitives", reflect.TypeOf(primitives{}))
+		actual, err := dec.ReadObject()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, actual, "size %d", tc.size)
+	}
+}
+
+func TestEncoder_WriteDataOutput(t *testing.T) {
+	var buf bytes.Buffer
+	enc, err := NewEncoder(&buf)
+	assert.NoError(t, err)
+	assert.NoError(t, enc.WriteChar('é'))
+	assert.NoError(t, enc.WriteUTF("a\x00é😀"))
+	assert.NoError(t, enc.WriteBytes("aé"))
+	assert.NoError(t, enc.WriteChars("a😀"))
+	assert.Error(t, enc.WriteUTF(strings.Repeat("é", 1<<15)))
+	assert.NoError(t, enc.Flush())
+	assert.Equal(t, []byte{
+		0xac, 0xed, 0x00, 0x05, TcBlockdata, 0x17,
+		0x00, 0xe9,
+		0x00, 0x0b, 0x61, 0xc0, 0x80, 0xc3, 0xa9, 0xed, 0xa0, 0xbd, 0xed, 0xb8, 0x80,
+		0x61, 0xe9,
+		0x00, 0x61, 0xd8, 0x3d, 0xde, 0x00,
+	}, buf.Bytes())
+}
+
+func TestEncoder_WriteDataOutputRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	enc, err := NewEncoder(&buf)
+	assert.NoError(err)
+	assert.NoError(enc.WriteInt(1))
+	assert.NoError(enc.WriteObject(&String{Value: "a"}))
+	assert.NoError(enc.WriteInt(2))
+	assert.NoError(enc.Flush())
+	// As written by ObjectOutputStream.writeInt(1), writeObject("a") and
+	// writeInt(2).
+	assert.Equal([]byte{
+		0xac, 0xed, 0x00, 0x05,
+		TcBlockdata, 0x04, 0x00, 0x00, 0x00, 0x01,
+		TcString, 0x00, 0x01, 'a',
+		TcBlockdata, 0x04, 0x00, 0x00, 0x00, 0x02,
+	}, buf.Bytes())
+
+	dec, err := NewDecoder(&buf)
+	assert.NoError(err)
+	i, err := dec.ReadInt()
+	assert.NoError(err)
+	assert.Equal(int32(1), i)
+	object, err := dec.ReadObject()
+	assert.NoError(err)
+	assert.Equal(&String{Value: "a"}, object)
+	i, err = dec.ReadInt()
+	assert.NoError(err)
+	assert.Equal(int32(2), i)
+}
+
+type plainList struct {
+	Value int32
+}
+
+func (plainList) ClassName() string {
+	return "List"
+}
+
+func (plainList) SerialVersionUID() int64 {
+	return 1
+}
+
+type annotatedList struct {
+	Value int32
+}
+
+func (annotatedList) ClassName() string {
+	return "List"
+}
+
+func (annotatedList) SerialVersionUID() int64 {
+	return 1
+}
+
+func (annotatedList) AnnotateClass(enc *Encoder) error {
+	if err := enc.WriteByte(0x2a); err != nil {
+		return err
+	}
+	return enc.WriteObject(&String{Value: "foo"})
+}
+
+func TestEncoder_AnnotateClass(t *testing.T) {
+	classDesc := []byte{
+		0xac, 0xed, 0x00, 0x05, TcObject, TcClassdesc, 0x00, 0x04, 'L', 'i', 's', 't',
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, ScSerializable,
+		0x00, 0x01, 'I', 0x00, 0x05, 'v', 'a', 'l', 'u', 'e',
+	}
+	for _, tc := range []struct {
+		name       string
+		object     interface{}
+		hook       func(enc *Encoder, className string) error
+		annotation []byte
+	}{
+		{
+			name:       "AnnotateClass",
+			object:     &annotatedList{Value: 17},
+			annotation: []byte{TcBlockdata, 0x01, 0x2a, TcString, 0x00, 0x03, 'f', 'o', 'o'},
+		},
+		{
+			name:   "SetAnnotateClass",
+			object: &plainList{Value: 17},
+			// Like MarshalOutputStream without a codebase.
+			hook: func(enc *Encoder, className string) error {
+				if className != "List" {
+					return fmt.Errorf("unexpected class %s", className)
+				}
+				return enc.WriteObject(nil)
+			},
+			annotation: []byte{TcNull},
+		},
+		{
+			name:   "AnnotateClass overrides SetAnnotateClass",
+			object: &annotatedList{Value: 17},
+			hook: func(enc *Encoder, className string) error {
+				return errors.New("not called")
+			},
+			annotation: []byte{TcBlockdata, 0x01, 0x2a, TcString, 0x00, 0x03, 'f', 'o', 'o'},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			enc, err := NewEncoder(&buf)
+			assert.NoError(t, err)
+			enc.SetAnnotateClass(tc.hook)
+			assert.NoError(t, enc.WriteObject(tc.object))
+			assert.NoError(t, enc.Flush())
+			expected := append(append([]byte{}, classDesc...), tc.annotation...)
+			expected = append(expected, TcEndblockdata, TcNull, 0x00, 0x00, 0x00, 0x11)
+			assert.Equal(t, expected, buf.Bytes())
+		})
+	}
+}
+
+// duration is written as a durationSer, like java.time.Duration.
+type duration struct {
+	seconds int64
+}
+
+func (d *duration) WriteReplace() interface{} {
+	if d.seconds < 0 {
+		return nil
+	}
+	return &durationSer{Seconds: d.seconds}
+}
+
+type durationSer struct {
+	Seconds int64
+}
+
+func (durationSer) ClassName() string {
+	return "Ser"
+}
+
+func (durationSer) SerialVersionUID() int64 {
+	return 1
+}
+
+func (s *durationSer) ReadResolve() (interface{}, error) {
+	return &duration{seconds: s.Seconds}, nil
+}
+
+func TestEncoder_WriteReplace(t *testing.T) {
+	var buf bytes.Buffer
+	enc, err := NewEncoder(&buf)
+	assert.NoError(t, err)
+	d := &duration{seconds: 42}
+	assert.NoError(t, enc.WriteObject(d))
+	assert.NoError(t, enc.WriteObject(d))
+	assert.NoError(t, enc.WriteObject(&duration{seconds: -1}))
+	assert.NoError(t, enc.Flush())
+	assert.Equal(t, []byte{
+		0xac, 0xed, 0x00, 0x05, TcObject, TcClassdesc, 0x00, 0x03, 'S', 'e', 'r',
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, ScSerializable,
+		0x00, 0x01, 'J', 0x00, 0x07, 's', 'e', 'c', 'o', 'n', 'd', 's', TcEndblockdata, TcNull,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x2a,
+		TcReference, 0x00, 0x7e, 0x00, 0x01,
+		TcNull,
+	}, buf.Bytes())
+}
+
+func TestEncoder_SetReplaceObject(t *testing.T) {
+	var buf bytes.Buffer
+	enc, err := NewEncoder(&buf)
+	assert.NoError(t, err)
+	enc.SetReplaceObject(func(object interface{}) (interface{}, error) {
+		if s, ok := object.(*String); ok {
+			return &String{Value: strings.ToUpper(s.Value)}, nil
+		}
+		return object, nil
+	})
+	assert.NoError(t, enc.WriteObject(&listOfString{Value: 1, Next: &String{Value: "foo"}}))
+	assert.NoError(t, enc.Flush())
+	assert.Contains(t, buf.String(), "FOO")
+	assert.NotContains(t, buf.String(), "foo")
+
+	enc, err = NewEncoder(&bytes.Buffer{})
+	assert.NoError(t, err)
+	enc.SetReplaceObject(func(object interface{}) (interface{}, error) {
+		return nil, errors.New("replaceObject failed")
+	})
+	assert.EqualError(t, enc.WriteObject(&List{}), "replaceObject failed")
+}
+
+func TestEncoder_WriteUnshared(t *testing.T) {
+	var buf bytes.Buffer
+	enc, err := NewEncoder(&buf)
+	assert.NoError(t, err)
+	list := &List{Value: 17}
+	assert.NoError(t, enc.WriteUnshared(list))
+	assert.NoError(t, enc.WriteObject(list))
+	assert.NoError(t, enc.WriteObject(list))
+	assert.NoError(t, enc.WriteObject(&String{Value: "a"}))
+	assert.NoError(t, enc.WriteUnshared(&String{Value: "a"}))
+	assert.NoError(t, enc.Flush())
+	assert.Equal(t, []byte{
+		0xac, 0xed, 0x00, 0x05, TcObject, TcClassdesc, 0x00, 0x04, 'L', 'i', 's', 't',
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, ScSerializable,
+		0x00, 0x02, 'I', 0x00, 0x05, 'v', 'a', 'l', 'u', 'e',
+		'L', 0x00, 0x04, 'n', 'e', 'x', 't', TcString, 0x00, 0x06, 'L', 'L', 'i', 's', 't', ';',
+		TcEndblockdata, TcNull, 0x00, 0x00, 0x00, 0x11, TcNull,
+		// The unshared object has handle 0x7e0002, which is never referred to.
+		TcObject, TcReference, 0x00, 0x7e, 0x00, 0x00, 0x00, 0x00, 0x00, 0x11, TcNull,
+		TcReference, 0x00, 0x7e, 0x00, 0x03,
+		TcString, 0x00, 0x01, 'a',
+		TcString, 0x00, 0x01, 'a',
+	}, buf.Bytes())
+}
+
+type point struct {
+	X, Y int32
+}
+
+func (point) ClassName() string {
+	return "Point"
+}
+
+func TestEncoder_SetIdentity(t *testing.T) {
+	encode := func(identity Identity, objects ...interface{}) []byte {
+		var buf bytes.Buffer
+		enc, err := NewEncoder(&buf)
+		assert.NoError(t, err)
+		enc.SetIdentity(identity)
+		for _, object := range objects {
+			assert.NoError(t, enc.WriteObject(object))
+		}
+		assert.NoError(t, enc.Flush())
+		return buf.Bytes()
+	}
+	header := []byte{0xac, 0xed, 0x00, 0x05}
+	ref := func(handle byte) []byte {
+		return []byte{TcReference, 0x00, 0x7e, 0x00, handle}
+	}
+	a := []byte{TcString, 0x00, 0x01, 'a'}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+
+	s := &String{Value: "a"}
+	objects := []interface{}{s, s, &String{Value: "a"}, "a"}
+	assert.Equal(t, join(header, a, ref(0), ref(0), ref(0)), encode(IdentityStrings, objects...))
+	assert.Equal(t, join(header, a, ref(0), a, a), encode(IdentityPointers, objects...))
+	assert.Equal(t, join(header, a, ref(0), ref(0), ref(0)), encode(IdentityValues, objects...))
+
+	p := encode(IdentityStrings, point{1, 2})
+	assert.Equal(t, join(p, ref(1)), encode(IdentityValues, point{1, 2}, point{1, 2}))
+	pt := &point{1, 2}
+	assert.Equal(t, join(p, ref(1)), encode(IdentityPointers, pt, pt))
+	assert.NotEqual(t, join(p, ref(1)), encode(IdentityValues, pt, &point{1, 2}))
+	assert.NotEqual(t, join(p, ref(1)), encode(IdentityStrings, point{1, 2}, point{1, 2}))
+
+	ints := []int32{1, 2}
+	array := encode(IdentityPointers, ints)
+	assert.Equal(t, join(array, ref(1)), encode(IdentityPointers, ints, ints))
+	assert.NotEqual(t, join(array, ref(1)), encode(IdentityPointers, ints, ints[:1]))
+}
+
+// EmbeddedA is A with its superclass embedded.
+type EmbeddedA struct {
+	B
+
+	IntValue    int32
+	LongValue   int64
+	StringValue *String
+}
+
+func (EmbeddedA) ClassName() string {
+	return "A"
+}
+
+func (EmbeddedA) SerialVersionUID() int64 {
+	return 1
+}
+
+// TaggedA is A with a pointer to its superclass tagged as such.
+type TaggedA struct {
+	Base *B `javaio:",super"`
+
+	IntValue    int32
+	LongValue   int64
+	StringValue *String
+}
+
+func (TaggedA) ClassName() string {
+	return "A"
+}
+
+func (TaggedA) SerialVersionUID() int64 {
+	return 1
+}
+
+// unnamedA has no ClassName of its own, only the one promoted from B.
+type unnamedA struct {
+	B
+}
+
+func TestEncoder_EmbeddedSuper(t *testing.T) {
+	encode := func(object interface{}) ([]byte, error) {
+		var buf bytes.Buffer
+		enc, err := NewEncoder(&buf)
+		assert.NoError(t, err)
+		err = enc.WriteObject(object)
+		assert.NoError(t, enc.Flush())
+		return buf.Bytes(), err
+	}
+	a := &A{IntValue: 42, LongValue: -42, StringValue: &String{Value: "foo"}}
+	a.super.SerializableValue = &Serializable{Value: &String{Value: "bar"}}
+	want, err := encode(a)
+	assert.NoError(t, err)
+
+	embedded := &EmbeddedA{IntValue: 42, LongValue: -42, StringValue: &String{Value: "foo"}}
+	embedded.SerializableValue = &Serializable{Value: &String{Value: "bar"}}
+	p, err := encode(embedded)
+	assert.NoError(t, err)
+	assert.Equal(t, want, p)
+
+	tagged := &TaggedA{IntValue: 42, LongValue: -42, StringValue: &String{Value: "foo"}}
+	tagged.Base = &B{SerializableValue: &Serializable{Value: &String{Value: "bar"}}}
+	p, err = encode(tagged)
+	assert.NoError(t, err)
+	assert.Equal(t, want, p)
+
+	_, err = encode(&unnamedA{})
+	assert.EqualError(t, err, "javaio: B: unsupported type *javaio.unnamedA: same class name as its superclass B (offset 5)")
+}
+
+// CustomParent has its own serialVersionUID, writeObject and readObject.
+type CustomParent struct {
+	P int32
+}
+
+func (CustomParent) ClassName() string {
+	return "Parent"
+}
+
+func (CustomParent) SerialVersionUID() int64 {
+	return 7
+}
+
+func (p *CustomParent) WriteObject(enc *Encoder) error {
+	return enc.WriteInt(p.P)
+}
+
+func (p *CustomParent) ReadObject(dec *Decoder) (err error) {
+	p.P, err = dec.ReadInt()
+	return err
+}
+
+func (p *CustomParent) AnnotateClass(enc *Encoder) error {
+	return enc.WriteByte(0x2a)
+}
+
+func (p *CustomParent) WriteReplace() interface{} {
+	return p
+}
+
+func (p *CustomParent) ReadResolve() (interface{}, error) {
+	return p, nil
+}
+
+// CustomChild has none of the methods of its parent, which must not be
+// taken for its own.
+type CustomChild struct {
+	CustomParent
+
+	C int32
+}
+
+func (CustomChild) ClassName() string {
+	return "Child"
+}
+
+// hiddenChild embeds its superclass unexported.
+type hiddenChild struct {
+	hiddenParent
+
+	C int32
+}
+
+type hiddenParent struct {
+	P int32
+}
+
+func (hiddenParent) ClassName() string {
+	return "Parent"
+}
+
+func (hiddenChild) ClassName() string {
+	return "Child"
+}
+
+func TestEncoder_EmbeddedSuperMethods(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	enc, err := NewEncoder(&buf)
+	assert.NoError(err)
+	object := &CustomChild{CustomParent: CustomParent{P: 1}, C: 2}
+	assert.NoError(enc.WriteObject(object))
+	assert.NoError(enc.Flush())
+	assert.Equal(streamOf(
+		TcObject, TcClassdesc, []byte{0x00, 0x05}, "Child", []byte{0, 0, 0, 0, 0, 0, 0, 0}, ScSerializable,
+		[]byte{0x00, 0x01, 'I', 0x00, 0x01}, "c", TcEndblockdata,
+		TcClassdesc, []byte{0x00, 0x06}, "Parent", []byte{0, 0, 0, 0, 0, 0, 0, 7}, ScSerializable|ScWriteMethod,
+		[]byte{0x00, 0x01, 'I', 0x00, 0x01}, "p", []byte{TcBlockdata, 0x01, 0x2a}, TcEndblockdata, TcNull,
+		[]byte{TcBlockdata, 0x04, 0x00, 0x00, 0x00, 0x01}, TcEndblockdata,
+		[]byte{0x00, 0x00, 0x00, 0x02},
+	), buf.Bytes())
+
+	dec, err := NewDecoder(bytes.NewReader(buf.Bytes()))
+	assert.NoError(err)
+	dec.RegisterType("Child", reflect.TypeOf(CustomChild{}))
+	v, err := dec.ReadObject()
+	if assert.NoError(err) {
+		assert.Equal(object, v)
+	}
+
+	enc, err = NewEncoder(&bytes.Buffer{})
+	assert.NoError(err)
+	err = enc.WriteObject(&hiddenChild{C: 2})
+	assert.EqualError(err, "javaio: Child: unsupported type javaio.hiddenChild: unexported embedded superclass hiddenParent (offset 22)")
+
+	dec, err = NewDecoder(bytes.NewReader(buf.Bytes()))
+	assert.NoError(err)
+	dec.RegisterType("Child", reflect.TypeOf(hiddenChild{}))
+	_, err = dec.ReadObject()
+	var typeErr *UnsupportedTypeError
+	assert.True(errors.As(err, &typeErr), "%v", err)
+}
+
+// Shape is a superclass that does not implement Serializable.
+type Shape struct {
+	Sides int32
+}
+
+func (*Shape) NonSerializable() {}
+
+func (s *Shape) Construct() {
+	s.Sides = -1
+}
+
+type Circle struct {
+	Shape
+
+	Radius float64
+}
+
+func (Circle) ClassName() string {
+	return "Circle"
+}
+
+func (Circle) SerialVersionUID() int64 {
+	return 1
+}
+
+// nilSuper returns a nil pointer to its superclass part.
+type nilSuper struct {
+	super interface{}
+}
+
+func (nilSuper) ClassName() string {
+	return "NilSuper"
+}
+
+func (s nilSuper) Super() interface{} {
+	return s.super
+}
+
+// ptrClassName declares ClassName on its pointer, so that a nil pointer
+// still has a class name.
+type ptrClassName struct {
+	Value int32
+}
+
+func (*ptrClassName) ClassName() string {
+	return "Super"
+}
+
+func TestEncoder_NilSuper(t *testing.T) {
+	for _, super := range []interface{}{(*B)(nil), (*ptrClassName)(nil)} {
+		enc, err := NewEncoder(&bytes.Buffer{})
+		assert.NoError(t, err)
+		err = enc.WriteObject(&nilSuper{super: super})
+		var mismatchErr *TypeMismatchError
+		if assert.True(t, errors.As(err, &mismatchErr), "%v", err) {
+			assert.Equal(t, fmt.Sprintf("%T", super), mismatchErr.Value)
+			assert.Equal(t, "struct", mismatchErr.Type)
+		}
+	}
+
+	// A nil interface means that there is no serializable superclass.
+	enc, err := NewEncoder(&bytes.Buffer{})
+	assert.NoError(t, err)
+	assert.NoError(t, enc.WriteObject(&nilSuper{}))
+}
+
+func TestEncoder_NonSerializableSuper(t *testing.T) {
+	var buf bytes.Buffer
+	enc, err := NewEncoder(&buf)
+	assert.NoError(t, err)
+	assert.NoError(t, enc.WriteObject(Circle{Shape: Shape{Sides: 1}, Radius: 2}))
+	assert.NoError(t, enc.Flush())
+	assert.Equal(t, []byte{
+		0xac, 0xed, 0x00, 0x05, TcObject, TcClassdesc, 0x00, 0x06, 'C', 'i', 'r', 'c', 'l', 'e',
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, ScSerializable,
+		0x00, 0x01, 'D', 0x00, 0x06, 'r', 'a', 'd', 'i', 'u', 's', TcEndblockdata, TcNull,
+		0x40, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}, buf.Bytes())
+}
+
+type integers struct {
+	Int     int
+	Uint    uint
+	Uintptr uintptr
+	Int8    int8
+	Uint16  uint16
+	Uint32  uint32
+	Uint64  uint64
+	Narrow  int `javaio:",type=I"`
+}
+
+func (integers) ClassName() string {
+	return "Integers"
+}
+
+func TestEncoder_WriteObjectIntegers(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	enc, err := NewEncoder(&buf)
+	assert.NoError(err)
+	object := &integers{Int: -1, Uint: 2, Uintptr: 3, Int8: -4, Uint16: 5, Uint32: 6, Uint64: 7, Narrow: -8}
+	assert.NoError(enc.WriteObject(object))
+	assert.NoError(enc.Flush())
+	p := buf.Bytes()
+	// int, uint and uintptr are written as long by default.
+	assert.Contains(string(p), "J\x00\x03intB\x00\x04int8I\x00\x06narrowJ\x00\x04uintS\x00\x06uint16I\x00\x06uint32J\x00\x06uint64J\x00\x07uintptr")
+	assert.Equal([]byte{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xfc,
+		0xff, 0xff, 0xff, 0xf8,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02,
+		0x00, 0x05,
+		0x00, 0x00, 0x00, 0x06,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x07,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03,
+	}, p[len(p)-43:])
+
+	dec, err := NewDecoder(&buf)
+	assert.NoError(err)
+	dec.RegisterType("Integers", reflect.TypeOf(integers{}))
+	v, err := dec.ReadObject()
+	if assert.NoError(err) {
+		assert.Equal(object, v)
+	}
+}
+
+type wideIntegers struct {
+	Int     int
+	Uint    uint
+	Uintptr uintptr
+}
+
+func (wideIntegers) ClassName() string {
+	return "Integers"
+}
+
+type narrowedIntegers struct {
+	Int     int     `javaio:"int,type=I"`
+	Uint    uint    `javaio:"uint,type=S"`
+	Uintptr uintptr `javaio:"uintptr,type=B"`
+}
+
+func (narrowedIntegers) ClassName() string {
+	return "Integers"
+}
+
+func TestEncoder_WriteObjectIntElements(t *testing.T) {
+	assert := assert.New(t)
+	// Without a field to tag, an int is always a long.
+	longArraySUID := uint64(0x782004b512b17593)
+	array := MustNewArray([]int{1})
+	assert.Equal("[J", array.ClassName())
+	assert.Equal(int64(longArraySUID), array.SerialVersionUID())
+
+	var buf bytes.Buffer
+	enc, err := NewEncoder(&buf)
+	assert.NoError(err)
+	assert.NoError(enc.WriteObject([]int{1}))
+	assert.NoError(enc.WriteObject(int(2)))
+	assert.NoError(enc.Flush())
+	assert.Equal(streamOf(
+		TcArray, TcClassdesc, []byte{0x00, 0x02}, "[J", []byte{0x78, 0x20, 0x04, 0xb5, 0x12, 0xb1, 0x75, 0x93},
+		ScSerializable, []byte{0x00, 0x00}, TcEndblockdata, TcNull,
+		[]byte{0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01},
+		[]byte{TcBlockdata, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02},
+	), buf.Bytes())
+}
+
+func TestEncoder_WriteObjectIntMapping(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		object interface{}
+		fields string
+		data   []byte
+	}{
+		{
+			"Default",
+			&wideIntegers{Int: -2, Uint: 3, Uintptr: 4},
+			"J\x00\x03intJ\x00\x04uintJ\x00\x07uintptr",
+			[]byte{
+				0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe,
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03,
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04,
+			},
+		},
+		{
+			"TypeOption",
+			&narrowedIntegers{Int: -2, Uint: 3, Uintptr: 4},
+			"I\x00\x03intS\x00\x04uintB\x00\x07uintptr",
+			[]byte{0xff, 0xff, 0xff, 0xfe, 0x00, 0x03, 0x04},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			enc, err := NewEncoder(&buf)
+			assert.NoError(t, err)
+			assert.NoError(t, enc.WriteObject(tc.object))
+			assert.NoError(t, enc.Flush())
+			p := buf.Bytes()
+			assert.Contains(t, string(p), tc.fields)
+			assert.Equal(t, tc.data, p[len(p)-len(tc.data):])
+
+			dec, err := NewDecoder(&buf)
+			assert.NoError(t, err)
+			dec.RegisterType("Integers", reflect.TypeOf(narrowedIntegers{}))
+			v, err := dec.ReadObject()
+			if assert.NoError(t, err) {
+				assert.Equal(t, &narrowedIntegers{Int: -2, Uint: 3, Uintptr: 4}, v)
+			}
+		})
+	}
+}
+
+type floatIntegers struct {
+	Int  float64 `javaio:"i,type=I"`
+	Char float32 `javaio:"c,type=C"`
+	Long float64 `javaio:"j,type=J"`
+}
+
+func (floatIntegers) ClassName() string {
+	return "FloatIntegers"
+}
+
+func TestEncoder_WriteObjectFloatIntegers(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	enc, err := NewEncoder(&buf)
+	assert.NoError(err)
+	assert.NoError(enc.WriteObject(&floatIntegers{Int: -1 << 31, Char: 65535.5, Long: -1.5}))
+	assert.NoError(enc.Flush())
+	p := buf.Bytes()
+	// Like a narrowing conversion in Java, the fraction is dropped.
+	assert.Equal([]byte{
+		0xff, 0xff,
+		0x80, 0x00, 0x00, 0x00,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+	}, p[len(p)-14:])
+}
+
+func TestEncoder_WriteObjectIntegerOverflow(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		object      interface{}
+		path, value string
+		typ         string
+		reinterpret bool // whether SetReinterpretUnsigned makes it fit
+	}{
+		{"Uint16", &integers{Uint16: 0x8000}, "Integers.uint16", "uint16 32768", "short", true},
+		{"Uint32", &integers{Uint32: 0xffffffff}, "Integers.uint32", "uint32 4294967295", "int", true},
+		{"Uint64", &integers{Uint64: 1 << 63}, "Integers.uint64", "uint64 9223372036854775808", "long", true},
+		{"Narrow", &integers{Narrow: 1 << 31}, "Integers.narrow", "int 2147483648", "int", false},
+		{"TopLevel", uint32(1 << 31), "", "uint32 2147483648", "int", true},
+		{"FloatInt", &floatIntegers{Int: 1 << 31}, "FloatIntegers.i", "float64 2.147483648e+09", "int", false},
+		{"FloatChar", &floatIntegers{Char: -1}, "FloatIntegers.c", "float32 -1", "char", false},
+		{"FloatLong", &floatIntegers{Long: 1 << 63}, "FloatIntegers.j", "float64 9.223372036854776e+18", "long", false},
+		{"NaN", &floatIntegers{Long: math.NaN()}, "FloatIntegers.j", "float64 NaN", "long", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			enc, err := NewEncoder(&bytes.Buffer{})
+			assert.NoError(t, err)
+			err = enc.WriteObject(tc.object)
+			var typeErr *TypeMismatchError
+			if assert.True(t, errors.As(err, &typeErr), "%v", err) {
+				assert.Equal(t, tc.path, typeErr.Path)
+				assert.Equal(t, tc.value, typeErr.Value)
+				assert.Equal(t, tc.typ, typeErr.Type)
+			}
+
+			enc, err = NewEncoder(&bytes.Buffer{})
+			assert.NoError(t, err)
+			enc.SetReinterpretUnsigned(true)
+			err = enc.WriteObject(tc.object)
+			if tc.reinterpret {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package javaio
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// A SyntaxError describes malformed serialization data.
+type SyntaxError struct {
+	Offset   int64  // offset of the byte where the error was detected
+	TypeCode byte   // type code being processed, if any
+	Msg      string // description of the error
+}
+
+func (e *SyntaxError) Error() string {
+	if e.TypeCode != 0 {
+		return fmt.Sprintf("javaio: %s (type code %02X at offset %d)", e.Msg, e.TypeCode, e.Offset)
+	}
+	return fmt.Sprintf("javaio: %s (offset %d)", e.Msg, e.Offset)
+}
+
+// A TypeMismatchError describes a value that does not fit the Go or Java
+// type it is read into or written as.
+//
+// Path locates the value in the object graph, starting with the simple
+// class name of the top-level object, e.g. "Package.elements[3].id".
+// Field names are the Java field names; an index is either an array index
+// or the position of an object within data written by a custom writeObject.
+type TypeMismatchError struct {
+	Offset int64
+	Path   string
+	Value  string // type of the value, e.g. "int32" or "*javaio.String"
+	Type   string // type the value was expected to have
+}
+
+func (e *TypeMismatchError) Error() string {
+	return fmt.Sprintf("javaio: %s: cannot use %s as %s (offset %d)", e.location(), e.Value, e.Type, e.Offset)
+}
+
+func (e *TypeMismatchError) location() string {
+	if e.Path == "" {
+		return "<root>"
+	}
+	return e.Path
+}
+
+// A WriteAbortedError is returned by a Decoder that reads the exception
+// ObjectOutputStream writes in place of an object it fails to write, like
+// WriteAbortedException. Detail is the exception, or nil if its class is not
+// registered.
+type WriteAbortedError struct {
+	Offset int64
+	Detail interface{}
+}
+
+func (e *WriteAbortedError) Error() string {
+	return fmt.Sprintf("javaio: writing aborted (offset %d)", e.Offset)
+}
+
+// An UnregisteredClassError is returned by a Decoder that encounters a class
+// for which no Go type has been registered with RegisterType.
+type UnregisteredClassError struct {
+	Offset    int64
+	Path      string
+	ClassName string
+}
+
+func (e *UnregisteredClassError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("javaio: class %q not registered (offset %d)", e.ClassName, e.Offset)
+	}
+	return fmt.Sprintf("javaio: %s: class %q not registered (offset %d)", e.Path, e.ClassName, e.Offset)
+}
+
+// An UnsupportedTypeError is returned by an Encoder when attempting to
+// encode a value of a Go type that cannot be mapped to a Java type.
+type UnsupportedTypeError struct {
+	Offset int64
+	Path   string
+	Type   reflect.Type
+	Msg    string
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("javaio: unsupported type %s: %s (offset %d)", e.Type, e.Msg, e.Offset)
+	}
+	return fmt.Sprintf("javaio: %s: unsupported type %s: %s (offset %d)", e.Path, e.Type, e.Msg, e.Offset)
+}
+
+// objectPath tracks the location of the value being processed within the
+// object graph.
+type objectPath []string
+
+func (path *objectPath) push(segment string) {
+	*path = append(*path, segment)
+}
+
+func (path *objectPath) pushField(name string) {
+	path.push("." + name)
+}
+
+func (path *objectPath) pushIndex(i int) {
+	path.push(fmt.Sprintf("[%d]", i))
+}
+
+func (path *objectPath) pop() {
+	*path = (*path)[:len(*path)-1]
+}
+
+func (path objectPath) String() string {
+	return strings.Join(path, "")
+}
+
+// simpleClassName returns the class name without its package, as used for
+// the first segment of an object path.
+func simpleClassName(name string) string {
+	if strings.HasPrefix(name, "[") {
+		return name
+	}
+	return name[strings.LastIndexAny(name, ".$")+1:]
+}
+
+// countingReader counts the bytes consumed from a buffered reader. Readers
+// that do not implement io.ByteReader are wrapped in a bufio.Reader.
+type countingReader struct {
+	r      io.Reader
+	br     io.ByteReader
+	n      int64
+	peeked bool // whether next holds the next byte
+	next   byte
+}
+
+func newCountingReader(r io.Reader) *countingReader {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		b := bufio.NewReader(r)
+		r, br = b, b
+	}
+	return &countingReader{r: r, br: br}
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	if r.peeked && len(p) > 0 {
+		p[0] = r.next
+		r.peeked = false
+		r.n++
+		return 1, nil
+	}
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *countingReader) ReadByte() (byte, error) {
+	if r.peeked {
+		r.peeked = false
+		r.n++
+		return r.next, nil
+	}
+	c, err := r.br.ReadByte()
+	if err == nil {
+		r.n++
+	}
+	return c, err
+}
+
+// PeekByte returns the next byte without consuming it.
+func (r *countingReader) PeekByte() (byte, error) {
+	if !r.peeked {
+		c, err := r.br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		r.next, r.peeked = c, true
+	}
+	return r.next, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
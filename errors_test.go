@@ -0,0 +1,106 @@
+package javaio
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyntaxError(t *testing.T) {
+	dec, err := NewDecoder(bytes.NewReader([]byte{0xac, 0xed, 0x00, 0x05, 0x73, 0x7f}))
+	assert.NoError(t, err)
+	_, err = dec.ReadObject()
+	var syntaxErr *SyntaxError
+	if assert.True(t, errors.As(err, &syntaxErr)) {
+		assert.Equal(t, int64(5), syntaxErr.Offset)
+		assert.Equal(t, byte(0x7f), syntaxErr.TypeCode)
+	}
+
+	_, err = NewDecoder(bytes.NewReader([]byte{0xac, 0xed, 0x00, 0x04}))
+	if assert.True(t, errors.As(err, &syntaxErr)) {
+		assert.Equal(t, int64(2), syntaxErr.Offset)
+	}
+}
+
+func TestUnregisteredClassError(t *testing.T) {
+	dec, err := NewDecoder(bytes.NewReader([]byte{
+		0xac, 0xed, 0x00, 0x05, 0x73, 0x72, 0x00, 0x04, 0x4c, 0x69, 0x73, 0x74, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x01, 0x02, 0x00, 0x00, 0x78, 0x70,
+	}))
+	assert.NoError(t, err)
+	_, err = dec.ReadObject()
+	var unregisteredErr *UnregisteredClassError
+	if assert.True(t, errors.As(err, &unregisteredErr)) {
+		assert.Equal(t, "List", unregisteredErr.ClassName)
+		assert.Equal(t, int64(25), unregisteredErr.Offset)
+	}
+}
+
+type listOfString struct {
+	Value int32
+	Next  interface{}
+}
+
+func (*listOfString) ClassName() string {
+	return "List"
+}
+
+func (*listOfString) SerialVersionUID() int64 {
+	return 1
+}
+
+func TestTypeMismatchError_Decoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc, err := NewEncoder(&buf)
+	assert.NoError(t, err)
+	assert.NoError(t, enc.WriteObject(&listOfString{
+		Value: 1,
+		Next: &listOfString{
+			Value: 2,
+			Next:  &String{Value: "foo"},
+		},
+	}))
+	assert.NoError(t, enc.Flush())
+	offset := int64(bytes.LastIndex(buf.Bytes(), []byte{TcString, 0x00, 0x03}))
+
+	dec, err := NewDecoder(&buf)
+	assert.NoError(t, err)
+	dec.RegisterType("List", reflect.TypeOf(List{}))
+	_, err = dec.ReadObject()
+	var mismatchErr *TypeMismatchError
+	if assert.True(t, errors.As(err, &mismatchErr)) {
+		assert.Equal(t, "List.next.next", mismatchErr.Path)
+		assert.Equal(t, offset, mismatchErr.Offset)
+		assert.Equal(t, "*javaio.String", mismatchErr.Value)
+		assert.Equal(t, "*javaio.List", mismatchErr.Type)
+	}
+}
+
+type token string
+
+func (token) ClassName() string {
+	return "Token"
+}
+
+type tokenHolder struct {
+	Token token
+}
+
+func (tokenHolder) ClassName() string {
+	return "com.example.TokenHolder"
+}
+
+func TestTypeMismatchError_Encoder(t *testing.T) {
+	enc, err := NewEncoder(&bytes.Buffer{})
+	assert.NoError(t, err)
+	err = enc.WriteObject(&tokenHolder{Token: "foo"})
+	var mismatchErr *TypeMismatchError
+	if assert.True(t, errors.As(err, &mismatchErr)) {
+		assert.Equal(t, "TokenHolder.token", mismatchErr.Path)
+		assert.Equal(t, "javaio.token", mismatchErr.Value)
+		assert.Equal(t, "struct", mismatchErr.Type)
+	}
+}
@@ -0,0 +1,270 @@
+package javaio
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// structField describes how a struct field is serialized.
+type structField struct {
+	name  string
+	index int
+	typ   reflect.Type // field type with pointers removed
+	// typeCode and descriptor are zero if they depend on the field value,
+	// which is the case for interface and *Array fields.
+	typeCode   byte
+	descriptor string // for object and array fields
+	convert    bool   // whether typeCode is set by the type= tag option
+	err        error  // why the field cannot be serialized, if it cannot
+}
+
+// structInfo holds the serializable fields of a struct type.
+type structInfo struct {
+	fields []structField // in serialization order
+	byName map[string]int
+	super  int   // index of the embedded superclass struct, or -1
+	err    error // why the struct cannot be serialized, if it cannot
+}
+
+var structInfoCache sync.Map // map[reflect.Type]*structInfo
+
+// cachedStructInfo returns the serializable fields of the struct type t.
+func cachedStructInfo(t reflect.Type) *structInfo {
+	if info, ok := structInfoCache.Load(t); ok {
+		return info.(*structInfo)
+	}
+	info, _ := structInfoCache.LoadOrStore(t, newStructInfo(t))
+	return info.(*structInfo)
+}
+
+func newStructInfo(t reflect.Type) *structInfo {
+	info := &structInfo{
+		fields: make([]structField, 0, t.NumField()),
+		super:  -1,
+	}
+	for i := 0; i < t.NumField(); i++ {
+		tf := t.Field(i)
+		// Skip unexported fields, but not an unexported superclass, whose
+		// fields could not be read or set.
+		if tf.PkgPath != "" {
+			if tf.Anonymous && info.super < 0 && info.err == nil && isClass(tf.Type) {
+				info.err = &UnsupportedTypeError{
+					Type: t,
+					Msg:  "unexported embedded superclass " + tf.Name,
+				}
+			}
+			continue
+		}
+		tag := tf.Tag.Get("javaio")
+		if tag == "-" {
+			continue
+		}
+		name, opts := parseTag(tag)
+		if opts.has("transient") {
+			continue
+		}
+		if (tf.Anonymous || opts.has("super")) && info.super < 0 &&
+			unpackPointerType(tf.Type).Kind() == reflect.Struct {
+			// An embedded struct holds the fields of the superclass.
+			info.super = i
+			continue
+		}
+		if name == "" {
+			name = lowerCamelCase(tf.Name)
+		}
+		f := structField{
+			name:  name,
+			index: i,
+			typ:   unpackPointerType(tf.Type),
+		}
+		javaType, hasType := opts.value("type")
+		class, hasClass := opts.value("class")
+		switch {
+		case hasType:
+			f.convert = true
+			if len(javaType) == 1 {
+				f.typeCode = javaType[0]
+			}
+			if !isPrimitiveTypeCode(f.typeCode) || !isPrimitiveKind(f.typ.Kind()) {
+				f.err = &UnsupportedTypeError{
+					Type: tf.Type,
+					Msg:  fmt.Sprintf("cannot use type=%s for field %s", javaType, name),
+				}
+			}
+		case hasClass:
+			f.typeCode, f.descriptor = classDescriptor(class)
+			if isPrimitiveKind(f.typ.Kind()) {
+				f.err = &UnsupportedTypeError{
+					Type: tf.Type,
+					Msg:  fmt.Sprintf("cannot use class=%s for field %s", class, name),
+				}
+			}
+		case f.typ.Kind() != reflect.Interface && f.typ != arrayType:
+			f.typeCode, f.err = typeCode(f.typ)
+			if f.typeCode == 'L' || f.typeCode == '[' {
+				f.descriptor, f.err = fieldDescriptor(f.typ)
+			}
+		}
+		info.fields = append(info.fields, f)
+	}
+	sortFields(info.fields)
+	info.byName = make(map[string]int, len(info.fields))
+	for i, f := range info.fields {
+		info.byName[f.name] = i
+	}
+	return info
+}
+
+var arrayType = reflect.TypeOf(Array{})
+
+// lowerCamelCase returns the default Java name of a Go field.
+func lowerCamelCase(name string) string {
+	runes := []rune(name)
+	if len(runes) > 0 {
+		runes[0] = unicode.ToLower(runes[0])
+	}
+	return string(runes)
+}
+
+// tagOptions holds the options that follow the field name in a javaio
+// struct tag, e.g. "super" in `javaio:",super"`.
+type tagOptions string
+
+func parseTag(tag string) (string, tagOptions) {
+	if i := strings.Index(tag, ","); i >= 0 {
+		return tag[:i], tagOptions(tag[i+1:])
+	}
+	return tag, ""
+}
+
+func (opts tagOptions) has(name string) bool {
+	_, ok := opts.lookup(name)
+	return ok
+}
+
+// value returns the value of an option of the form name=value.
+func (opts tagOptions) value(name string) (string, bool) {
+	opt, ok := opts.lookup(name + "=")
+	return strings.TrimPrefix(opt, name+"="), ok
+}
+
+// lookup returns the option that is name, or starts with name if name
+// ends with '='.
+func (opts tagOptions) lookup(name string) (string, bool) {
+	for opts != "" {
+		var opt string
+		if i := strings.Index(string(opts), ","); i >= 0 {
+			opt, opts = string(opts[:i]), opts[i+1:]
+		} else {
+			opt, opts = string(opts), ""
+		}
+		if opt == name || strings.HasSuffix(name, "=") && strings.HasPrefix(opt, name) {
+			return opt, true
+		}
+	}
+	return "", false
+}
+
+func isPrimitiveTypeCode(code byte) bool {
+	return code != 0 && strings.IndexByte("BCDFIJSZ", code) >= 0
+}
+
+// classDescriptor returns the type code and field descriptor of a field
+// declared as the given class, e.g. "java.lang.Object" or
+// "[Ljava.lang.String;".
+func classDescriptor(class string) (byte, string) {
+	desc := strings.ReplaceAll(class, ".", "/")
+	if strings.HasPrefix(desc, "[") {
+		return '[', desc
+	}
+	return 'L', "L" + desc + ";"
+}
+
+// isClass reports whether typ, or a pointer to it, is a struct describing a
+// Java class, as opposed to a helper embedded for its methods.
+func isClass(typ reflect.Type) bool {
+	typ = unpackPointerType(typ)
+	if typ.Kind() != reflect.Struct {
+		return false
+	}
+	typ = reflect.PtrTo(typ)
+	_, ok := typ.MethodByName("ClassName")
+	return ok || typ.Implements(nonSerializableType)
+}
+
+// error returns a copy of info.err, like structField.error.
+func (info *structInfo) error() error {
+	if typeErr, ok := info.err.(*UnsupportedTypeError); ok {
+		e := *typeErr
+		return &e
+	}
+	return info.err
+}
+
+// superField returns the embedded superclass field of the struct that v
+// is or points to.
+func superField(v reflect.Value) (reflect.Value, bool) {
+	v = unpackPointer(v)
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}, false
+	}
+	info := cachedStructInfo(v.Type())
+	if info.super < 0 {
+		return reflect.Value{}, false
+	}
+	return v.Field(info.super), true
+}
+
+// error returns a copy of f.err, so that the location filled in by
+// Encoder.typeError does not leak into the cache.
+func (f *structField) error() error {
+	if typeErr, ok := f.err.(*UnsupportedTypeError); ok {
+		e := *typeErr
+		return &e
+	}
+	return f.err
+}
+
+// sortFields sorts fields the way ObjectStreamClass.getSerialFields does:
+// primitive fields first, then object fields, each ordered by name.
+// Fields whose type code depends on the value count as object fields.
+func sortFields(fields []structField) {
+	sort.SliceStable(fields, func(i, j int) bool {
+		pi, pj := isPrimitiveTypeCode(fields[i].typeCode), isPrimitiveTypeCode(fields[j].typeCode)
+		if pi != pj {
+			return pi
+		}
+		return javaLess(fields[i].name, fields[j].name)
+	})
+}
+
+// javaLess reports whether a sorts before b by String.compareTo, which
+// compares UTF-16 code units rather than code points.
+func javaLess(a, b string) bool {
+	for a != "" && b != "" {
+		ra, na := utf8.DecodeRuneInString(a)
+		rb, nb := utf8.DecodeRuneInString(b)
+		if ra != rb {
+			if ra >= 0x10000 && rb >= 0x10000 {
+				return ra < rb
+			}
+			ua, _ := utf16.EncodeRune(ra)
+			ub, _ := utf16.EncodeRune(rb)
+			if ra < 0x10000 {
+				ua = ra
+			}
+			if rb < 0x10000 {
+				ub = rb
+			}
+			return ua < ub
+		}
+		a, b = a[na:], b[nb:]
+	}
+	return b != ""
+}
@@ -0,0 +1,290 @@
+package javaio
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type renamedFields struct {
+	Zeta   int32 `javaio:"alpha"`
+	Beta   int32
+	Name   *String `javaio:"label"`
+	Hidden int32   `javaio:"-"`
+	hidden int32
+}
+
+func (renamedFields) ClassName() string {
+	return "RenamedFields"
+}
+
+func TestCachedStructInfo(t *testing.T) {
+	assert := assert.New(t)
+	typ := reflect.TypeOf(renamedFields{})
+	var wg sync.WaitGroup
+	infos := make([]*structInfo, 8)
+	for i := range infos {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			infos[i] = cachedStructInfo(typ)
+		}(i)
+	}
+	wg.Wait()
+	for _, info := range infos {
+		assert.True(info == infos[0])
+	}
+
+	info := infos[0]
+	var names []string
+	for _, f := range info.fields {
+		names = append(names, f.name)
+	}
+	assert.Equal([]string{"alpha", "beta", "label"}, names)
+	assert.Equal(2, info.byName["label"])
+	label := info.fields[info.byName["label"]]
+	assert.Equal(2, label.index)
+	assert.Equal(byte('L'), label.typeCode)
+	assert.Equal("Ljava/lang/String;", label.descriptor)
+}
+
+func TestCachedStructInfo_Error(t *testing.T) {
+	type holder struct {
+		Value complex128
+	}
+	info := cachedStructInfo(reflect.TypeOf(holder{}))
+	err := info.fields[0].error()
+	err.(*UnsupportedTypeError).Path = "somewhere"
+	assert.Equal(t, "", info.fields[0].err.(*UnsupportedTypeError).Path)
+}
+
+func TestSortFields(t *testing.T) {
+	var (
+		i32  = reflect.TypeOf(int32(0))
+		obj  = reflect.TypeOf((*interface{})(nil)).Elem()
+		str  = reflect.TypeOf(&String{})
+		arr  = reflect.TypeOf(&Array{})
+		ints = reflect.TypeOf([]int32(nil))
+	)
+	type field struct {
+		name string
+		typ  reflect.Type
+	}
+	// "f0" to "f39" in the order String.compareTo sorts them.
+	var many []field
+	var manyWant []string
+	for d := 0; d < 10; d++ {
+		manyWant = append(manyWant, fmt.Sprintf("f%d", d))
+		if d >= 1 && d <= 3 {
+			for e := 0; e < 10; e++ {
+				manyWant = append(manyWant, fmt.Sprintf("f%d%d", d, e))
+			}
+		}
+	}
+	for i := 39; i >= 0; i-- {
+		many = append(many, field{fmt.Sprintf("f%d", i), i32})
+	}
+
+	// The expected orders are those of ObjectStreamClass.getFields for a
+	// class declaring the same fields: primitives first, then objects, each
+	// by String.compareTo.
+	for _, c := range []struct {
+		name   string
+		fields []field
+		want   []string
+	}{
+		{"Empty", nil, nil},
+		{
+			"Case",
+			[]field{{"b", i32}, {"B", i32}, {"a", str}, {"A", str}, {"Z", i32}, {"z", obj}},
+			[]string{"B", "Z", "b", "A", "a", "z"},
+		},
+		{
+			"UnderscoreDollar",
+			[]field{{"ab", i32}, {"a_b", i32}, {"a$b", i32}, {"_", ints}, {"$", arr}, {"A", obj}},
+			[]string{"a$b", "a_b", "ab", "$", "A", "_"},
+		},
+		{
+			// U+10000 is written as the surrogates D800 DC00, which sort
+			// before U+FF41 but after U+00E9.
+			"Supplementary",
+			[]field{{"\uff41", i32}, {"\U00010000", i32}, {"\u00e9", i32}, {"\uff42", str}, {"\U00010400", str}, {"\u00ff", str}},
+			[]string{"\u00e9", "\U00010000", "\uff41", "\u00ff", "\U00010400", "\uff42"},
+		},
+		{"Many", many, manyWant},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var fields []reflect.StructField
+			for i, f := range c.fields {
+				fields = append(fields, reflect.StructField{
+					Name: fmt.Sprintf("F%d", i),
+					Type: f.typ,
+					Tag:  reflect.StructTag(`javaio:"` + f.name + `"`),
+				})
+			}
+			info := cachedStructInfo(reflect.StructOf(fields))
+			var names []string
+			for i, f := range info.fields {
+				names = append(names, f.name)
+				assert.Equal(t, i, info.byName[f.name])
+			}
+			assert.Equal(t, c.want, names)
+		})
+	}
+}
+
+func TestSortFields_TypeOption(t *testing.T) {
+	type holder struct {
+		A *String
+		B int32   `javaio:",type=C"`
+		C *String `javaio:",class=java.lang.Object"`
+		D uint16
+	}
+	info := cachedStructInfo(reflect.TypeOf(holder{}))
+	var names []string
+	for _, f := range info.fields {
+		names = append(names, f.name)
+	}
+	assert.Equal(t, []string{"b", "d", "a", "c"}, names)
+}
+
+func TestJavaLess(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		less bool
+	}{
+		{"", "", false},
+		{"", "a", true},
+		{"a", "", false},
+		{"a", "ab", true},
+		{"B", "a", true},
+		{"a_b", "ab", true},
+		{"$", "a", true},
+		// U+FFFF is a single code unit greater than the high surrogate that
+		// starts U+10000, so Java orders it after.
+		{"\U00010000", "\uffff", true},
+		{"\uffff", "\U00010000", false},
+		{"\U00010000", "\U00010001", true},
+	} {
+		assert.Equal(t, c.less, javaLess(c.a, c.b), "%q < %q", c.a, c.b)
+	}
+}
+
+func TestEncoder_WriteObjectRenamedFields(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	enc, err := NewEncoder(&buf)
+	assert.NoError(err)
+	assert.NoError(enc.WriteObject(&renamedFields{Zeta: 1, Beta: 2, Name: &String{Value: "x"}, Hidden: 3}))
+	assert.NoError(enc.Flush())
+
+	dec, err := NewDecoder(&buf)
+	assert.NoError(err)
+	dec.RegisterType("RenamedFields", reflect.TypeOf(renamedFields{}))
+	dec.RegisterType("java.lang.String", reflect.TypeOf(String{}))
+	v, err := dec.ReadObject()
+	if assert.NoError(err) {
+		assert.Equal(&renamedFields{Zeta: 1, Beta: 2, Name: &String{Value: "x"}}, v)
+	}
+}
+
+type taggedFields struct {
+	Count int         `javaio:"count,type=J"`
+	Flag  uint8       `javaio:",type=Z"`
+	Value interface{} `javaio:",class=java.lang.Number"`
+	Names interface{} `javaio:",class=[Ljava.lang.String;"`
+	Cache int32       `javaio:",transient"`
+}
+
+func (taggedFields) ClassName() string {
+	return "Tagged"
+}
+
+func TestEncoder_WriteObjectTagOptions(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	enc, err := NewEncoder(&buf)
+	assert.NoError(err)
+	assert.NoError(enc.WriteObject(&taggedFields{Count: 7, Flag: 2, Cache: 5}))
+	assert.NoError(enc.Flush())
+	assert.Equal([]byte{
+		0xac, 0xed, 0x00, 0x05, TcObject, TcClassdesc, 0x00, 0x06, 'T', 'a', 'g', 'g', 'e', 'd',
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, ScSerializable, 0x00, 0x04,
+		'J', 0x00, 0x05, 'c', 'o', 'u', 'n', 't',
+		'Z', 0x00, 0x04, 'f', 'l', 'a', 'g',
+		'[', 0x00, 0x05, 'n', 'a', 'm', 'e', 's',
+		TcString, 0x00, 0x13, '[', 'L', 'j', 'a', 'v', 'a', '/', 'l', 'a', 'n', 'g', '/', 'S', 't', 'r', 'i', 'n', 'g', ';',
+		'L', 0x00, 0x05, 'v', 'a', 'l', 'u', 'e',
+		TcString, 0x00, 0x12, 'L', 'j', 'a', 'v', 'a', '/', 'l', 'a', 'n', 'g', '/', 'N', 'u', 'm', 'b', 'e', 'r', ';',
+		TcEndblockdata, TcNull,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x07, 0x01, TcNull, TcNull,
+	}, buf.Bytes())
+
+	dec, err := NewDecoder(&buf)
+	assert.NoError(err)
+	dec.RegisterType("Tagged", reflect.TypeOf(taggedFields{}))
+	v, err := dec.ReadObject()
+	if assert.NoError(err) {
+		assert.Equal(&taggedFields{Count: 7, Flag: 1}, v)
+	}
+
+	type invalid struct {
+		Name *String `javaio:",type=I"`
+	}
+	err = cachedStructInfo(reflect.TypeOf(invalid{})).fields[0].err
+	assert.EqualError(err, "javaio: unsupported type *javaio.String: cannot use type=I for field name (offset 0)")
+
+	type invalidClass struct {
+		Count int32 `javaio:",class=java.lang.Integer"`
+	}
+	err = cachedStructInfo(reflect.TypeOf(invalidClass{})).fields[0].err
+	assert.EqualError(err, "javaio: unsupported type int32: cannot use class=java.lang.Integer for field count (offset 0)")
+}
+
+// reorderedFields sorts differently by Java name than by Go name.
+type reorderedFields struct {
+	First  int32   `javaio:"z"`
+	Second int32   `javaio:"a"`
+	Third  *String `javaio:"b"`
+	Fourth *String `javaio:"A"`
+}
+
+func (reorderedFields) ClassName() string {
+	return "R"
+}
+
+func TestEncoder_WriteObjectReorderedFields(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	enc, err := NewEncoder(&buf)
+	assert.NoError(err)
+	object := &reorderedFields{First: 1, Second: 2, Third: &String{Value: "3"}, Fourth: &String{Value: "4"}}
+	assert.NoError(enc.WriteObject(object))
+	assert.NoError(enc.Flush())
+	// The class data is in the order of the descriptor.
+	assert.Equal([]byte{
+		0xac, 0xed, 0x00, 0x05, TcObject, TcClassdesc, 0x00, 0x01, 'R',
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, ScSerializable, 0x00, 0x04,
+		'I', 0x00, 0x01, 'a',
+		'I', 0x00, 0x01, 'z',
+		'L', 0x00, 0x01, 'A',
+		TcString, 0x00, 0x12, 'L', 'j', 'a', 'v', 'a', '/', 'l', 'a', 'n', 'g', '/', 'S', 't', 'r', 'i', 'n', 'g', ';',
+		'L', 0x00, 0x01, 'b', TcReference, 0x00, 0x7e, 0x00, 0x01,
+		TcEndblockdata, TcNull,
+		0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x01,
+		TcString, 0x00, 0x01, '4',
+		TcString, 0x00, 0x01, '3',
+	}, buf.Bytes())
+
+	dec, err := NewDecoder(&buf)
+	assert.NoError(err)
+	dec.RegisterType("R", reflect.TypeOf(reorderedFields{}))
+	v, err := dec.ReadObject()
+	if assert.NoError(err) {
+		assert.Equal(object, v)
+	}
+}
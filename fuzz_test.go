@@ -0,0 +1,141 @@
+//go:build go1.18
+// +build go1.18
+
+package javaio
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// seedStreams returns the JDK-produced streams checked into testdata.
+func seedStreams(f *testing.F) [][]byte {
+	paths, err := filepath.Glob(filepath.Join("testdata", "*.ser"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	streams := make([][]byte, 0, len(paths))
+	for _, path := range paths {
+		p, err := ioutil.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		streams = append(streams, p)
+	}
+	return streams
+}
+
+func readAll(dec *Decoder) {
+	for i := 0; i < 16; i++ {
+		if _, err := dec.ReadObject(); err != nil {
+			return
+		}
+	}
+}
+
+func FuzzDecoder_ReadObject(f *testing.F) {
+	for _, p := range seedStreams(f) {
+		f.Add(p)
+	}
+	f.Fuzz(func(t *testing.T, p []byte) {
+		dec, err := NewDecoder(bytes.NewReader(p))
+		if err != nil {
+			return
+		}
+		readAll(dec)
+	})
+}
+
+func FuzzDecoder_ReadObjectRegistered(f *testing.F) {
+	for _, p := range seedStreams(f) {
+		f.Add(p)
+	}
+	f.Fuzz(func(t *testing.T, p []byte) {
+		dec, err := NewDecoder(bytes.NewReader(p))
+		if err != nil {
+			return
+		}
+		dec.RegisterType("List", reflect.TypeOf(List{}))
+		dec.RegisterType("B", reflect.TypeOf(ClassB{}))
+		dec.RegisterType("java.util.LinkedList", reflect.TypeOf(LinkedList{}))
+		dec.RegisterType("java.lang.String", reflect.TypeOf(String{}))
+		readAll(dec)
+	})
+}
+
+func FuzzDecoder_readClassDesc(f *testing.F) {
+	for _, p := range seedStreams(f) {
+		// Strip the stream header and the type code of the first content.
+		if len(p) > 5 && (p[4] == TcObject || p[4] == TcArray || p[4] == TcEnum) {
+			f.Add(p[5:])
+		}
+	}
+	f.Fuzz(func(t *testing.T, p []byte) {
+		dec, err := NewDecoder(bytes.NewReader(append([]byte{0xac, 0xed, 0x00, 0x05}, p...)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dec.blockDataMode = false
+		_, _ = dec.readClassDesc()
+	})
+}
+
+type fuzzRecord struct {
+	ID    int32
+	Count int64
+	Flag  bool
+	Name  *String
+	Next  *fuzzRecord
+}
+
+func (*fuzzRecord) ClassName() string {
+	return "FuzzRecord"
+}
+
+func FuzzEncoder_RoundTrip(f *testing.F) {
+	f.Add(int32(17), int64(-42), true, "hello", uint8(0))
+	f.Add(int32(0), int64(0), false, "", uint8(3))
+	f.Add(int32(-1), int64(1<<40), true, "\x00é\U0001f600", uint8(15))
+	f.Fuzz(func(t *testing.T, id int32, count int64, flag bool, name string, depth uint8) {
+		var head *fuzzRecord
+		for i := int(depth % 16); i >= 0; i-- {
+			head = &fuzzRecord{
+				ID:    id + int32(i),
+				Count: count,
+				Flag:  flag,
+				Next:  head,
+			}
+			if i%2 == 0 {
+				head.Name = &String{Value: name}
+			}
+		}
+
+		var buf bytes.Buffer
+		enc, err := NewEncoder(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := enc.WriteObject(head); err != nil {
+			t.Fatal(err)
+		}
+		if err := enc.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		dec, err := NewDecoder(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dec.RegisterType("FuzzRecord", reflect.TypeOf(fuzzRecord{}))
+		object, err := dec.ReadObject()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, head, object)
+	})
+}
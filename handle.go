@@ -5,29 +5,101 @@ import (
 	"unsafe"
 )
 
-type refElem struct {
-	kind  reflect.Kind
-	index int32
+// Identity determines which objects an Encoder writes as references to
+// objects written before, instead of writing them again.
+type Identity int
+
+const (
+	// IdentityStrings identifies objects by pointer and strings by value,
+	// as if every string were interned. This is the default.
+	IdentityStrings Identity = iota
+
+	// IdentityPointers identifies objects by pointer only. Values that are
+	// not pointers, including strings, are written as new objects every
+	// time; write the same *String twice to write the same String object.
+	// If the Go graph uses a pointer for every Java object and shares
+	// pointers exactly where the Java graph shares objects, the stream has
+	// the same handles as one written by ObjectOutputStream.
+	IdentityPointers
+
+	// IdentityValues identifies objects by pointer, and strings and other
+	// immutable values by value. A value is immutable if its type is
+	// comparable and contains no pointers, interfaces, slices or maps.
+	IdentityValues
+)
+
+// stringKey identifies a string by value. The type signatures of fields are
+// always identified by value, since ObjectStreamField interns them.
+type stringKey string
+
+// classNameKey identifies the class descriptor of a class.
+type classNameKey string
+
+// sliceKey identifies a non-empty slice by its type, first element and
+// length. Empty slices have no identity.
+type sliceKey struct {
+	typ  reflect.Type
+	data unsafe.Pointer
+	len  int
 }
 
-func kindAndPointer(v reflect.Value) (reflect.Kind, unsafe.Pointer) {
-	if v.Kind() == reflect.Ptr {
-		for v.Elem().Kind() == reflect.Ptr {
-			v = v.Elem()
+// identityKey returns the key that identifies object in the handle table,
+// or nil if object is written as a new object every time.
+func (enc *Encoder) identityKey(object interface{}) interface{} {
+	if s, ok := object.(*String); ok && s != nil {
+		if enc.identity == IdentityPointers {
+			return s
+		}
+		return stringKey(s.Value)
+	}
+	v := reflect.ValueOf(object)
+	for v.Kind() == reflect.Ptr && v.Elem().Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Invalid:
+		return nil
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		return v.Interface()
+	case reflect.Slice:
+		if v.Len() == 0 {
+			return nil
 		}
-		switch kind := v.Kind(); kind {
-		case reflect.Slice, reflect.Map:
-			return kind, unsafe.Pointer(v.Elem().Pointer())
-		default:
-			return kind, unsafe.Pointer(v.Pointer())
+		return sliceKey{v.Type(), unsafe.Pointer(v.Pointer()), v.Len()}
+	case reflect.String:
+		if enc.identity == IdentityPointers {
+			return nil
 		}
+		return stringKey(v.String())
 	}
-	switch kind := v.Kind(); kind {
-	case reflect.Slice, reflect.Map:
-		return kind, unsafe.Pointer(v.Pointer())
-	default:
-		return kind, unsafe.Pointer(packPointer(v).Pointer())
+	if enc.identity == IdentityValues && isImmutable(v.Type()) {
+		return v.Interface()
 	}
+	return nil
+}
+
+// isImmutable reports whether values of type typ can be identified by
+// value.
+func isImmutable(typ reflect.Type) bool {
+	switch typ.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128, reflect.String:
+		return true
+	case reflect.Array:
+		return isImmutable(typ.Elem())
+	case reflect.Struct:
+		for i := 0; i < typ.NumField(); i++ {
+			if !isImmutable(typ.Field(i).Type) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
 }
 
 func unpackPointer(v reflect.Value) reflect.Value {
@@ -37,12 +109,6 @@ func unpackPointer(v reflect.Value) reflect.Value {
 	return v
 }
 
-func packPointer(x reflect.Value) reflect.Value {
-	v := reflect.New(x.Type())
-	v.Elem().Set(x)
-	return v
-}
-
 func unpackPointerType(t reflect.Type) reflect.Type {
 	for t.Kind() == reflect.Ptr {
 		t = t.Elem()
@@ -50,20 +116,22 @@ func unpackPointerType(t reflect.Type) reflect.Type {
 	return t
 }
 
-func (enc *Encoder) newHandle(object interface{}) {
-	v := reflect.ValueOf(object)
-	kind, pointer := kindAndPointer(v)
-	index := baseWireHandle + int32(len(enc.handleMap))
-	enc.handleMap[pointer] = refElem{kind, index}
+// newHandle assigns the next handle to the object identified by key. An
+// object with a nil key is assigned a handle too, but findHandle never
+// returns it.
+func (enc *Encoder) newHandle(key interface{}) {
+	if key != nil {
+		enc.handles[key] = baseWireHandle + enc.handleCount
+	}
+	enc.handleCount++
 }
 
-func (enc *Encoder) findHandle(object interface{}) int32 {
-	v := reflect.ValueOf(object)
-	kind, pointer := kindAndPointer(v)
-	if elem, ok := enc.handleMap[pointer]; ok {
-		if elem.kind == kind {
-			return elem.index
-		}
+func (enc *Encoder) findHandle(key interface{}) int32 {
+	if key == nil {
+		return -1
+	}
+	if handle, ok := enc.handles[key]; ok {
+		return handle
 	}
 	return -1
 }
@@ -0,0 +1,432 @@
+// Package classfile parses the parts of Java class files that matter for
+// serialization: the class hierarchy, fields, methods and constant values.
+package classfile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/lujjjh/go-javaio/internal/mutf8"
+)
+
+// Access flags, as defined by the JVM specification and java.lang.reflect.Modifier.
+const (
+	AccPublic       = 0x0001
+	AccPrivate      = 0x0002
+	AccProtected    = 0x0004
+	AccStatic       = 0x0008
+	AccFinal        = 0x0010
+	AccSynchronized = 0x0020
+	AccVolatile     = 0x0040
+	AccTransient    = 0x0080
+	AccNative       = 0x0100
+	AccInterface    = 0x0200
+	AccAbstract     = 0x0400
+	AccStrict       = 0x0800
+	AccEnum         = 0x4000
+)
+
+const magic = 0xcafebabe
+
+const (
+	constantUtf8               = 1
+	constantInteger            = 3
+	constantFloat              = 4
+	constantLong               = 5
+	constantDouble             = 6
+	constantClass              = 7
+	constantString             = 8
+	constantFieldref           = 9
+	constantMethodref          = 10
+	constantInterfaceMethodref = 11
+	constantNameAndType        = 12
+	constantMethodHandle       = 15
+	constantMethodType         = 16
+	constantDynamic            = 17
+	constantInvokeDynamic      = 18
+	constantModule             = 19
+	constantPackage            = 20
+)
+
+// ClassFile is a parsed class file. Class names use dots as separators,
+// e.g. "java.util.ArrayList"; descriptors are kept as in the class file.
+type ClassFile struct {
+	AccessFlags uint16
+	Name        string
+	SuperName   string // empty for java.lang.Object
+	Interfaces  []string
+	Fields      []*Member
+	Methods     []*Member
+
+	// innerFlags holds the access flags of the class from its InnerClasses
+	// attribute, which is what reflection reports for nested classes.
+	innerFlags    uint16
+	hasInnerFlags bool
+}
+
+// Member is a field or a method.
+type Member struct {
+	AccessFlags uint16
+	Name        string
+	Descriptor  string
+	// ConstantValue is the value of the ConstantValue attribute of a field:
+	// an int32, int64, float32, float64 or string, or nil if there is none.
+	ConstantValue interface{}
+}
+
+// A FormatError reports a malformed class file.
+type FormatError struct {
+	Offset int64
+	Msg    string
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("classfile: %s (offset %d)", e.Msg, e.Offset)
+}
+
+type parser struct {
+	b    []byte
+	off  int
+	pool []*constant
+	err  error
+}
+
+type constant struct {
+	tag   byte
+	value interface{} // string for Utf8 and numbers for numeric constants
+	index uint16      // name or string index for Class and String
+}
+
+// Parse parses a class file.
+func Parse(b []byte) (*ClassFile, error) {
+	p := &parser{b: b}
+	cf := p.classFile()
+	if p.err != nil {
+		return nil, p.err
+	}
+	return cf, nil
+}
+
+func (p *parser) classFile() *ClassFile {
+	if p.u4() != magic {
+		p.fail(0, "invalid magic")
+		return nil
+	}
+	p.u2() // minor_version
+	p.u2() // major_version
+	p.constantPool()
+	cf := &ClassFile{AccessFlags: p.u2()}
+	thisClass := p.u2()
+	cf.Name = p.className(thisClass)
+	if superClass := p.u2(); superClass != 0 {
+		cf.SuperName = p.className(superClass)
+	}
+	for n := p.u2(); n > 0 && p.err == nil; n-- {
+		cf.Interfaces = append(cf.Interfaces, p.className(p.u2()))
+	}
+	for n := p.u2(); n > 0 && p.err == nil; n-- {
+		cf.Fields = append(cf.Fields, p.member())
+	}
+	for n := p.u2(); n > 0 && p.err == nil; n-- {
+		cf.Methods = append(cf.Methods, p.member())
+	}
+	for n := p.u2(); n > 0 && p.err == nil; n-- {
+		name, data := p.attribute()
+		if name == "InnerClasses" {
+			p.innerClasses(cf, thisClass, data)
+		}
+	}
+	return cf
+}
+
+func (p *parser) fail(offset int, format string, args ...interface{}) {
+	if p.err == nil {
+		p.err = &FormatError{Offset: int64(offset), Msg: fmt.Sprintf(format, args...)}
+	}
+}
+
+func (p *parser) bytes(n int) []byte {
+	if p.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(p.b)-p.off {
+		p.err = &FormatError{Offset: int64(len(p.b)), Msg: io.ErrUnexpectedEOF.Error()}
+		return nil
+	}
+	b := p.b[p.off : p.off+n]
+	p.off += n
+	return b
+}
+
+func (p *parser) u1() byte {
+	if b := p.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (p *parser) u2() uint16 {
+	if b := p.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (p *parser) u4() uint32 {
+	if b := p.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (p *parser) constantPool() {
+	count := int(p.u2())
+	p.pool = make([]*constant, count)
+	for i := 1; i < count && p.err == nil; i++ {
+		start := p.off
+		c := &constant{tag: p.u1()}
+		switch c.tag {
+		case constantUtf8:
+			c.value = mutf8.Decode(p.bytes(int(p.u2())))
+		case constantInteger:
+			c.value = int32(p.u4())
+		case constantFloat:
+			c.value = math.Float32frombits(p.u4())
+		case constantLong:
+			c.value = int64(p.u4())<<32 | int64(p.u4())
+		case constantDouble:
+			c.value = math.Float64frombits(uint64(p.u4())<<32 | uint64(p.u4()))
+		case constantClass, constantString, constantMethodType, constantModule, constantPackage:
+			c.index = p.u2()
+		case constantFieldref, constantMethodref, constantInterfaceMethodref,
+			constantNameAndType, constantDynamic, constantInvokeDynamic:
+			c.index = p.u2()
+			p.u2()
+		case constantMethodHandle:
+			p.u1()
+			p.u2()
+		default:
+			p.fail(start, "invalid constant pool tag %d", c.tag)
+		}
+		p.pool[i] = c
+		// Longs and doubles take two entries.
+		if c.tag == constantLong || c.tag == constantDouble {
+			i++
+		}
+	}
+}
+
+func (p *parser) constant(index uint16, tag byte) *constant {
+	if p.err != nil {
+		return nil
+	}
+	if int(index) >= len(p.pool) || p.pool[index] == nil {
+		p.fail(p.off, "invalid constant pool index %d", index)
+		return nil
+	}
+	c := p.pool[index]
+	if c.tag != tag {
+		p.fail(p.off, "constant pool entry %d has tag %d, expected %d", index, c.tag, tag)
+		return nil
+	}
+	return c
+}
+
+func (p *parser) utf8(index uint16) string {
+	if c := p.constant(index, constantUtf8); c != nil {
+		return c.value.(string)
+	}
+	return ""
+}
+
+func (p *parser) className(index uint16) string {
+	if c := p.constant(index, constantClass); c != nil {
+		return strings.ReplaceAll(p.utf8(c.index), "/", ".")
+	}
+	return ""
+}
+
+func (p *parser) attribute() (string, []byte) {
+	name := p.utf8(p.u2())
+	return name, p.bytes(int(p.u4()))
+}
+
+func (p *parser) member() *Member {
+	m := &Member{
+		AccessFlags: p.u2(),
+		Name:        p.utf8(p.u2()),
+		Descriptor:  p.utf8(p.u2()),
+	}
+	for n := p.u2(); n > 0 && p.err == nil; n-- {
+		name, data := p.attribute()
+		if name != "ConstantValue" || len(data) != 2 {
+			continue
+		}
+		index := binary.BigEndian.Uint16(data)
+		if int(index) >= len(p.pool) || p.pool[index] == nil {
+			p.fail(p.off, "invalid constant pool index %d", index)
+			continue
+		}
+		switch c := p.pool[index]; c.tag {
+		case constantString:
+			m.ConstantValue = p.utf8(c.index)
+		case constantInteger, constantLong, constantFloat, constantDouble:
+			m.ConstantValue = c.value
+		}
+	}
+	return m
+}
+
+func (p *parser) innerClasses(cf *ClassFile, thisClass uint16, data []byte) {
+	if len(data) < 2 {
+		return
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	for i := 0; i < n && len(data) >= 8; i++ {
+		if binary.BigEndian.Uint16(data) == thisClass {
+			cf.innerFlags = binary.BigEndian.Uint16(data[6:])
+			cf.hasInnerFlags = true
+		}
+		data = data[8:]
+	}
+}
+
+// Modifiers returns the class modifiers as reported by Class.getModifiers.
+func (cf *ClassFile) Modifiers() uint16 {
+	if cf.hasInnerFlags {
+		return cf.innerFlags
+	}
+	return cf.AccessFlags
+}
+
+// Field returns the field with the given name, or nil.
+func (cf *ClassFile) Field(name string) *Member {
+	for _, f := range cf.Fields {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// Method returns the method with the given name and descriptor, or nil.
+func (cf *ClassFile) Method(name, descriptor string) *Member {
+	for _, m := range cf.Methods {
+		if m.Name == name && m.Descriptor == descriptor {
+			return m
+		}
+	}
+	return nil
+}
+
+// SerialVersionUID returns the value of the static final long
+// serialVersionUID field, if the class declares one.
+func (cf *ClassFile) SerialVersionUID() (int64, bool) {
+	f := cf.Field("serialVersionUID")
+	if f == nil || f.Descriptor != "J" || f.AccessFlags&(AccStatic|AccFinal) != AccStatic|AccFinal {
+		return 0, false
+	}
+	suid, ok := f.ConstantValue.(int64)
+	return suid, ok
+}
+
+// DefaultSerialVersionUID computes the serialVersionUID the JVM assigns to
+// a class that does not declare one, following
+// ObjectStreamClass.computeDefaultSUID.
+func (cf *ClassFile) DefaultSerialVersionUID() int64 {
+	var buf bytes.Buffer
+	writeUTF := func(s string) {
+		b := mutf8.Encode(s)
+		binary.Write(&buf, binary.BigEndian, uint16(len(b)))
+		buf.Write(b)
+	}
+	writeInt := func(i uint16) {
+		binary.Write(&buf, binary.BigEndian, int32(i))
+	}
+
+	writeUTF(cf.Name)
+
+	var methods, constructors []*Member
+	hasStaticInitializer := false
+	for _, m := range cf.Methods {
+		switch m.Name {
+		case "<clinit>":
+			hasStaticInitializer = true
+		case "<init>":
+			constructors = append(constructors, m)
+		default:
+			methods = append(methods, m)
+		}
+	}
+
+	classMods := cf.Modifiers() & (AccPublic | AccFinal | AccInterface | AccAbstract)
+	if classMods&AccInterface != 0 {
+		if len(methods) > 0 {
+			classMods |= AccAbstract
+		} else {
+			classMods &^= AccAbstract
+		}
+	}
+	writeInt(classMods)
+
+	interfaces := append([]string(nil), cf.Interfaces...)
+	sort.Strings(interfaces)
+	for _, name := range interfaces {
+		writeUTF(name)
+	}
+
+	fields := append([]*Member(nil), cf.Fields...)
+	sort.SliceStable(fields, func(i, j int) bool {
+		return fields[i].Name < fields[j].Name
+	})
+	for _, f := range fields {
+		mods := f.AccessFlags & (AccPublic | AccPrivate | AccProtected | AccStatic | AccFinal | AccVolatile | AccTransient)
+		if mods&AccPrivate == 0 || mods&(AccStatic|AccTransient) == 0 {
+			writeUTF(f.Name)
+			writeInt(mods)
+			writeUTF(f.Descriptor)
+		}
+	}
+
+	if hasStaticInitializer {
+		writeUTF("<clinit>")
+		writeInt(AccStatic)
+		writeUTF("()V")
+	}
+
+	const methodMask = AccPublic | AccPrivate | AccProtected | AccStatic | AccFinal |
+		AccSynchronized | AccNative | AccAbstract | AccStrict
+	sort.SliceStable(constructors, func(i, j int) bool {
+		return constructors[i].Descriptor < constructors[j].Descriptor
+	})
+	for _, m := range constructors {
+		if mods := m.AccessFlags & methodMask; mods&AccPrivate == 0 {
+			writeUTF("<init>")
+			writeInt(mods)
+			writeUTF(strings.ReplaceAll(m.Descriptor, "/", "."))
+		}
+	}
+	sort.SliceStable(methods, func(i, j int) bool {
+		if methods[i].Name != methods[j].Name {
+			return methods[i].Name < methods[j].Name
+		}
+		return methods[i].Descriptor < methods[j].Descriptor
+	})
+	for _, m := range methods {
+		if mods := m.AccessFlags & methodMask; mods&AccPrivate == 0 {
+			writeUTF(m.Name)
+			writeInt(mods)
+			writeUTF(strings.ReplaceAll(m.Descriptor, "/", "."))
+		}
+	}
+
+	hash := sha1.Sum(buf.Bytes())
+	return int64(binary.LittleEndian.Uint64(hash[:8]))
+}
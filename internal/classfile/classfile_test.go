@@ -0,0 +1,210 @@
+package classfile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// assembler builds minimal class files for tests.
+type assembler struct {
+	pool  bytes.Buffer
+	count uint16
+	utf8s map[string]uint16
+}
+
+type memberSpec struct {
+	flags      uint16
+	name       string
+	descriptor string
+	constant   interface{} // int64 or string
+}
+
+func newAssembler() *assembler {
+	return &assembler{count: 1, utf8s: make(map[string]uint16)}
+}
+
+func (a *assembler) entry(b ...interface{}) uint16 {
+	for _, v := range b {
+		binary.Write(&a.pool, binary.BigEndian, v)
+	}
+	a.count++
+	return a.count - 1
+}
+
+func (a *assembler) utf8(s string) uint16 {
+	if i, ok := a.utf8s[s]; ok {
+		return i
+	}
+	i := a.entry(byte(constantUtf8), uint16(len(s)), []byte(s))
+	a.utf8s[s] = i
+	return i
+}
+
+func (a *assembler) class(name string) uint16 {
+	return a.entry(byte(constantClass), a.utf8(name))
+}
+
+func (a *assembler) members(buf *bytes.Buffer, members []memberSpec) {
+	binary.Write(buf, binary.BigEndian, uint16(len(members)))
+	for _, m := range members {
+		binary.Write(buf, binary.BigEndian, []uint16{m.flags, a.utf8(m.name), a.utf8(m.descriptor)})
+		if m.constant == nil {
+			binary.Write(buf, binary.BigEndian, uint16(0))
+			continue
+		}
+		var index uint16
+		switch v := m.constant.(type) {
+		case int64:
+			index = a.entry(byte(constantLong), v)
+			a.count++
+		case string:
+			index = a.entry(byte(constantString), a.utf8(v))
+		}
+		binary.Write(buf, binary.BigEndian, []uint16{1, a.utf8("ConstantValue"), 0, 2, index})
+	}
+}
+
+func (a *assembler) assemble(flags uint16, name, super string, interfaces []string, fields, methods []memberSpec, innerFlags int) []byte {
+	var body bytes.Buffer
+	thisClass := a.class(name)
+	var superClass uint16
+	if super != "" {
+		superClass = a.class(super)
+	}
+	binary.Write(&body, binary.BigEndian, []uint16{flags, thisClass, superClass, uint16(len(interfaces))})
+	for _, iface := range interfaces {
+		binary.Write(&body, binary.BigEndian, a.class(iface))
+	}
+	a.members(&body, fields)
+	a.members(&body, methods)
+	if innerFlags < 0 {
+		binary.Write(&body, binary.BigEndian, uint16(0))
+	} else {
+		binary.Write(&body, binary.BigEndian, []uint16{1, a.utf8("InnerClasses"), 0, 10, 1, thisClass, 0, 0, uint16(innerFlags)})
+	}
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, []uint32{magic, 52})
+	binary.Write(&b, binary.BigEndian, a.count)
+	b.Write(a.pool.Bytes())
+	b.Write(body.Bytes())
+	return b.Bytes()
+}
+
+func TestParse(t *testing.T) {
+	assert := assert.New(t)
+	a := newAssembler()
+	b := a.assemble(AccPublic|0x20, "com/example/Point", "java/lang/Object", []string{"java/io/Serializable"},
+		[]memberSpec{
+			{AccPrivate | AccStatic | AccFinal, "serialVersionUID", "J", int64(-42)},
+			{AccPrivate | AccStatic | AccFinal, "ORIGIN", "Ljava/lang/String;", "origin"},
+			{AccPrivate, "x", "I", nil},
+			{AccPrivate | AccTransient, "cache", "Ljava/lang/Object;", nil},
+		},
+		[]memberSpec{
+			{AccPublic, "<init>", "()V", nil},
+			{AccPrivate, "writeObject", "(Ljava/io/ObjectOutputStream;)V", nil},
+		}, -1)
+	cf, err := Parse(b)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal("com.example.Point", cf.Name)
+	assert.Equal("java.lang.Object", cf.SuperName)
+	assert.Equal([]string{"java.io.Serializable"}, cf.Interfaces)
+	assert.Len(cf.Fields, 4)
+	assert.Equal("origin", cf.Field("ORIGIN").ConstantValue)
+	assert.Equal(uint16(AccPrivate|AccTransient), cf.Field("cache").AccessFlags)
+	assert.NotNil(cf.Method("writeObject", "(Ljava/io/ObjectOutputStream;)V"))
+	assert.Nil(cf.Method("readObject", "(Ljava/io/ObjectInputStream;)V"))
+	suid, ok := cf.SerialVersionUID()
+	assert.True(ok)
+	assert.Equal(int64(-42), suid)
+	assert.Equal(uint16(AccPublic|0x20), cf.Modifiers())
+
+	for i := range b {
+		_, err := Parse(b[:i])
+		assert.Error(err)
+	}
+}
+
+func TestDefaultSerialVersionUID(t *testing.T) {
+	a := newAssembler()
+	cf, err := Parse(a.assemble(AccPublic|0x20, "p/Outer$Inner", "java/lang/Object", []string{"java/lang/Cloneable", "java/io/Serializable"},
+		[]memberSpec{
+			{AccPrivate | AccStatic, "skippedStatic", "I", nil},
+			{AccPrivate | AccTransient, "skippedTransient", "I", nil},
+			{AccProtected | AccVolatile, "b", "[Lp/Outer;", nil},
+			{AccPrivate, "a", "J", nil},
+		},
+		[]memberSpec{
+			{AccPrivate, "<init>", "(I)V", nil},
+			{AccPublic | 0x80, "<init>", "([Ljava/lang/String;)V", nil},
+			{AccStatic, "<clinit>", "()V", nil},
+			{AccPrivate, "hidden", "()V", nil},
+			{AccPublic | 0x40 | 0x1000, "m", "(Lp/Outer;)Ljava/lang/Object;", nil},
+			{AccPublic, "m", "()V", nil},
+		}, AccPrivate|AccStatic))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// The input to the hash, as written by ObjectStreamClass.computeDefaultSUID.
+	var buf bytes.Buffer
+	utf := func(s string) {
+		binary.Write(&buf, binary.BigEndian, uint16(len(s)))
+		buf.WriteString(s)
+	}
+	mods := func(m int32) {
+		binary.Write(&buf, binary.BigEndian, m)
+	}
+	utf("p.Outer$Inner")
+	mods(0) // private static from InnerClasses, masked
+	utf("java.io.Serializable")
+	utf("java.lang.Cloneable")
+	utf("a")
+	mods(AccPrivate)
+	utf("J")
+	utf("b")
+	mods(AccProtected | AccVolatile)
+	utf("[Lp/Outer;")
+	utf("<clinit>")
+	mods(AccStatic)
+	utf("()V")
+	utf("<init>")
+	mods(AccPublic)
+	utf("([Ljava.lang.String;)V")
+	utf("m")
+	mods(AccPublic)
+	utf("()V")
+	utf("m")
+	mods(AccPublic)
+	utf("(Lp.Outer;)Ljava.lang.Object;")
+	hash := sha1.Sum(buf.Bytes())
+	assert.Equal(t, int64(binary.LittleEndian.Uint64(hash[:])), cf.DefaultSerialVersionUID())
+}
+
+func TestDefaultSerialVersionUID_Interface(t *testing.T) {
+	a := newAssembler()
+	cf, err := Parse(a.assemble(AccPublic|AccInterface|AccAbstract, "I", "java/lang/Object", nil, nil, nil, -1))
+	if !assert.NoError(t, err) {
+		return
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint16(1))
+	buf.WriteString("I")
+	binary.Write(&buf, binary.BigEndian, int32(AccPublic|AccInterface))
+	hash := sha1.Sum(buf.Bytes())
+	assert.Equal(t, int64(binary.LittleEndian.Uint64(hash[:])), cf.DefaultSerialVersionUID())
+}
+
+func TestParse_Malformed(t *testing.T) {
+	_, err := Parse([]byte{0xca, 0xfe, 0xba, 0xbf})
+	assert.Error(t, err)
+	_, err = Parse([]byte{0xca, 0xfe, 0xba, 0xbe, 0, 0, 0, 52, 0, 2, 99})
+	assert.EqualError(t, err, "classfile: invalid constant pool tag 99 (offset 10)")
+}
@@ -0,0 +1,88 @@
+// Package mutf8 implements the modified UTF-8 encoding used by Java's
+// DataInput and DataOutput and by class files.
+package mutf8
+
+import "unicode/utf16"
+
+// Decode decodes modified UTF-8. Malformed sequences decode to U+FFFD.
+func Decode(b []byte) string {
+	ascii := true
+	for _, c := range b {
+		if c == 0 || c >= 0x80 {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return string(b)
+	}
+	units := make([]uint16, 0, len(b))
+	for i := 0; i < len(b); {
+		c := b[i]
+		switch {
+		case c < 0x80:
+			units = append(units, uint16(c))
+			i++
+		case c&0xe0 == 0xc0 && i+1 < len(b) && b[i+1]&0xc0 == 0x80:
+			units = append(units, uint16(c&0x1f)<<6|uint16(b[i+1]&0x3f))
+			i += 2
+		case c&0xf0 == 0xe0 && i+2 < len(b) && b[i+1]&0xc0 == 0x80 && b[i+2]&0xc0 == 0x80:
+			units = append(units, uint16(c&0x0f)<<12|uint16(b[i+1]&0x3f)<<6|uint16(b[i+2]&0x3f))
+			i += 3
+		default:
+			units = append(units, 0xfffd)
+			i++
+		}
+	}
+	return string(utf16.Decode(units))
+}
+
+// Encode encodes s in modified UTF-8: NUL is encoded in two bytes and
+// supplementary characters as surrogate pairs.
+func Encode(s string) []byte {
+	if isASCII(s) {
+		return []byte(s)
+	}
+	b := make([]byte, 0, len(s))
+	for _, u := range utf16.Encode([]rune(s)) {
+		switch {
+		case u != 0 && u < 0x80:
+			b = append(b, byte(u))
+		case u < 0x800:
+			b = append(b, 0xc0|byte(u>>6), 0x80|byte(u&0x3f))
+		default:
+			b = append(b, 0xe0|byte(u>>12), 0x80|byte(u>>6&0x3f), 0x80|byte(u&0x3f))
+		}
+	}
+	return b
+}
+
+// isASCII reports whether s holds only ASCII characters other than NUL,
+// which are encoded the same in UTF-8 and modified UTF-8.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == 0 || c >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// Valid reports whether b is well-formed modified UTF-8, as checked by
+// DataInput.readUTF.
+func Valid(b []byte) bool {
+	for i := 0; i < len(b); {
+		c := b[i]
+		switch {
+		case c < 0x80:
+			i++
+		case c&0xe0 == 0xc0 && i+1 < len(b) && b[i+1]&0xc0 == 0x80:
+			i += 2
+		case c&0xf0 == 0xe0 && i+2 < len(b) && b[i+1]&0xc0 == 0x80 && b[i+2]&0xc0 == 0x80:
+			i += 3
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,38 @@
+package mutf8
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	for _, test := range []struct {
+		s string
+		b []byte
+	}{
+		{"", []byte{}},
+		{"abc", []byte("abc")},
+		{"\x00", []byte{0xc0, 0x80}},
+		{"é", []byte{0xc3, 0xa9}},
+		{"中", []byte{0xe4, 0xb8, 0xad}},
+		{"\U0001F600", []byte{0xed, 0xa0, 0xbd, 0xed, 0xb8, 0x80}},
+	} {
+		assert.Equal(t, test.b, Encode(test.s), test.s)
+		assert.Equal(t, test.s, Decode(test.b), test.s)
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	assert.Equal(t, "a�b", Decode([]byte{'a', 0xc3, 'b'}))
+	assert.Equal(t, "�", Decode([]byte{0xff}))
+}
+
+func TestValid(t *testing.T) {
+	assert.True(t, Valid(nil))
+	assert.True(t, Valid([]byte{'a', 0xc0, 0x80, 0xed, 0xa0, 0xbd, 0xed, 0xb8, 0x80}))
+	assert.False(t, Valid([]byte{'a', 0xc3, 'b'}))
+	assert.False(t, Valid([]byte{0xe4, 0xb8}))
+	assert.False(t, Valid([]byte{0x80}))
+	assert.False(t, Valid([]byte{0xf0, 0x9f, 0x98, 0x80}))
+}
@@ -0,0 +1,716 @@
+// Package stream parses Java serialization streams into a tree of contents
+// without mapping them to Go types. Every content records the offset at
+// which it starts and the handle it was assigned, which makes the tree
+// suitable for inspection tools.
+package stream
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	javaio "github.com/lujjjh/go-javaio"
+	"github.com/lujjjh/go-javaio/internal/mutf8"
+)
+
+// Content is an element of a stream: an object, a class, an array, a
+// string, an enum constant, a class descriptor, null, a reference, block
+// data, a reset or an exception.
+type Content interface {
+	Offset() int64
+}
+
+type Null struct {
+	Pos int64
+}
+
+type Reference struct {
+	Pos    int64
+	Handle int32
+	Target Content
+}
+
+type String struct {
+	Pos    int64
+	Handle int32
+	Long   bool
+	Value  string
+}
+
+type ClassDesc struct {
+	Pos              int64
+	Handle           int32
+	Proxy            bool
+	Name             string
+	SerialVersionUID int64
+	Flags            byte
+	Fields           []*Field
+	Interfaces       []string // proxy interface names
+	Annotations      []Content
+	Super            Content // *ClassDesc, *Reference or *Null
+}
+
+type Field struct {
+	Pos       int64
+	TypeCode  byte
+	Name      string
+	ClassName Content // *String or *Reference for object fields
+}
+
+type Object struct {
+	Pos       int64
+	Handle    int32
+	Class     Content
+	ClassData []*ClassData // from the topmost superclass down
+}
+
+// ClassData holds the serial data written for one class in the hierarchy
+// of an object.
+type ClassData struct {
+	Class       *ClassDesc
+	Values      []*Value
+	Annotations []Content // contents written by writeObject or writeExternal
+}
+
+// Value is a field value or an array element. Exactly one of Primitive
+// and Object is set.
+type Value struct {
+	Pos       int64
+	TypeCode  byte
+	Name      string
+	Primitive interface{}
+	Object    Content
+}
+
+// Array is an array object. The elements of byte arrays are stored in
+// Bytes, starting at offset BytesPos, rather than in Values.
+type Array struct {
+	Pos      int64
+	Handle   int32
+	Class    Content
+	Values   []*Value
+	Bytes    []byte
+	BytesPos int64
+}
+
+type Enum struct {
+	Pos      int64
+	Handle   int32
+	Class    Content
+	Constant Content
+}
+
+type Class struct {
+	Pos    int64
+	Handle int32
+	Class  Content
+}
+
+type BlockData struct {
+	Pos  int64
+	Data []byte
+}
+
+type Reset struct {
+	Pos int64
+}
+
+type Exception struct {
+	Pos       int64
+	Throwable Content
+}
+
+// EndBlockData marks the end of annotations; it only appears in the
+// results of Parser.ReadContent.
+type EndBlockData struct {
+	Pos int64
+}
+
+func (c *Null) Offset() int64         { return c.Pos }
+func (c *Reference) Offset() int64    { return c.Pos }
+func (c *String) Offset() int64       { return c.Pos }
+func (c *ClassDesc) Offset() int64    { return c.Pos }
+func (c *Object) Offset() int64       { return c.Pos }
+func (c *Array) Offset() int64        { return c.Pos }
+func (c *Enum) Offset() int64         { return c.Pos }
+func (c *Class) Offset() int64        { return c.Pos }
+func (c *BlockData) Offset() int64    { return c.Pos }
+func (c *Reset) Offset() int64        { return c.Pos }
+func (c *Exception) Offset() int64    { return c.Pos }
+func (c *EndBlockData) Offset() int64 { return c.Pos }
+
+// Resolve follows a reference and returns the class descriptor it denotes,
+// or nil for null.
+func Resolve(c Content) *ClassDesc {
+	if ref, ok := c.(*Reference); ok {
+		c = ref.Target
+	}
+	desc, _ := c.(*ClassDesc)
+	return desc
+}
+
+// Hierarchy returns the class descriptors of desc and its superclasses,
+// from the topmost superclass down.
+func (desc *ClassDesc) Hierarchy() []*ClassDesc {
+	var descs []*ClassDesc
+	seen := make(map[*ClassDesc]bool)
+	for d := desc; d != nil && !seen[d]; d = Resolve(d.Super) {
+		seen[d] = true
+		descs = append([]*ClassDesc{d}, descs...)
+	}
+	return descs
+}
+
+const baseWireHandle = 0x7e0000
+
+type Parser struct {
+	r       io.Reader
+	offset  int64
+	handles []Content
+}
+
+// NewParser reads the stream header from r and returns a Parser for the
+// contents that follow.
+func NewParser(r io.Reader) (*Parser, error) {
+	p := &Parser{r: r}
+	var header [4]byte
+	if err := p.read(header[:]); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint16(header[:2]) != javaio.StreamMagic {
+		return nil, p.errorf(0, "invalid stream magic %02x%02x", header[0], header[1])
+	}
+	if version := int16(binary.BigEndian.Uint16(header[2:])); version != javaio.StreamVersion {
+		return nil, p.errorf(2, "unsupported stream version %d", version)
+	}
+	return p, nil
+}
+
+// Parse reads all contents of the stream in r. The contents read before
+// an error are returned along with it.
+func Parse(r io.Reader) ([]Content, error) {
+	p, err := NewParser(r)
+	if err != nil {
+		return nil, err
+	}
+	var contents []Content
+	for {
+		c, err := p.ReadContent()
+		if err == io.EOF {
+			return contents, nil
+		}
+		if c != nil {
+			contents = append(contents, c)
+		}
+		if err != nil {
+			return contents, err
+		}
+	}
+}
+
+// Offset returns the number of bytes consumed so far, including the stream
+// header.
+func (p *Parser) Offset() int64 {
+	return p.offset
+}
+
+// ReadContent reads the next top-level content. It returns io.EOF at the
+// end of the stream. On other errors, the partially read content is
+// returned if there is one.
+func (p *Parser) ReadContent() (Content, error) {
+	tc, err := p.readByte()
+	if err != nil {
+		return nil, err
+	}
+	return p.content(tc)
+}
+
+func (p *Parser) content(tc byte) (Content, error) {
+	pos := p.offset - 1
+	switch tc {
+	case javaio.TcBlockdata, javaio.TcBlockdatalong:
+		return p.blockData(tc)
+	case javaio.TcEndblockdata:
+		return &EndBlockData{Pos: pos}, nil
+	}
+	return p.object(tc)
+}
+
+func (p *Parser) object(tc byte) (Content, error) {
+	pos := p.offset - 1
+	switch tc {
+	case javaio.TcNull:
+		return &Null{Pos: pos}, nil
+	case javaio.TcReference:
+		ref, err := p.reference()
+		if ref == nil {
+			return nil, err
+		}
+		return ref, err
+	case javaio.TcString, javaio.TcLongstring:
+		return p.newString(tc)
+	case javaio.TcClassdesc, javaio.TcProxyclassdesc:
+		return p.newClassDesc(tc)
+	case javaio.TcObject:
+		return p.newObject()
+	case javaio.TcArray:
+		return p.newArray()
+	case javaio.TcEnum:
+		return p.newEnum()
+	case javaio.TcClass:
+		c := &Class{Pos: pos}
+		desc, err := p.classDesc()
+		c.Class = desc
+		if err != nil {
+			return c, err
+		}
+		c.Handle = p.assign(c)
+		return c, nil
+	case javaio.TcReset:
+		p.handles = p.handles[:0]
+		return &Reset{Pos: pos}, nil
+	case javaio.TcException:
+		p.handles = p.handles[:0]
+		c := &Exception{Pos: pos}
+		throwable, err := p.readObject()
+		c.Throwable = throwable
+		p.handles = p.handles[:0]
+		return c, err
+	default:
+		return nil, p.errorf(pos, "invalid type code %02X", tc)
+	}
+}
+
+func (p *Parser) readObject() (Content, error) {
+	tc, err := p.readByte()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return p.object(tc)
+}
+
+func (p *Parser) assign(c Content) int32 {
+	p.handles = append(p.handles, c)
+	return baseWireHandle + int32(len(p.handles)-1)
+}
+
+func (p *Parser) reference() (*Reference, error) {
+	pos := p.offset - 1
+	handle, err := p.readInt()
+	if err != nil {
+		return nil, err
+	}
+	i := int64(handle) - baseWireHandle
+	if i < 0 || i >= int64(len(p.handles)) {
+		return nil, p.errorf(pos+1, "invalid handle %#x", handle)
+	}
+	return &Reference{Pos: pos, Handle: handle, Target: p.handles[i]}, nil
+}
+
+func (p *Parser) newString(tc byte) (*String, error) {
+	s := &String{Pos: p.offset - 1, Long: tc == javaio.TcLongstring}
+	s.Handle = p.assign(s)
+	var err error
+	if s.Long {
+		s.Value, err = p.readLongUTF()
+	} else {
+		s.Value, err = p.readUTF()
+	}
+	return s, err
+}
+
+func (p *Parser) classDesc() (Content, error) {
+	tc, err := p.readByte()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	switch tc {
+	case javaio.TcNull, javaio.TcClassdesc, javaio.TcProxyclassdesc:
+		return p.object(tc)
+	case javaio.TcReference:
+		ref, err := p.reference()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := ref.Target.(*ClassDesc); !ok {
+			return ref, p.errorf(ref.Pos, "reference %#x is not a class descriptor", ref.Handle)
+		}
+		return ref, nil
+	default:
+		return nil, p.errorf(p.offset-1, "invalid class descriptor type code %02X", tc)
+	}
+}
+
+func (p *Parser) newClassDesc(tc byte) (*ClassDesc, error) {
+	desc := &ClassDesc{Pos: p.offset - 1, Proxy: tc == javaio.TcProxyclassdesc}
+	if desc.Proxy {
+		desc.Handle = p.assign(desc)
+		count, err := p.readInt()
+		if err != nil {
+			return desc, err
+		}
+		if count < 0 {
+			return desc, p.errorf(p.offset-4, "invalid interface count %d", count)
+		}
+		for i := int32(0); i < count; i++ {
+			name, err := p.readUTF()
+			if err != nil {
+				return desc, err
+			}
+			desc.Interfaces = append(desc.Interfaces, name)
+		}
+	} else {
+		name, err := p.readUTF()
+		if err != nil {
+			return desc, err
+		}
+		desc.Name = name
+		if desc.SerialVersionUID, err = p.readLong(); err != nil {
+			return desc, err
+		}
+		desc.Handle = p.assign(desc)
+		if desc.Flags, err = p.readByte(); err != nil {
+			return desc, unexpectedEOF(err)
+		}
+		count, err := p.readShort()
+		if err != nil {
+			return desc, err
+		}
+		if count < 0 {
+			return desc, p.errorf(p.offset-2, "invalid field count %d", count)
+		}
+		for i := int16(0); i < count; i++ {
+			field, err := p.fieldDesc()
+			if field != nil {
+				desc.Fields = append(desc.Fields, field)
+			}
+			if err != nil {
+				return desc, err
+			}
+		}
+	}
+	annotations, err := p.annotations()
+	desc.Annotations = annotations
+	if err != nil {
+		return desc, err
+	}
+	desc.Super, err = p.classDesc()
+	return desc, err
+}
+
+func (p *Parser) fieldDesc() (*Field, error) {
+	field := &Field{Pos: p.offset}
+	var err error
+	if field.TypeCode, err = p.readByte(); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if field.Name, err = p.readUTF(); err != nil {
+		return field, err
+	}
+	switch field.TypeCode {
+	case 'B', 'C', 'D', 'F', 'I', 'J', 'S', 'Z':
+	case 'L', '[':
+		field.ClassName, err = p.readObject()
+		if err != nil {
+			return field, err
+		}
+		switch c := field.ClassName.(type) {
+		case *String:
+		case *Reference:
+			if _, ok := c.Target.(*String); !ok {
+				return field, p.errorf(c.Pos, "field type %#x is not a string", c.Handle)
+			}
+		default:
+			return field, p.errorf(c.Offset(), "field type is not a string")
+		}
+	default:
+		return field, p.errorf(field.Pos, "invalid field type code %q", field.TypeCode)
+	}
+	return field, nil
+}
+
+// annotations reads contents up to and including TC_ENDBLOCKDATA.
+func (p *Parser) annotations() ([]Content, error) {
+	var contents []Content
+	for {
+		tc, err := p.readByte()
+		if err != nil {
+			return contents, unexpectedEOF(err)
+		}
+		c, err := p.content(tc)
+		if c != nil {
+			if _, ok := c.(*EndBlockData); ok {
+				return contents, nil
+			}
+			contents = append(contents, c)
+		}
+		if err != nil {
+			return contents, err
+		}
+	}
+}
+
+func (p *Parser) newObject() (*Object, error) {
+	obj := &Object{Pos: p.offset - 1}
+	var err error
+	if obj.Class, err = p.classDesc(); err != nil {
+		return obj, err
+	}
+	desc := Resolve(obj.Class)
+	if desc == nil {
+		return obj, p.errorf(obj.Pos, "object has no class descriptor")
+	}
+	obj.Handle = p.assign(obj)
+	for _, d := range desc.Hierarchy() {
+		data := &ClassData{Class: d}
+		obj.ClassData = append(obj.ClassData, data)
+		if err := p.classData(data); err != nil {
+			return obj, err
+		}
+	}
+	return obj, nil
+}
+
+func (p *Parser) classData(data *ClassData) error {
+	desc := data.Class
+	switch {
+	case desc.Proxy:
+		return nil
+	case desc.Flags&javaio.ScExternalizable != 0:
+		if desc.Flags&javaio.ScBlockData == 0 {
+			return p.errorf(p.offset, "cannot parse externalizable data of %s written without block data", desc.Name)
+		}
+		var err error
+		data.Annotations, err = p.annotations()
+		return err
+	case desc.Flags&javaio.ScSerializable != 0:
+		for _, field := range desc.Fields {
+			value, err := p.value(field.TypeCode, field.Name)
+			if value != nil {
+				data.Values = append(data.Values, value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if desc.Flags&javaio.ScWriteMethod != 0 {
+			var err error
+			data.Annotations, err = p.annotations()
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Parser) value(tc byte, name string) (*Value, error) {
+	value := &Value{Pos: p.offset, TypeCode: tc, Name: name}
+	var err error
+	switch tc {
+	case 'B':
+		var v byte
+		v, err = p.readByte()
+		value.Primitive = int8(v)
+	case 'C':
+		var v int16
+		v, err = p.readShort()
+		value.Primitive = uint16(v)
+	case 'D':
+		var v int64
+		v, err = p.readLong()
+		value.Primitive = math.Float64frombits(uint64(v))
+	case 'F':
+		var v int32
+		v, err = p.readInt()
+		value.Primitive = math.Float32frombits(uint32(v))
+	case 'I':
+		value.Primitive, err = p.readInt()
+	case 'J':
+		value.Primitive, err = p.readLong()
+	case 'S':
+		value.Primitive, err = p.readShort()
+	case 'Z':
+		var v byte
+		v, err = p.readByte()
+		value.Primitive = v != 0
+	case 'L', '[':
+		value.Object, err = p.readObject()
+		if value.Object == nil {
+			value.Object = &Null{Pos: value.Pos}
+		}
+	default:
+		return nil, p.errorf(value.Pos, "invalid type code %q", tc)
+	}
+	return value, unexpectedEOF(err)
+}
+
+func (p *Parser) newArray() (*Array, error) {
+	array := &Array{Pos: p.offset - 1}
+	var err error
+	if array.Class, err = p.classDesc(); err != nil {
+		return array, err
+	}
+	desc := Resolve(array.Class)
+	if desc == nil || len(desc.Name) < 2 || desc.Name[0] != '[' {
+		return array, p.errorf(array.Pos, "array has no array class descriptor")
+	}
+	array.Handle = p.assign(array)
+	length, err := p.readInt()
+	if err != nil {
+		return array, err
+	}
+	if length < 0 {
+		return array, p.errorf(p.offset-4, "invalid array length %d", length)
+	}
+	elem := desc.Name[1]
+	if elem == 'B' {
+		array.BytesPos = p.offset
+		array.Bytes, err = p.readBytes(int64(length))
+		return array, err
+	}
+	for i := int32(0); i < length; i++ {
+		value, err := p.value(elem, "")
+		if value != nil {
+			array.Values = append(array.Values, value)
+		}
+		if err != nil {
+			return array, err
+		}
+	}
+	return array, nil
+}
+
+func (p *Parser) newEnum() (*Enum, error) {
+	enum := &Enum{Pos: p.offset - 1}
+	var err error
+	if enum.Class, err = p.classDesc(); err != nil {
+		return enum, err
+	}
+	enum.Handle = p.assign(enum)
+	enum.Constant, err = p.readObject()
+	return enum, err
+}
+
+func (p *Parser) blockData(tc byte) (*BlockData, error) {
+	block := &BlockData{Pos: p.offset - 1}
+	var size int64
+	if tc == javaio.TcBlockdata {
+		n, err := p.readByte()
+		if err != nil {
+			return block, unexpectedEOF(err)
+		}
+		size = int64(n)
+	} else {
+		n, err := p.readInt()
+		if err != nil {
+			return block, err
+		}
+		if n < 0 {
+			return block, p.errorf(p.offset-4, "invalid block data length %d", n)
+		}
+		size = int64(n)
+	}
+	var err error
+	block.Data, err = p.readBytes(size)
+	return block, err
+}
+
+// SyntaxError describes malformed data at a stream offset.
+type SyntaxError struct {
+	Offset int64
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("offset %#x: %s", e.Offset, e.Msg)
+}
+
+func (p *Parser) errorf(offset int64, format string, args ...interface{}) error {
+	return &SyntaxError{Offset: offset, Msg: fmt.Sprintf(format, args...)}
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (p *Parser) read(b []byte) error {
+	n, err := io.ReadFull(p.r, b)
+	p.offset += int64(n)
+	return err
+}
+
+func (p *Parser) readByte() (byte, error) {
+	var b [1]byte
+	err := p.read(b[:])
+	return b[0], err
+}
+
+func (p *Parser) readShort() (int16, error) {
+	var b [2]byte
+	err := p.read(b[:])
+	return int16(binary.BigEndian.Uint16(b[:])), unexpectedEOF(err)
+}
+
+func (p *Parser) readInt() (int32, error) {
+	var b [4]byte
+	err := p.read(b[:])
+	return int32(binary.BigEndian.Uint32(b[:])), unexpectedEOF(err)
+}
+
+func (p *Parser) readLong() (int64, error) {
+	var b [8]byte
+	err := p.read(b[:])
+	return int64(binary.BigEndian.Uint64(b[:])), unexpectedEOF(err)
+}
+
+// readBytes reads n bytes, growing the buffer as data arrives so that a
+// corrupted length cannot cause a huge allocation.
+func (p *Parser) readBytes(n int64) ([]byte, error) {
+	const chunkSize = 64 * 1024
+	b := make([]byte, 0, minInt64(n, chunkSize))
+	for int64(len(b)) < n {
+		chunk := make([]byte, minInt64(n-int64(len(b)), chunkSize))
+		if err := p.read(chunk); err != nil {
+			return b, unexpectedEOF(err)
+		}
+		b = append(b, chunk...)
+	}
+	return b, nil
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (p *Parser) readUTF() (string, error) {
+	n, err := p.readShort()
+	if err != nil {
+		return "", err
+	}
+	b, err := p.readBytes(int64(uint16(n)))
+	if err != nil {
+		return "", err
+	}
+	return mutf8.Decode(b), nil
+}
+
+func (p *Parser) readLongUTF() (string, error) {
+	n, err := p.readLong()
+	if err != nil {
+		return "", err
+	}
+	if n < 0 {
+		return "", p.errorf(p.offset-8, "invalid string length %d", n)
+	}
+	b, err := p.readBytes(n)
+	if err != nil {
+		return "", err
+	}
+	return mutf8.Decode(b), nil
+}
@@ -0,0 +1,129 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func parseFile(t *testing.T, name string) []Content {
+	p, err := ioutil.ReadFile("../../testdata/" + name)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	contents, err := Parse(bytes.NewReader(p))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return contents
+}
+
+func TestParse_Object(t *testing.T) {
+	assert := assert.New(t)
+	contents := parseFile(t, "list.ser")
+	if !assert.Len(contents, 2) {
+		return
+	}
+
+	obj := contents[0].(*Object)
+	assert.Equal(int64(4), obj.Pos)
+	assert.Equal(int32(0x7e0002), obj.Handle)
+	desc := Resolve(obj.Class)
+	assert.Equal("List", desc.Name)
+	assert.Equal(int64(1), desc.SerialVersionUID)
+	assert.Len(desc.Fields, 2)
+	assert.Equal("value", desc.Fields[0].Name)
+	assert.Equal("LList;", desc.Fields[1].ClassName.(*String).Value)
+
+	values := obj.ClassData[0].Values
+	assert.Equal(int32(17), values[0].Primitive)
+	next := values[1].Object.(*Object)
+	assert.Equal(int32(0x7e0003), next.Handle)
+	assert.Equal(desc, Resolve(next.Class))
+	assert.IsType(&Null{}, next.ClassData[0].Values[1].Object)
+
+	ref := contents[1].(*Reference)
+	assert.Equal(int32(0x7e0003), ref.Handle)
+	assert.Equal(next, ref.Target)
+}
+
+func TestParse_CustomData(t *testing.T) {
+	assert := assert.New(t)
+	contents := parseFile(t, "custom_read_object.ser")
+	obj := contents[0].(*Object)
+	hierarchy := Resolve(obj.Class).Hierarchy()
+	if !assert.Len(hierarchy, 2) || !assert.Len(obj.ClassData, 2) {
+		return
+	}
+	assert.Equal("A", hierarchy[0].Name)
+	assert.Equal("B", hierarchy[1].Name)
+	assert.Equal("world", obj.ClassData[0].Values[0].Object.(*String).Value)
+	annotations := obj.ClassData[1].Annotations
+	if assert.Len(annotations, 1) {
+		assert.Equal([]byte{0, 0, 0, 1}, annotations[0].(*BlockData).Data)
+	}
+}
+
+func TestParse_Enum(t *testing.T) {
+	assert := assert.New(t)
+	contents := parseFile(t, "time_unit.ser")
+	enum := contents[0].(*Enum)
+	assert.Equal("java.util.concurrent.TimeUnit", Resolve(enum.Class).Name)
+	assert.Equal("SECONDS", enum.Constant.(*String).Value)
+}
+
+func TestParse_ByteArray(t *testing.T) {
+	assert := assert.New(t)
+	contents := parseFile(t, "byte_array.ser")
+	array := contents[0].(*Array)
+	assert.Equal([]byte{0xde, 0xad, 0xbe, 0xef}, array.Bytes)
+	assert.Equal(int64(0x1b), array.BytesPos)
+	assert.Nil(array.Values)
+}
+
+func TestParse_ModifiedUTF8(t *testing.T) {
+	assert := assert.New(t)
+	// "\x00" followed by U+1F600 encoded as a surrogate pair.
+	p, _ := hex.DecodeString("aced0005740008c080eda0bdedb880")
+	contents, err := Parse(bytes.NewReader(p))
+	if assert.NoError(err) {
+		assert.Equal("\x00\U0001F600", contents[0].(*String).Value)
+	}
+}
+
+func TestParse_Malformed(t *testing.T) {
+	assert := assert.New(t)
+	for _, test := range []struct {
+		name   string
+		stream string
+		offset int64
+	}{
+		{"bad type code", "aced00057f", 4},
+		{"dangling reference", "aced0005710007e00000", 5},
+		{"truncated class descriptor", "aced000575720002", -1},
+	} {
+		p, _ := hex.DecodeString(test.stream)
+		_, err := Parse(bytes.NewReader(p))
+		if !assert.Error(err, test.name) {
+			continue
+		}
+		if test.offset >= 0 {
+			if syntaxErr, ok := err.(*SyntaxError); assert.True(ok, test.name) {
+				assert.Equal(test.offset, syntaxErr.Offset, test.name)
+			}
+		}
+	}
+}
+
+func TestParse_Truncated(t *testing.T) {
+	assert := assert.New(t)
+	p, _ := hex.DecodeString("aced0005740003616263740003")
+	contents, err := Parse(bytes.NewReader(p))
+	assert.Error(err)
+	if assert.Len(contents, 2) {
+		assert.Equal("abc", contents[0].(*String).Value)
+	}
+}
@@ -1,5 +1,11 @@
 package javaio
 
+import (
+	"reflect"
+	"runtime"
+	"sync"
+)
+
 type Serializable struct {
 	Value interface{} `javaio:"-"`
 }
@@ -11,3 +17,85 @@ func (Serializable) ClassName() string {
 func (Serializable) SerialVersionUID() int64 {
 	return 1196656838076753133
 }
+
+// NonSerializable is implemented by the superclass part of objects whose
+// Java superclass does not implement java.io.Serializable. Such a
+// superclass, and its own superclasses, have neither a class descriptor nor
+// data in the stream.
+type NonSerializable interface {
+	NonSerializable()
+}
+
+// A Constructor is a NonSerializable superclass with a constructor. The
+// Decoder calls Construct on the superclass part of each object it reads,
+// like the no-arg constructor that ObjectInputStream calls.
+type Constructor interface {
+	NonSerializable
+	Construct()
+}
+
+// ClassModifiers is implemented by types whose Java class is not public.
+// ClassModifiers returns the modifiers of the class, as returned by
+// Class.getModifiers. The serialVersionUID of an array class depends on
+// whether its component class is public; classes of types that do not
+// implement ClassModifiers are taken to be public.
+type ClassModifiers interface {
+	ClassModifiers() int32
+}
+
+// Modifiers, as defined by java.lang.reflect.Modifier.
+const (
+	modifierPublic   = 0x0001
+	modifierFinal    = 0x0010
+	modifierAbstract = 0x0400
+)
+
+var nonSerializableType = reflect.TypeOf((*NonSerializable)(nil)).Elem()
+
+// isNonSerializable reports whether the type of the superclass part sup,
+// or a pointer to it, implements NonSerializable.
+func isNonSerializable(sup interface{}) bool {
+	return reflect.PtrTo(unpackPointerType(reflect.TypeOf(sup))).Implements(nonSerializableType)
+}
+
+type methodKey struct {
+	typ    reflect.Type
+	method string
+}
+
+var declaresCache sync.Map // map[methodKey]bool
+
+// declares reports whether the type of object declares the named method
+// itself, with a value or a pointer receiver, rather than having it
+// promoted from an embedded field. A struct that embeds its superclass
+// must not take on the SerialVersionUID or the WriteObject of its parent.
+func declares(object interface{}, method string) bool {
+	typ := unpackPointerType(reflect.TypeOf(object))
+	if typ.Kind() != reflect.Struct {
+		return true
+	}
+	key := methodKey{typ, method}
+	if declared, ok := declaresCache.Load(key); ok {
+		return declared.(bool)
+	}
+	declared := false
+	for _, t := range []reflect.Type{typ, reflect.PtrTo(typ)} {
+		// The compiler generates the promoted methods, and the methods of
+		// *T that call those of T.
+		if m, ok := t.MethodByName(method); ok && !isGenerated(m.Func.Pointer()) {
+			declared = true
+			break
+		}
+	}
+	declaresCache.Store(key, declared)
+	return declared
+}
+
+func isGenerated(pc uintptr) bool {
+	f := runtime.FuncForPC(pc)
+	if f == nil {
+		return false
+	}
+	file, _ := f.FileLine(f.Entry())
+	return file == "<autogenerated>"
+}
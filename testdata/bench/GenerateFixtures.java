@@ -0,0 +1,75 @@
+// GenerateFixtures writes the streams used by the Java fixture benchmarks
+// and tests in bench_test.go. The graphs must match the ones built by
+// benchList, benchGraph and benchLinkedList.
+//
+// Usage: make bench-fixtures
+
+import java.io.FileOutputStream;
+import java.io.IOException;
+import java.io.ObjectOutputStream;
+import java.io.Serializable;
+import java.util.LinkedList;
+
+class List implements Serializable {
+    private static final long serialVersionUID = 1L;
+
+    int value;
+    List next;
+}
+
+class BenchRecord implements Serializable {
+    private static final long serialVersionUID = 1L;
+
+    int id;
+    long count;
+    double score;
+    boolean active;
+    String name;
+    BenchRecord parent;
+}
+
+public class GenerateFixtures {
+    public static void main(String[] args) throws IOException {
+        String dir = args.length > 0 ? args[0] : ".";
+
+        List list = null;
+        for (int i = 999; i >= 0; i--) {
+            List node = new List();
+            node.value = i;
+            node.next = list;
+            list = node;
+        }
+        write(dir + "/list_1000.ser", list);
+
+        String[] names = new String[16];
+        for (int i = 0; i < names.length; i++) {
+            names[i] = "record-" + i;
+        }
+        BenchRecord[] records = new BenchRecord[5000];
+        for (int i = 0; i < records.length; i++) {
+            BenchRecord record = new BenchRecord();
+            record.id = i;
+            record.count = i * 1000L;
+            record.score = i / 3.0;
+            record.active = i % 2 == 0;
+            record.name = names[i % names.length];
+            if (i > 0) {
+                record.parent = records[i - 1];
+            }
+            records[i] = record;
+        }
+        write(dir + "/records_5000.ser", records);
+
+        LinkedList<String> linkedList = new LinkedList<>();
+        for (int i = 0; i < 1000; i++) {
+            linkedList.add(Integer.toString(i));
+        }
+        write(dir + "/linked_list_1000.ser", linkedList);
+    }
+
+    private static void write(String name, Object object) throws IOException {
+        try (ObjectOutputStream out = new ObjectOutputStream(new FileOutputStream(name))) {
+            out.writeObject(object);
+        }
+    }
+}